@@ -17,16 +17,56 @@
 
 package clients
 
+import (
+	"context"
+	"fmt"
+)
+
 /*
  * clients must implement this constructor
  * NewClient(cfg config.Config) (clients.Client, error)
  */
 
-// clients must implement this interface.
+// clients must implement this interface.  Every method takes a context,
+// once the context is cancelled or its deadline expires no new work is
+// started and the method returns the context error.
 type Client interface {
-	Close() error
-	Login() error
-	Install() error
-	PreInstall() error
-	PostInstall() error
+	Close(ctx context.Context) error
+	Login(ctx context.Context) error
+	Install(ctx context.Context) error
+	PreInstall(ctx context.Context) error
+	PostInstall(ctx context.Context) error
+}
+
+// Bindings are the certificates in use on a TrueNAS host.
+type Bindings struct {
+	Version        string
+	UICertificate  string   // the name of the UI certificate
+	FTPCertificate string   // the name of the FTP certificate, empty if none is set
+	Apps           []string // the installed apps using a certificate
+}
+
+// clients may implement this interface to report the certificates in use,
+// the init command shows them.
+type Inspector interface {
+	Bindings(ctx context.Context) (*Bindings, error)
+}
+
+// CertificateName returns the name of a certificate given by the value of a
+// setting, either a certificate ID or an object with a name, and the names
+// of the certificates by ID.  An empty string is returned for an unset value.
+func CertificateName(v interface{}, names map[int64]string) string {
+	switch t := v.(type) {
+	case float64:
+		if name, ok := names[int64(t)]; ok {
+			return name
+		}
+		return fmt.Sprintf("certificate ID %d", int64(t))
+	case map[string]interface{}:
+		if name, ok := t["name"].(string); ok {
+			return name
+		}
+		return CertificateName(t["id"], names)
+	}
+	return ""
 }
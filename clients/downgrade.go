@@ -0,0 +1,172 @@
+/*
+ * Copyright (C) 2025 by John J. Rushford jrushford@apache.org
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package clients
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+	"tnascert-deploy/config"
+)
+
+// BoundCertificate is a certificate used by a TrueNAS service.
+type BoundCertificate struct {
+	Service string // UI or FTP
+	Name    string
+	PEM     string // the certificate chain
+}
+
+// clients may implement this interface to return the certificates bound to
+// the UI and FTP services, the deployment then refuses to replace them with
+// an older certificate.
+type CertificateFetcher interface {
+	BoundCertificates(ctx context.Context) ([]BoundCertificate, error)
+}
+
+// CertificateRecord is a certificate returned by the certificate query of
+// the TrueNAS API.
+type CertificateRecord struct {
+	ID          int64  `json:"id"`
+	Name        string `json:"name"`
+	Certificate string `json:"certificate"`
+}
+
+// Bound returns the certificates of the records bound to the UI and FTP
+// services given by the values of the ui_certificate and ssltls_certificate
+// settings.
+func Bound(records []CertificateRecord, ui interface{}, ftp interface{}) []BoundCertificate {
+	var bound []BoundCertificate
+	for _, s := range []struct {
+		service string
+		value   interface{}
+	}{{"UI", ui}, {"FTP", ftp}} {
+		id, ok := CertificateID(s.value)
+		if !ok {
+			continue
+		}
+		for _, r := range records {
+			if r.ID == id {
+				bound = append(bound, BoundCertificate{Service: s.service, Name: r.Name, PEM: r.Certificate})
+			}
+		}
+	}
+	return bound
+}
+
+// CertificateID returns the certificate ID of the value of a setting, either
+// a certificate ID or an object with an id, false for an unset value.
+func CertificateID(v interface{}) (int64, bool) {
+	switch t := v.(type) {
+	case float64:
+		return int64(t), true
+	case map[string]interface{}:
+		return CertificateID(t["id"])
+	}
+	return 0, false
+}
+
+// CheckDowngrade returns an error when the certificate to deploy would
+// replace a bound certificate that expires later or covers names that it
+// does not.  Only the services that the deployment changes are checked, and
+// the truenas_default and self-signed certificates are never compared, so a
+// first deployment on a stock NAS is allowed.
+func CheckDowngrade(ctx context.Context, cfg *config.Config, bound []BoundCertificate) error {
+	leaf, err := loadLeaf(ctx, cfg)
+	if err != nil {
+		return fmt.Errorf("error loading the certificate: %v", err)
+	}
+
+	var errs []error
+	for _, b := range bound {
+		if (b.Service == "UI" && !cfg.AddAsUiCertificate) || (b.Service == "FTP" && !cfg.AddAsFTPCertificate) {
+			continue
+		}
+		block, _ := pem.Decode([]byte(b.PEM))
+		if block == nil {
+			return fmt.Errorf("the %s certificate '%s' has no PEM certificate", b.Service, b.Name)
+		}
+		current, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return fmt.Errorf("error parsing the %s certificate '%s': %v", b.Service, b.Name, err)
+		}
+		if b.Name == defaultCertName || selfSigned(current) {
+			if cfg.Debug {
+				log.Printf("the %s certificate '%s' is a default or self-signed certificate, not comparing it", b.Service, b.Name)
+			}
+			continue
+		}
+
+		if leaf.NotAfter.Before(current.NotAfter) {
+			errs = append(errs, fmt.Errorf("the certificate expires on %s, before the %s certificate '%s' that expires on %s",
+				leaf.NotAfter.Format(time.RFC3339), b.Service, b.Name, current.NotAfter.Format(time.RFC3339)))
+		}
+		if missing := uncoveredNames(leaf, current); len(missing) > 0 {
+			errs = append(errs, fmt.Errorf("the certificate does not cover '%s' covered by the %s certificate '%s'",
+				strings.Join(missing, "', '"), b.Service, b.Name))
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("refusing to replace a newer certificate, use --allow-downgrade to deploy it anyway: %w", errors.Join(errs...))
+	}
+	return nil
+}
+
+// the name of the certificate that TrueNAS generates on installation.
+const defaultCertName = "truenas_default"
+
+// returns the names of current that leaf does not cover.
+func uncoveredNames(leaf *x509.Certificate, current *x509.Certificate) []string {
+	leafNames := coveredNames(leaf)
+	var missing []string
+	for _, name := range coveredNames(current) {
+		covered := false
+		for _, n := range leafNames {
+			if strings.EqualFold(n, name) {
+				covered = true
+				break
+			}
+		}
+		// a wildcard name is only covered by the same wildcard, other names
+		// also by the wildcards of leaf
+		if !covered && !strings.HasPrefix(name, "*.") {
+			covered = leaf.VerifyHostname(name) == nil
+		}
+		if !covered {
+			missing = append(missing, name)
+		}
+	}
+	return missing
+}
+
+// returns the DNS names and IP addresses of a certificate, or its common
+// name when it has no subject alternative names.
+func coveredNames(c *x509.Certificate) []string {
+	names := append([]string(nil), c.DNSNames...)
+	for _, ip := range c.IPAddresses {
+		names = append(names, ip.String())
+	}
+	if len(names) == 0 && c.Subject.CommonName != "" {
+		names = append(names, c.Subject.CommonName)
+	}
+	return names
+}
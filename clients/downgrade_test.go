@@ -0,0 +1,92 @@
+/*
+ * Copyright (C) 2025 by John J. Rushford jrushford@apache.org
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package clients
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/pem"
+	"strings"
+	"testing"
+	"time"
+)
+
+// returns the PEM of a test certificate.
+func certPem(c *testCert) string {
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.cert.Raw}))
+}
+
+func TestCheckDowngrade(t *testing.T) {
+	now := time.Now()
+	root := issue(t, "Test Root", "", ecKey(t), now.Add(-time.Hour), now.AddDate(2, 0, 0), nil)
+	longer := issue(t, "nas01", "nas01.example.com", ecKey(t), now.Add(-time.Hour), now.AddDate(0, 3, 0), root)
+	shorter := issue(t, "nas01", "nas01.example.com", ecKey(t), now.Add(-time.Hour), now.AddDate(0, 2, 0), root)
+	wildcard := issue(t, "wildcard", "*.example.com", ecKey(t), now.Add(-time.Hour), now.AddDate(0, 4, 0), root)
+	other := issue(t, "nas02", "nas02.example.com", ecKey(t), now.Add(-time.Hour), now.AddDate(0, 4, 0), root)
+	// like the truenas_default certificate, self-signed for 10 years
+	selfSigned := issue(t, "localhost", "truenas.local", ecKey(t), now.Add(-time.Hour), now.AddDate(10, 0, 0), nil)
+
+	deployed := "tnas-cert-deploy-2025-01-01-1735689600"
+	tests := []struct {
+		local   *testCert
+		bound   BoundCertificate
+		refused string
+	}{
+		{longer, BoundCertificate{"UI", deployed, certPem(shorter)}, ""},
+		{longer, BoundCertificate{"UI", deployed, certPem(longer)}, ""},
+		{shorter, BoundCertificate{"UI", deployed, certPem(longer)}, "expires on"},
+		{wildcard, BoundCertificate{"UI", deployed, certPem(shorter)}, ""},
+		{other, BoundCertificate{"UI", deployed, certPem(shorter)}, "does not cover 'nas01.example.com'"},
+		{longer, BoundCertificate{"UI", deployed, certPem(wildcard)}, "does not cover '*.example.com'"},
+		// a manually imported certificate is compared too
+		{shorter, BoundCertificate{"UI", "imported-by-hand", certPem(longer)}, "expires on"},
+		// the default and self-signed certificates are not compared
+		{shorter, BoundCertificate{"UI", "truenas_default", certPem(selfSigned)}, ""},
+		{shorter, BoundCertificate{"UI", "truenas_default", certPem(longer)}, ""},
+		{shorter, BoundCertificate{"UI", "imported-by-hand", certPem(selfSigned)}, ""},
+		{shorter, BoundCertificate{"UI", deployed, certPem(selfSigned)}, ""},
+		// the certificates of the services left unchanged are not compared
+		{shorter, BoundCertificate{"FTP", deployed, certPem(longer)}, ""},
+	}
+	for _, test := range tests {
+		cfg := writeChain(t, test.local, root)
+		cfg.CertBasename = "tnas-cert-deploy"
+		err := CheckDowngrade(context.Background(), cfg, []BoundCertificate{test.bound})
+		if test.refused == "" && err != nil {
+			t.Errorf("replacing the %s certificate '%s' with %s should be allowed: %v", test.bound.Service, test.bound.Name, test.local.cert.DNSNames, err)
+		}
+		if test.refused != "" && (err == nil || !strings.Contains(err.Error(), test.refused) || !strings.Contains(err.Error(), "--allow-downgrade")) {
+			t.Errorf("replacing the %s certificate '%s' with %s should be refused with '%s', got: %v", test.bound.Service, test.bound.Name, test.local.cert.DNSNames, test.refused, err)
+		}
+	}
+}
+
+func TestBound(t *testing.T) {
+	records := []CertificateRecord{{1, "truenas_default", "default pem"}, {7, "tnascert", "deployed pem"}}
+	var ui, ftp interface{}
+	json.Unmarshal([]byte(`{"id": 7, "name": "tnascert"}`), &ui)
+	json.Unmarshal([]byte(`1`), &ftp)
+
+	bound := Bound(records, ui, ftp)
+	if len(bound) != 2 || bound[0] != (BoundCertificate{"UI", "tnascert", "deployed pem"}) || bound[1] != (BoundCertificate{"FTP", "truenas_default", "default pem"}) {
+		t.Errorf("unexpected bound certificates: %+v", bound)
+	}
+	if bound = Bound(records, ui, nil); len(bound) != 1 {
+		t.Errorf("an unset ssltls_certificate should not be bound: %+v", bound)
+	}
+}
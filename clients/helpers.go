@@ -18,42 +18,250 @@
 package clients
 
 import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
+	"errors"
 	"fmt"
 	"log"
+	"net/http"
+	"strings"
 	"time"
+	"tnascert-deploy/config"
 )
 
-func VerifyCertificateKeyPair(cert_path string, key_path string) error {
-	cert, err := tls.LoadX509KeyPair(cert_path, key_path)
+// Severity tells whether a preflight problem aborts the deployment.
+type Severity string
+
+const (
+	SeverityWarning Severity = "warning" // aborts with preflight_policy = strict
+	SeverityError   Severity = "error"   // always aborts
+)
+
+// Problem is a problem of the certificate found by the preflight.
+type Problem struct {
+	Severity Severity
+	Check    string // the check finding the problem, such as "chain order"
+	Message  string
+}
+
+// PreflightReport lists the problems of the certificate to deploy.
+type PreflightReport struct {
+	Problems []Problem
+}
+
+func (r *PreflightReport) add(severity Severity, check string, format string, a ...any) {
+	r.Problems = append(r.Problems, Problem{Severity: severity, Check: check, Message: fmt.Sprintf(format, a...)})
+}
+
+// Err returns the problems aborting the deployment, the errors and, with
+// the strict policy, the warnings too.
+func (r *PreflightReport) Err(strict bool) error {
+	var errs []error
+	for _, p := range r.Problems {
+		if p.Severity == SeverityError || strict {
+			errs = append(errs, fmt.Errorf("%s: %s", p.Check, p.Message))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// the trusted roots completing the certificate chains, replaced by the tests.
+var systemRoots = x509.SystemCertPool
+
+// VerifyCertificateKeyPair checks the certificate and the private key of
+// cfg before they are deployed.  The problems of the preflight are logged,
+// the errors abort the deployment, as do the warnings with
+// preflight_policy = strict.
+func VerifyCertificateKeyPair(ctx context.Context, cfg *config.Config) error {
+	report, err := Preflight(ctx, cfg)
 	if err != nil {
-		return fmt.Errorf("LoadX509KeyPair error: %v", err)
+		return err
+	}
+	for _, p := range report.Problems {
+		log.Printf("certificate preflight %s, %s: %s", p.Severity, p.Check, p.Message)
+	}
+	if len(report.Problems) == 0 {
+		log.Printf("certificate preflight passed")
 	}
+	return report.Err(cfg.PreflightPolicy == "strict")
+}
 
-	c, err := x509.ParseCertificate(cert.Certificate[0])
+// Preflight checks that the private key matches the certificate and reports
+// the problems of the certificate chain: its order, a missing intermediate
+// or an included root, the validity period and the remaining validity, the
+// key type and size, and, for a UI certificate, the names covering the
+// connect_host.
+func Preflight(ctx context.Context, cfg *config.Config) (*PreflightReport, error) {
+	keyPair, err := cfg.LoadKeyPair(ctx)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := tls.X509KeyPair(keyPair.CertificatePEM, keyPair.PrivateKeyPEM)
 	if err != nil {
-		return fmt.Errorf("certificate parsing error: %v", err)
+		return nil, fmt.Errorf("X509KeyPair error: %v", err)
+	}
+	var chain []*x509.Certificate
+	for _, der := range cert.Certificate {
+		c, err := x509.ParseCertificate(der)
+		if err != nil {
+			return nil, fmt.Errorf("certificate parsing error: %v", err)
+		}
+		chain = append(chain, c)
+	}
+	leaf := chain[0]
+	report := &PreflightReport{}
+	now := time.Now()
+
+	// the validity period
+	for i, c := range chain {
+		switch {
+		case now.After(c.NotAfter) && i == 0:
+			report.add(SeverityError, "validity", "the certificate expired on %s, a new up to date certificate is needed", c.NotAfter.Format(time.RFC3339))
+		case now.After(c.NotAfter):
+			report.add(SeverityError, "validity", "the intermediate certificate '%s' expired on %s", c.Subject.CommonName, c.NotAfter.Format(time.RFC3339))
+		case now.Before(c.NotBefore):
+			report.add(SeverityError, "validity", "the certificate '%s' is not valid before %s", c.Subject.CommonName, c.NotBefore.Format(time.RFC3339))
+		}
+	}
+	if remaining := leaf.NotAfter.Sub(now); remaining > 0 && remaining < cfg.PreflightMinValidity {
+		report.add(SeverityWarning, "remaining validity", "the certificate expires in %v, less than the preflight_min_validity of %v",
+			remaining.Round(time.Minute), cfg.PreflightMinValidity)
+	}
+
+	// the key type and size
+	switch key := leaf.PublicKey.(type) {
+	case *rsa.PublicKey:
+		if bits := key.N.BitLen(); bits < 2048 {
+			report.add(SeverityError, "key", "the RSA key has %d bits, at least 2048 are needed", bits)
+		}
+	case *ecdsa.PublicKey:
+		if curve := key.Curve.Params().Name; curve != "P-256" && curve != "P-384" {
+			report.add(SeverityWarning, "key", "the ECDSA key uses the %s curve, many clients only support P-256 and P-384", curve)
+		}
+	case ed25519.PublicKey:
+		report.add(SeverityWarning, "key", "the Ed25519 key is not supported by the web browsers")
+	default:
+		report.add(SeverityError, "key", "the %T key type is not supported", key)
 	}
-	if time.Now().After(c.NotAfter) {
-		return fmt.Errorf("Your certificate expired, a new up to date certificate is needed")
+
+	// the chain goes from the leaf to the last intermediate
+	for i := 1; i < len(chain); i++ {
+		if chain[i-1].CheckSignatureFrom(chain[i]) != nil {
+			report.add(SeverityWarning, "chain order", "certificate %d of the chain, '%s', did not issue certificate %d, '%s', the chain must go from the leaf to its issuers",
+				i+1, chain[i].Subject.CommonName, i, chain[i-1].Subject.CommonName)
+		}
+	}
+	last := chain[len(chain)-1]
+	if selfSigned(last) {
+		if len(chain) > 1 {
+			report.add(SeverityWarning, "root included", "the chain includes the root '%s', the clients already have it", last.Subject.CommonName)
+		}
+	} else {
+		roots, err := systemRoots()
+		if err != nil {
+			log.Printf("could not load system certificate pool, %v", err)
+		}
+		intermediates := x509.NewCertPool()
+		for _, c := range chain[1:] {
+			intermediates.AddCert(c)
+		}
+		_, err = leaf.Verify(x509.VerifyOptions{Roots: roots, Intermediates: intermediates, CurrentTime: now})
+		var unknownAuthority x509.UnknownAuthorityError
+		switch {
+		case errors.As(err, &unknownAuthority) && len(chain) == 1:
+			report.add(SeverityError, "missing intermediate", "the chain only holds the leaf certificate, the certificate of its issuer '%s' is missing", leaf.Issuer.CommonName)
+		case errors.As(err, &unknownAuthority):
+			report.add(SeverityWarning, "missing intermediate", "the issuer '%s' of '%s' is neither in the chain nor a trusted root", last.Issuer.CommonName, last.Subject.CommonName)
+		case err == nil:
+			log.Printf("certificate verified successfully")
+		}
+	}
+
+	// the names of a UI certificate cover the connect_host
+	if cfg.AddAsUiCertificate {
+		for _, host := range cfg.ConnectHosts() {
+			if leaf.VerifyHostname(host) != nil {
+				report.add(SeverityWarning, "names", "the certificate names %s do not cover the connect_host %s", certificateNames(leaf), host)
+			}
+		}
+	}
+	return report, nil
+}
+
+// reports whether a certificate is signed by its own key.
+func selfSigned(c *x509.Certificate) bool {
+	return bytes.Equal(c.RawIssuer, c.RawSubject) && c.CheckSignature(c.SignatureAlgorithm, c.RawTBSCertificate, c.Signature) == nil
+}
+
+// returns the DNS names and IP addresses of a certificate.
+func certificateNames(c *x509.Certificate) string {
+	names := append([]string(nil), c.DNSNames...)
+	for _, ip := range c.IPAddresses {
+		names = append(names, ip.String())
+	}
+	if len(names) == 0 {
+		return "(none)"
+	}
+	return "'" + strings.Join(names, "', '") + "'"
+}
+
+// VerifyServedCertificate connects to address, such as the virtual IP of a
+// TrueNAS HA pair, and checks that it serves the certificate deployed with
+// cfg.  The connection uses the proxy and the client certificate of cfg
+// like the API connections, the served certificate is only compared with
+// the deployed one.
+func VerifyServedCertificate(ctx context.Context, address string, cfg *config.Config) error {
+	leaf, err := loadLeaf(ctx, cfg)
+	if err != nil {
+		return err
 	}
 
-	roots, err := x509.SystemCertPool()
+	tlsConfig, err := TLSConfig(cfg)
 	if err != nil {
-		log.Printf("could not load system certificate pool, %v", err)
+		return err
 	}
-	opts := x509.VerifyOptions{
-		CurrentTime: time.Now(),
-		Roots:       roots,
+	// the served certificate is compared with the deployed one, neither
+	// verified nor pinned
+	tlsConfig.InsecureSkipVerify = true
+	tlsConfig.VerifyConnection = nil
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = ProxyFunc(cfg)
+	transport.TLSClientConfig = tlsConfig
+	httpClient := &http.Client{Transport: transport}
+	defer httpClient.CloseIdleConnections()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, "https://"+address+"/", nil)
+	if err != nil {
+		return fmt.Errorf("could not connect to %s: %v", address, err)
 	}
-	_, err = c.Verify(opts)
-	// report certificate validation information.
+	resp, err := httpClient.Do(req)
 	if err != nil {
-		log.Printf("certificate verification: %v", err)
-	} else {
-		log.Printf("certificate verified successfully")
+		return fmt.Errorf("could not connect to %s: %w", address, err)
 	}
+	resp.Body.Close()
 
+	if resp.TLS == nil || len(resp.TLS.PeerCertificates) == 0 {
+		return fmt.Errorf("%s did not send a certificate", address)
+	}
+	served := resp.TLS.PeerCertificates
+	if !bytes.Equal(served[0].Raw, leaf.Raw) {
+		return fmt.Errorf("%s serves the certificate with SHA-256 fingerprint %x, not the deployed certificate %x",
+			address, sha256.Sum256(served[0].Raw), sha256.Sum256(leaf.Raw))
+	}
 	return nil
 }
+
+// returns the leaf certificate of the key pair to deploy.
+func loadLeaf(ctx context.Context, cfg *config.Config) (*x509.Certificate, error) {
+	chain, err := cfg.LoadChain(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return chain[0], nil
+}
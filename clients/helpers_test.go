@@ -18,8 +18,26 @@
 package clients
 
 import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
 	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
 	"testing"
+	"time"
 	"tnascert-deploy/config"
 )
 
@@ -42,9 +60,208 @@ func TestVerifyCertificate(t *testing.T) {
 		t.Errorf("error loading config file: %v", err)
 	}
 
-	err = VerifyCertificateKeyPair(cfg.FullChainPath, cfg.PrivateKeyPath)
+	err = VerifyCertificateKeyPair(context.Background(), cfg)
 	if err != nil {
 		t.Errorf("VerifyCertificatKeyPair() test failed: %v", err)
 	}
 
 }
+
+func TestVerifyServedCertificate(t *testing.T) {
+	cfg, err := getConfig()
+	if err != nil {
+		t.Fatalf("error loading config file: %v", err)
+	}
+	cert, err := tls.LoadX509KeyPair(cfg.FullChainPath, cfg.PrivateKeyPath)
+	if err != nil {
+		t.Fatalf("error loading the test certificate: %v", err)
+	}
+	server := httptest.NewUnstartedServer(http.NotFoundHandler())
+	server.TLS = &tls.Config{Certificates: []tls.Certificate{cert}}
+	server.StartTLS()
+	defer server.Close()
+	address := server.Listener.Addr().String()
+
+	err = VerifyServedCertificate(context.Background(), address, cfg)
+	if err != nil {
+		t.Errorf("VerifyServedCertificate() should find the deployed certificate: %v", err)
+	}
+	other := &config.Config{FullChainPath: "test_files/expired-cert.pem", PrivateKeyPath: "test_files/expired-key.pem"}
+	err = VerifyServedCertificate(context.Background(), address, other)
+	if err == nil || !strings.Contains(err.Error(), "not the deployed certificate") {
+		t.Errorf("VerifyServedCertificate() should report another certificate, got %v", err)
+	}
+
+	// the verify_host is reached through the proxy, presenting the client
+	// certificate
+	server.Close()
+	server = httptest.NewUnstartedServer(http.NotFoundHandler())
+	server.TLS = &tls.Config{Certificates: []tls.Certificate{cert}, ClientAuth: tls.RequireAnyClientCert}
+	server.StartTLS()
+	defer server.Close()
+	p := &connectProxy{backend: server.Listener.Addr().String(), hosts: make(chan string, 2), auth: make(chan string, 2)}
+	proxyServer := httptest.NewServer(p)
+	defer proxyServer.Close()
+	cfg.Proxy = "http://" + proxyServer.Listener.Addr().String()
+	if err = VerifyServedCertificate(context.Background(), "vip.example:443", cfg); err == nil {
+		t.Errorf("VerifyServedCertificate() without the client certificate should fail")
+	}
+	cfg.ClientCertPath = cfg.FullChainPath
+	cfg.ClientKeyPath = cfg.PrivateKeyPath
+	if err = VerifyServedCertificate(context.Background(), "vip.example:443", cfg); err != nil {
+		t.Errorf("VerifyServedCertificate() through the proxy failed: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if host := <-p.hosts; host != "vip.example:443" {
+			t.Errorf("the proxy was asked for %s", host)
+		}
+	}
+}
+
+// a certificate issued for the tests and its key.
+type testCert struct {
+	cert *x509.Certificate
+	key  crypto.Signer
+}
+
+// issues a test certificate for name valid from notBefore to notAfter, a CA
+// certificate when dnsName is empty.  It is self-signed without a parent.
+func issue(t *testing.T, name string, dnsName string, key crypto.Signer, notBefore time.Time, notAfter time.Time, parent *testCert) *testCert {
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    notBefore,
+		NotAfter:     notAfter,
+	}
+	if dnsName == "" {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage = x509.KeyUsageCertSign
+	} else {
+		template.DNSNames = []string{dnsName}
+		template.KeyUsage = x509.KeyUsageDigitalSignature
+	}
+	issuer, signer := template, key
+	if parent != nil {
+		issuer, signer = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, issuer, key.Public(), signer)
+	if err != nil {
+		t.Fatalf("error issuing the %s certificate: %v", name, err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCert{cert: cert, key: key}
+}
+
+func ecKey(t *testing.T) crypto.Signer {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// writes the chain and the key of its first certificate, returning the
+// configuration deploying them as the UI certificate of nas01.example.com.
+func writeChain(t *testing.T, chain ...*testCert) *config.Config {
+	dir := t.TempDir()
+	var certPem []byte
+	for _, c := range chain {
+		certPem = append(certPem, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.cert.Raw})...)
+	}
+	keyDer, err := x509.MarshalPKCS8PrivateKey(chain[0].key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &config.Config{
+		FullChainPath:        filepath.Join(dir, "fullchain.pem"),
+		PrivateKeyPath:       filepath.Join(dir, "privkey.pem"),
+		ConnectHost:          "nas01.example.com",
+		AddAsUiCertificate:   true,
+		PreflightMinValidity: 7 * 24 * time.Hour,
+	}
+	if err = os.WriteFile(cfg.FullChainPath, certPem, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(cfg.PrivateKeyPath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return cfg
+}
+
+func TestPreflight(t *testing.T) {
+	now := time.Now()
+	year := now.AddDate(1, 0, 0)
+	root := issue(t, "Test Root", "", ecKey(t), now.Add(-time.Hour), year, nil)
+	int1 := issue(t, "Test Intermediate 1", "", ecKey(t), now.Add(-time.Hour), year, root)
+	int2 := issue(t, "Test Intermediate 2", "", ecKey(t), now.Add(-time.Hour), year, int1)
+	leaf := issue(t, "nas01", "nas01.example.com", ecKey(t), now.Add(-time.Hour), year, int2)
+	future := issue(t, "nas01", "nas01.example.com", ecKey(t), now.Add(time.Hour), year, int2)
+	expiring := issue(t, "nas01", "nas01.example.com", ecKey(t), now.Add(-time.Hour), now.Add(48*time.Hour), int2)
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	weak := issue(t, "nas01", "nas01.example.com", rsaKey, now.Add(-time.Hour), year, int2)
+
+	// the test root is the only trusted root
+	defer func(roots func() (*x509.CertPool, error)) { systemRoots = roots }(systemRoots)
+	systemRoots = func() (*x509.CertPool, error) {
+		pool := x509.NewCertPool()
+		pool.AddCert(root.cert)
+		return pool, nil
+	}
+
+	tests := []struct {
+		name     string
+		chain    []*testCert
+		host     string
+		problems []string // the check and severity of the problems found
+	}{
+		{"complete chain", []*testCert{leaf, int2, int1}, "", nil},
+		{"root included", []*testCert{leaf, int2, int1, root}, "", []string{"root included warning"}},
+		{"wrong order", []*testCert{leaf, int1, int2}, "", []string{"chain order warning", "chain order warning"}},
+		{"leaf only", []*testCert{leaf}, "", []string{"missing intermediate error"}},
+		{"incomplete chain", []*testCert{leaf, int2}, "", []string{"missing intermediate warning"}},
+		{"not yet valid", []*testCert{future, int2, int1}, "", []string{"validity error"}},
+		{"expiring soon", []*testCert{expiring, int2, int1}, "", []string{"remaining validity warning"}},
+		{"weak key", []*testCert{weak, int2, int1}, "", []string{"key error"}},
+		{"other host", []*testCert{leaf, int2, int1}, "nas02.example.com", []string{"names warning"}},
+	}
+	for _, test := range tests {
+		cfg := writeChain(t, test.chain...)
+		if test.host != "" {
+			cfg.ConnectHost = test.host
+		}
+		report, err := Preflight(context.Background(), cfg)
+		if err != nil {
+			t.Errorf("%s: Preflight() failed: %v", test.name, err)
+			continue
+		}
+		var problems []string
+		for _, p := range report.Problems {
+			problems = append(problems, fmt.Sprintf("%s %s", p.Check, p.Severity))
+		}
+		if !slices.Equal(problems, test.problems) {
+			t.Errorf("%s: Preflight() found %v, expected %v", test.name, report.Problems, test.problems)
+		}
+	}
+
+	// the warnings only abort the deployment with the strict policy
+	cfg := writeChain(t, leaf, int2, int1, root)
+	if err = VerifyCertificateKeyPair(context.Background(), cfg); err != nil {
+		t.Errorf("VerifyCertificateKeyPair() should only warn: %v", err)
+	}
+	cfg.PreflightPolicy = "strict"
+	if err = VerifyCertificateKeyPair(context.Background(), cfg); err == nil || !strings.Contains(err.Error(), "root included") {
+		t.Errorf("VerifyCertificateKeyPair() should fail with the strict policy, got %v", err)
+	}
+	cfg = writeChain(t, leaf)
+	cfg.PreflightPolicy = "warn"
+	if err = VerifyCertificateKeyPair(context.Background(), cfg); err == nil || !strings.Contains(err.Error(), "missing intermediate") {
+		t.Errorf("VerifyCertificateKeyPair() should fail on an error, got %v", err)
+	}
+}
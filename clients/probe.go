@@ -0,0 +1,139 @@
+/*
+ * Copyright (C) 2025 by John J. Rushford jrushford@apache.org
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package clients
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+	"tnascert-deploy/config"
+
+	"github.com/gorilla/websocket"
+)
+
+// the endpoints probed to find the API served by a TrueNAS host.
+const (
+	wsProbeEndPoint   = "/api/current"
+	restProbeEndPoint = "/api/v2.0/core/ping"
+)
+
+// API is the client API and protocol found on a TrueNAS host.
+type API struct {
+	ClientApi string // wsapi or restapi
+	Protocol  string // wss, ws, https or http
+}
+
+// DetectAPI probes the connect_host and port of cfg for the JSON-RPC
+// websocket API at /api/current, served by TrueNAS 25.04 and later, and for
+// the REST API at /api/v2.0, served by TrueNAS CORE and older SCALE
+// releases.  The websocket API is preferred.  The protocol of cfg tells
+// whether TLS is used, when it is empty TLS is tried first and the
+// unencrypted protocols are only tried when the host does not speak TLS.  A
+// certificate that cannot be verified is returned as an error.  Each probe
+// must be answered within the connect_timeout.
+func DetectAPI(ctx context.Context, cfg *config.Config) (*API, error) {
+	address := net.JoinHostPort(cfg.ConnectHost, strconv.FormatUint(cfg.Port, 10))
+	tlsConfig, err := TLSConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	proxy := ProxyFunc(cfg)
+
+	protocols := [][2]string{{"wss", "https"}, {"ws", "http"}}
+	switch cfg.Protocol {
+	case "wss", "https":
+		protocols = protocols[:1]
+	case "ws", "http":
+		protocols = protocols[1:]
+	}
+	var errs []error
+	for _, api := range protocols {
+		wsProtocol, httpProtocol := api[0], api[1]
+		err := probeWebSocket(ctx, wsProtocol+"://"+address+wsProbeEndPoint, tlsConfig, proxy, cfg.ConnectTimeout)
+		if err == nil {
+			return &API{ClientApi: "wsapi", Protocol: wsProtocol}, nil
+		}
+		errs = append(errs, err)
+		if IsCertificateError(err) {
+			break
+		}
+		err = probeREST(ctx, httpProtocol+"://"+address+restProbeEndPoint, tlsConfig, proxy, cfg.ConnectTimeout)
+		if err == nil {
+			return &API{ClientApi: "restapi", Protocol: httpProtocol}, nil
+		}
+		errs = append(errs, err)
+		if IsCertificateError(err) {
+			break
+		}
+	}
+	return nil, fmt.Errorf("no TrueNAS API was found on %s: %w", address, errors.Join(errs...))
+}
+
+// IsCertificateError returns true when err is caused by a TLS certificate
+// that could not be verified or that does not match its pin.
+func IsCertificateError(err error) bool {
+	var verifyErr *tls.CertificateVerificationError
+	var pinErr *PinError
+	return errors.As(err, &verifyErr) || errors.As(err, &pinErr)
+}
+
+// returns nil if a websocket connection to url is accepted.
+func probeWebSocket(ctx context.Context, url string, tlsConfig *tls.Config, proxy proxyFunc, timeout time.Duration) error {
+	dialer := websocket.Dialer{
+		Proxy:            proxy,
+		TLSClientConfig:  tlsConfig,
+		HandshakeTimeout: timeout,
+	}
+	conn, resp, err := dialer.DialContext(ctx, url, nil)
+	if err != nil {
+		if resp != nil {
+			return fmt.Errorf("%s: %s", url, resp.Status)
+		}
+		return fmt.Errorf("%s: %w", url, err)
+	}
+	return conn.Close()
+}
+
+// returns nil if url answers like the REST API ping, with 'pong' or with an
+// authentication error.
+func probeREST(ctx context.Context, url string, tlsConfig *tls.Config, proxy proxyFunc, timeout time.Duration) error {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = proxy
+	transport.TLSClientConfig = tlsConfig
+	httpClient := &http.Client{Transport: transport, Timeout: timeout}
+	defer httpClient.CloseIdleConnections()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return fmt.Errorf("%s: %v", url, err)
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusUnauthorized {
+		return fmt.Errorf("%s: %s", url, resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,217 @@
+/*
+ * Copyright (C) 2025 by John J. Rushford jrushford@apache.org
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package clients
+
+import (
+	"context"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+	"tnascert-deploy/config"
+
+	"github.com/gorilla/websocket"
+)
+
+// returns a configuration connecting to the test server.
+func probeConfig(t *testing.T, server *httptest.Server, tlsSkipVerify bool) *config.Config {
+	host, port, err := net.SplitHostPort(server.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("invalid test server address: %v", err)
+	}
+	p, _ := strconv.ParseUint(port, 10, 64)
+	return &config.Config{ConnectHost: host, Port: p, TlsSkipVerify: tlsSkipVerify, ConnectTimeout: 5 * time.Second}
+}
+
+// a mock TrueNAS host serving the websocket API, the REST API or both.
+func apiHandler(ws bool, rest bool) http.Handler {
+	mux := http.NewServeMux()
+	if ws {
+		upgrader := websocket.Upgrader{}
+		mux.HandleFunc(wsProbeEndPoint, func(w http.ResponseWriter, r *http.Request) {
+			conn, err := upgrader.Upgrade(w, r, nil)
+			if err == nil {
+				conn.Close()
+			}
+		})
+	}
+	if rest {
+		mux.HandleFunc(restProbeEndPoint, func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+		})
+	}
+	return mux
+}
+
+func TestDetectAPI(t *testing.T) {
+	tests := []struct {
+		name      string
+		ws, rest  bool
+		tls       bool
+		clientApi string
+		protocol  string
+	}{
+		{"SCALE 25.04", true, true, true, "wsapi", "wss"},
+		{"CORE", false, true, true, "restapi", "https"},
+		{"SCALE 25.04 over http", true, true, false, "wsapi", "ws"},
+		{"CORE over http", false, true, false, "restapi", "http"},
+	}
+	for _, test := range tests {
+		server := httptest.NewUnstartedServer(apiHandler(test.ws, test.rest))
+		if test.tls {
+			server.StartTLS()
+		} else {
+			server.Start()
+		}
+		api, err := DetectAPI(context.Background(), probeConfig(t, server, true))
+		server.Close()
+		if err != nil {
+			t.Errorf("%s: DetectAPI() failed: %v", test.name, err)
+			continue
+		}
+		if api.ClientApi != test.clientApi || api.Protocol != test.protocol {
+			t.Errorf("%s: expected %s over %s, got %+v", test.name, test.clientApi, test.protocol, *api)
+		}
+	}
+
+	// the protocol tells whether TLS is used
+	server := httptest.NewServer(apiHandler(true, true))
+	cfg := probeConfig(t, server, true)
+	cfg.Protocol = "wss"
+	if _, err := DetectAPI(context.Background(), cfg); err == nil {
+		t.Errorf("expected no API to be found over TLS")
+	}
+	cfg.Protocol = "http"
+	if api, err := DetectAPI(context.Background(), cfg); err != nil || api.ClientApi != "wsapi" || api.Protocol != "ws" {
+		t.Errorf("expected wsapi over ws, got %v %v", api, err)
+	}
+	server.Close()
+
+	// an untrusted certificate is not downgraded to an unencrypted protocol
+	server = httptest.NewTLSServer(apiHandler(true, true))
+	defer server.Close()
+	_, err := DetectAPI(context.Background(), probeConfig(t, server, false))
+	if !IsCertificateError(err) {
+		t.Errorf("expected a certificate error, got %v", err)
+	}
+
+	// not a TrueNAS host
+	other := httptest.NewTLSServer(http.NotFoundHandler())
+	defer other.Close()
+	_, err = DetectAPI(context.Background(), probeConfig(t, other, true))
+	if err == nil {
+		t.Errorf("expected no API to be found")
+	}
+}
+
+// an HTTP CONNECT proxy stand-in tunneling every connection to backend,
+// whatever host is asked for.  The hosts asked for and the
+// Proxy-Authorization headers received are recorded.
+type connectProxy struct {
+	backend string
+	hosts   chan string
+	auth    chan string
+}
+
+func (p *connectProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodConnect {
+		http.Error(w, "CONNECT only", http.StatusMethodNotAllowed)
+		return
+	}
+	p.hosts <- r.Host
+	p.auth <- r.Header.Get("Proxy-Authorization")
+	backend, err := net.Dial("tcp", p.backend)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	conn, rw, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		backend.Close()
+		return
+	}
+	go func() {
+		io.Copy(backend, rw)
+		backend.Close()
+	}()
+	io.Copy(conn, backend)
+	conn.Close()
+}
+
+func TestProxyFunc(t *testing.T) {
+	dir := t.TempDir()
+	passwordFile := filepath.Join(dir, "proxy-password")
+	if err := os.WriteFile(passwordFile, []byte("s3cret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("NO_PROXY", "direct.example,.lan")
+	cfg := &config.Config{Proxy: "socks5://bastion@bastion.example:1080", ProxyPassword: "file:" + passwordFile}
+	proxy := ProxyFunc(cfg)
+
+	// the password is read from its secret reference
+	req := httptest.NewRequest(http.MethodGet, "https://nas01.example/api/v2.0/core/ping", nil)
+	u, err := proxy(req)
+	if err != nil {
+		t.Fatalf("ProxyFunc() failed: %v", err)
+	}
+	if password, _ := u.User.Password(); u.Scheme != "socks5" || u.Host != "bastion.example:1080" ||
+		u.User.Username() != "bastion" || password != "s3cret" {
+		t.Errorf("unexpected proxy URL %s", u.Redacted())
+	}
+
+	// NO_PROXY hosts are connected to directly
+	for _, host := range []string{"direct.example", "nas02.lan"} {
+		req = httptest.NewRequest(http.MethodGet, "https://"+host+"/api/current", nil)
+		if u, err = proxy(req); u != nil || err != nil {
+			t.Errorf("%s should not use the proxy, got %v %v", host, u, err)
+		}
+	}
+
+	// the websocket API is probed through the proxy
+	server := httptest.NewServer(apiHandler(true, false))
+	defer server.Close()
+	p := &connectProxy{backend: server.Listener.Addr().String(), hosts: make(chan string, 1), auth: make(chan string, 1)}
+	proxyServer := httptest.NewServer(p)
+	defer proxyServer.Close()
+
+	cfg = probeConfig(t, server, false)
+	cfg.ConnectHost = "nas01.example"
+	cfg.Protocol = "ws"
+	cfg.Proxy = "http://deploy@" + proxyServer.Listener.Addr().String()
+	cfg.ProxyPassword = "file:" + passwordFile
+	api, err := DetectAPI(context.Background(), cfg)
+	if err != nil {
+		t.Fatalf("DetectAPI() through the proxy failed: %v", err)
+	}
+	if api.ClientApi != "wsapi" {
+		t.Errorf("expected wsapi, got %+v", *api)
+	}
+	if host := <-p.hosts; host != "nas01.example:"+strconv.FormatUint(cfg.Port, 10) {
+		t.Errorf("the proxy was asked for %s", host)
+	}
+	if auth := <-p.auth; auth != "Basic "+base64.StdEncoding.EncodeToString([]byte("deploy:s3cret")) {
+		t.Errorf("unexpected Proxy-Authorization '%s'", auth)
+	}
+}
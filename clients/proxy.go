@@ -0,0 +1,64 @@
+/*
+ * Copyright (C) 2025 by John J. Rushford jrushford@apache.org
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package clients
+
+import (
+	"net/http"
+	"net/url"
+	"sync"
+	"tnascert-deploy/config"
+
+	"golang.org/x/net/http/httpproxy"
+)
+
+// chooses the proxy of a request, nil for a direct connection.
+type proxyFunc = func(*http.Request) (*url.URL, error)
+
+// ProxyFunc returns the function choosing the proxy of a request, as used
+// by http.Transport and websocket.Dialer.  The proxy of cfg is used for
+// the hosts that NO_PROXY does not exclude, without one the HTTPS_PROXY,
+// HTTP_PROXY and NO_PROXY environment variables are used.  The
+// proxy_password is resolved when the proxy is first used.
+func ProxyFunc(cfg *config.Config) proxyFunc {
+	if cfg.Proxy == "" {
+		return http.ProxyFromEnvironment
+	}
+	byHost := (&httpproxy.Config{
+		HTTPProxy:  cfg.Proxy,
+		HTTPSProxy: cfg.Proxy,
+		NoProxy:    httpproxy.FromEnvironment().NoProxy,
+	}).ProxyFunc()
+
+	var once sync.Once
+	var password string
+	var passwordErr error
+	return func(req *http.Request) (*url.URL, error) {
+		u, err := byHost(req.URL)
+		if u == nil || err != nil || cfg.ProxyPassword == "" {
+			return u, err
+		}
+		once.Do(func() {
+			password, passwordErr = cfg.ResolveProxyPassword(req.Context())
+		})
+		if passwordErr != nil {
+			return nil, passwordErr
+		}
+		u.User = url.UserPassword(u.User.Username(), password)
+		return u, nil
+	}
+}
@@ -19,15 +19,14 @@ package restapi
 
 import (
 	"bytes"
-	"crypto/tls"
+	"context"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"net/http/cookiejar"
-	"os"
-	"regexp"
 	"strings"
 	"time"
 	"tnascert-deploy/clients"
@@ -69,43 +68,144 @@ type TrueNASRest struct {
 	Cfg        *config.Config
 }
 
+// Bindings returns the certificates used by the UI, the FTP service and the
+// installed apps.
+func (c *TrueNASRest) Bindings(ctx context.Context) (*clients.Bindings, error) {
+	err := getSystemInfo(ctx, c)
+	if err != nil {
+		return nil, fmt.Errorf("could not get system info: %w", err)
+	}
+	bindings := &clients.Bindings{Version: c.Version}
+
+	var certs []struct {
+		ID   int64  `json:"id"`
+		Name string `json:"name"`
+	}
+	if err = getJSON(ctx, c, http.MethodGet, "/certificate?limit=0", nil, &certs); err != nil {
+		return nil, err
+	}
+	names := make(map[int64]string)
+	for _, cert := range certs {
+		names[cert.ID] = cert.Name
+	}
+
+	var general struct {
+		UICertificate interface{} `json:"ui_certificate"`
+	}
+	if err = getJSON(ctx, c, http.MethodGet, "/system/general", nil, &general); err != nil {
+		return nil, err
+	}
+	bindings.UICertificate = clients.CertificateName(general.UICertificate, names)
+
+	var ftp struct {
+		Certificate interface{} `json:"ssltls_certificate"`
+	}
+	if err = getJSON(ctx, c, http.MethodGet, "/ftp", nil, &ftp); err != nil {
+		return nil, err
+	}
+	bindings.FTPCertificate = clients.CertificateName(ftp.Certificate, names)
+
+	// only TrueNAS SCALE has apps
+	if !strings.HasPrefix(c.Version, "TrueNAS-SCALE") {
+		return bindings, nil
+	}
+	var apps []struct {
+		Name string `json:"name"`
+	}
+	if err = getJSON(ctx, c, http.MethodGet, "/app", nil, &apps); err != nil {
+		return nil, err
+	}
+	for _, app := range apps {
+		var appConfig struct {
+			Network map[string]interface{} `json:"network"`
+		}
+		body, err := json.Marshal(app.Name)
+		if err != nil {
+			return nil, fmt.Errorf("could not marshal the app name '%s': %v", app.Name, err)
+		}
+		if err = getJSON(ctx, c, http.MethodPost, "/app/config", body, &appConfig); err != nil {
+			return nil, err
+		}
+		if appConfig.Network["certificate_id"] != nil {
+			bindings.Apps = append(bindings.Apps, app.Name)
+		}
+	}
+	return bindings, nil
+}
+
+// BoundCertificates returns the certificates of the UI and FTP services.
+func (c *TrueNASRest) BoundCertificates(ctx context.Context) ([]clients.BoundCertificate, error) {
+	var records []clients.CertificateRecord
+	if err := getJSON(ctx, c, http.MethodGet, "/certificate?limit=0", nil, &records); err != nil {
+		return nil, err
+	}
+	var general struct {
+		UICertificate interface{} `json:"ui_certificate"`
+	}
+	if err := getJSON(ctx, c, http.MethodGet, "/system/general", nil, &general); err != nil {
+		return nil, err
+	}
+	var ftp struct {
+		Certificate interface{} `json:"ssltls_certificate"`
+	}
+	if err := getJSON(ctx, c, http.MethodGet, "/ftp", nil, &ftp); err != nil {
+		return nil, err
+	}
+	return clients.Bound(records, general.UICertificate, ftp.Certificate), nil
+}
+
 // noop for truenasrest
-func (c *TrueNASRest) Close() error {
+func (c *TrueNASRest) Close(ctx context.Context) error {
 	if c.Cfg.Debug {
 		log.Printf("close the client connection, %v", c.Url)
 	}
 	return nil
 }
 
-func (c *TrueNASRest) Install() error {
+func (c *TrueNASRest) Install(ctx context.Context) error {
 	if c.Cfg.Debug {
 		log.Println("running install tasks")
 	}
-	certName = c.Cfg.CertName()
+	var err error
+	if certName, err = c.Cfg.CertName(ctx); err != nil {
+		return fmt.Errorf("could not build the certificate name: %v", err)
+	}
 
 	// import the certificate
-	err := importCertificate(c)
+	err = importCertificate(ctx, c)
 	if err != nil {
-		return fmt.Errorf("could not import certificate: %v", err)
+		return fmt.Errorf("could not import certificate: %w", err)
 	}
 
 	// collect a certificate list
-	err = getCertificateList(c)
+	err = getCertificateList(ctx, c)
 	if err != nil {
-		return fmt.Errorf("could not get certificate list: %v", err)
+		return fmt.Errorf("could not get certificate list: %w", err)
 	}
 	return nil
 }
 
-func (c *TrueNASRest) Login() error {
+func (c *TrueNASRest) Login(ctx context.Context) error {
 	if c.Cfg.Debug {
 		log.Printf("running login task")
 	}
 
-	r, err := http.NewRequest(http.MethodGet, c.Url+"/core/ping", nil)
-	res, err := c.HttpClient.Do(r)
+	// the credentials are resolved when they are first needed
+	if art, ok := c.HttpClient.Transport.(*AuthRoundTripper); ok && art.AuthToken == "" {
+		authToken, err := authToken(ctx, c.Cfg)
+		if err != nil {
+			return err
+		}
+		art.AuthToken = authToken
+	}
+
+	r, err := http.NewRequestWithContext(ctx, http.MethodGet, c.Url+"/core/ping", nil)
+	if err != nil {
+		return fmt.Errorf("error creating the login request: %v", err)
+	}
+	res, err := c.withTimeout(c.Cfg.ConnectTimeout).Do(r)
 	if err != nil {
-		return fmt.Errorf("login error %v", err)
+		return fmt.Errorf("login error %w", err)
 	}
 	defer res.Body.Close()
 	if res.StatusCode != 200 {
@@ -114,30 +214,49 @@ func (c *TrueNASRest) Login() error {
 	return nil
 }
 
+// returns the Authorization header value, the api_key is preferred.
+func authToken(ctx context.Context, cfg *config.Config) (string, error) {
+	if cfg.ApiKey != "" {
+		apiKey, err := cfg.ResolveApiKey(ctx)
+		if err != nil {
+			return "", err
+		}
+		return "Bearer " + apiKey, nil
+	}
+	password, err := cfg.ResolvePassword(ctx)
+	if err != nil {
+		return "", err
+	}
+	plainText := cfg.Username + ":" + password
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(plainText)), nil
+}
+
 // constructor
 func NewClient(cfg *config.Config) (clients.Client, error) {
-	var authToken string
-	var durationFromSeconds time.Duration = time.Duration(cfg.TimeoutSeconds) * time.Second
 	serverURL := strings.TrimRight(cfg.ServerURL(), "/") + EndPoint
 
-	if cfg.ApiKey != "" {
-		authToken = "Bearer " + cfg.ApiKey
-	} else if cfg.Username != "" && cfg.Password != "" {
-		plainText := cfg.Username + ":" + cfg.Password
-		authToken = "Basic " + base64.StdEncoding.EncodeToString([]byte(plainText))
-	} else {
+	if cfg.ApiKey == "" && (cfg.Username == "" || cfg.Password == "") {
 		return nil, fmt.Errorf("no valid credentials have been supplied")
 	}
 
+	// the connection and its TLS handshake must complete within the
+	// connect_timeout, the requests within the call_timeout
 	customTransport := http.DefaultTransport.(*http.Transport).Clone()
+	customTransport.DialContext = (&net.Dialer{
+		Timeout:   cfg.ConnectTimeout,
+		KeepAlive: 30 * time.Second,
+	}).DialContext
+	customTransport.TLSHandshakeTimeout = cfg.ConnectTimeout
+	customTransport.Proxy = clients.ProxyFunc(cfg)
 	if cfg.Protocol == "https" {
-		customTransport.TLSClientConfig = &tls.Config{
-			InsecureSkipVerify: cfg.TlsSkipVerify,
+		tlsConfig, err := clients.TLSConfig(cfg)
+		if err != nil {
+			return nil, err
 		}
+		customTransport.TLSClientConfig = tlsConfig
 	}
 	authTransport := &AuthRoundTripper{
 		Transport: customTransport,
-		AuthToken: authToken,
 	}
 
 	jar, err := cookiejar.New(nil)
@@ -147,7 +266,7 @@ func NewClient(cfg *config.Config) (clients.Client, error) {
 
 	httpClient := &http.Client{
 		Transport: authTransport,
-		Timeout:   durationFromSeconds,
+		Timeout:   cfg.CallTimeout,
 		Jar:       jar,
 	}
 
@@ -160,7 +279,7 @@ func NewClient(cfg *config.Config) (clients.Client, error) {
 	return &rest_client, nil
 }
 
-func (c *TrueNASRest) PostInstall() error {
+func (c *TrueNASRest) PostInstall(ctx context.Context) error {
 	var activated bool = false
 	if c.Cfg.Debug {
 		log.Println("running post install tasks")
@@ -169,9 +288,9 @@ func (c *TrueNASRest) PostInstall() error {
 	// update the UI to use the newly
 	// imported certificate
 	if c.Cfg.AddAsUiCertificate {
-		err := addAsUICertificate(c)
+		err := addAsUICertificate(ctx, c)
 		if err != nil {
-			return fmt.Errorf("failed to set %s as the UI certificate: %v", certName, err)
+			return fmt.Errorf("failed to set %s as the UI certificate: %w", certName, err)
 		}
 		activated = true
 	}
@@ -179,9 +298,9 @@ func (c *TrueNASRest) PostInstall() error {
 	// update the FTP service to use the newly
 	// imported certificate
 	if c.Cfg.AddAsFTPCertificate {
-		err := addAsFTPCertificate(c)
+		err := addAsFTPCertificate(ctx, c)
 		if err != nil {
-			return fmt.Errorf("failed to set %s as the FTP certificate: %v", certName, err)
+			return fmt.Errorf("failed to set %s as the FTP certificate: %w", certName, err)
 		}
 	}
 
@@ -193,8 +312,14 @@ func (c *TrueNASRest) PostInstall() error {
 			if strings.HasPrefix(c.Version, "TrueNAS-SCALE") {
 				appList := strings.Split(c.Cfg.AppList, ",")
 				for _, app := range appList {
-					err := c.addAsAppCertificate(app)
+					if err := ctx.Err(); err != nil {
+						return fmt.Errorf("stopped before updating the '%s' app: %w", strings.TrimSpace(app), context.Cause(ctx))
+					}
+					err := c.addAsAppCertificate(ctx, app)
 					if err != nil {
+						if ctx.Err() != nil {
+							return fmt.Errorf("failed to add the '%s' certificate to the '%s' app: %w", certName, app, err)
+						}
 						log.Printf("failed to add the '%s' certificate to the '%s' app: %v", certName, app, err)
 					}
 				}
@@ -208,19 +333,21 @@ func (c *TrueNASRest) PostInstall() error {
 		if c.Cfg.DeleteOldCerts {
 			// give a wait of 5 seconds before deleting old certificates.
 			// to insure app updates have completed.
-			time.Sleep(5 * time.Second)
-			err := deleteCertificates(c)
+			if err := sleep(ctx, 5*time.Second); err != nil {
+				return fmt.Errorf("stopped before deleting old certificates: %w", err)
+			}
+			err := deleteCertificates(ctx, c)
 			if err != nil {
-				return fmt.Errorf("error deleting old certificates: %v", err)
+				return fmt.Errorf("error deleting old certificates: %w", err)
 			} else {
 				log.Println("successfully deleted old certificates")
 			}
 		}
 
 		// restart the UI
-		err := restartUI(c)
+		err := restartUI(ctx, c)
 		if err != nil {
-			return fmt.Errorf("failed to restart the UI")
+			return fmt.Errorf("failed to restart the UI: %w", err)
 		} else {
 			log.Println("successfully restarted the UI")
 		}
@@ -228,17 +355,22 @@ func (c *TrueNASRest) PostInstall() error {
 	return nil
 }
 
-func (c *TrueNASRest) PreInstall() error {
+func (c *TrueNASRest) PreInstall(ctx context.Context) error {
 	if c.Cfg.Debug {
 		log.Println("running preinstall tasks")
 	}
 
-	err := getSystemInfo(c)
+	err := getSystemInfo(ctx, c)
 	if err != nil {
-		return fmt.Errorf("could not get system info: %v", err)
+		return fmt.Errorf("could not get system info: %w", err)
 	}
 
-	err = clients.VerifyCertificateKeyPair(c.Cfg.FullChainPath, c.Cfg.PrivateKeyPath)
+	err = c.Cfg.LoadCertName(ctx)
+	if err != nil {
+		return fmt.Errorf("could not build the certificate name: %v", err)
+	}
+
+	err = clients.VerifyCertificateKeyPair(ctx, c.Cfg)
 	if err != nil {
 		return fmt.Errorf("failed certificate verification: %v", err)
 	}
@@ -246,18 +378,18 @@ func (c *TrueNASRest) PreInstall() error {
 	return nil
 }
 
-func (c *TrueNASRest) addAsAppCertificate(appName string) error {
+func (c *TrueNASRest) addAsAppCertificate(ctx context.Context, appName string) error {
 	log.Printf("adding %s with ID %d to the %s app", certName, certsList[certName], appName)
 
 	// get the app configuration
 	app := []byte("\"" + appName + "\"")
-	req, err := http.NewRequest(http.MethodPost, c.Url+"/app/config", bytes.NewBuffer(app))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.Url+"/app/config", bytes.NewBuffer(app))
 	if err != nil {
 		return fmt.Errorf("error creating application configuration request for '%s': %v", appName, err)
 	}
 	resp, err := c.HttpClient.Do(req)
 	if err != nil {
-		return fmt.Errorf("error executing the application configuration request for '%s': %v", appName, err)
+		return fmt.Errorf("error executing the application configuration request for '%s': %w", appName, err)
 	}
 	if resp.StatusCode != http.StatusOK {
 		return fmt.Errorf("application configuration request for '%s' failed: %v", appName, resp.Status)
@@ -298,20 +430,22 @@ func (c *TrueNASRest) addAsAppCertificate(appName string) error {
 			log.Printf("update message for '%s' app: %s\n", appName, string(jsonUpdate))
 		}
 		body := bytes.NewBuffer([]byte(jsonUpdate))
-		req, err = http.NewRequest(http.MethodPut, c.Url+"/app/id/"+appName, body)
+		req, err = http.NewRequestWithContext(ctx, http.MethodPut, c.Url+"/app/id/"+appName, body)
 		if err != nil {
 			return fmt.Errorf("error creating application configuration update for '%s': %v", appName, err)
 		}
-		resp, err = c.HttpClient.Do(req)
+		resp, err = c.withTimeout(c.Cfg.AppUpdateTimeout).Do(req)
 		if err != nil {
-			return fmt.Errorf("error executing the application update request for '%s': %v", appName, err)
+			return fmt.Errorf("error executing the application update request for '%s': %w", appName, err)
 		}
 		if resp.StatusCode != http.StatusOK {
 			return fmt.Errorf("the application update request for '%s' failed: %v", appName, resp.Status)
 		}
 		defer resp.Body.Close()
 
-		time.Sleep(5 * time.Second)
+		if err := sleep(ctx, 5*time.Second); err != nil {
+			return err
+		}
 		log.Printf("updated the  certificate for application '%s' to use %s", appName, certName)
 	} else {
 		return fmt.Errorf("error obtaining the network configuration for '%s'\n", appName)
@@ -320,7 +454,7 @@ func (c *TrueNASRest) addAsAppCertificate(appName string) error {
 	return nil
 }
 
-func addAsFTPCertificate(c *TrueNASRest) error {
+func addAsFTPCertificate(ctx context.Context, c *TrueNASRest) error {
 	if id, ok := certsList[certName]; ok {
 		data := struct {
 			CertId int64 `json:"ssltls_certificate"`
@@ -332,19 +466,21 @@ func addAsFTPCertificate(c *TrueNASRest) error {
 			return fmt.Errorf("could not marshal ftp update message: %v", err)
 		}
 		// update active FTP certificate
-		req, err := http.NewRequest(http.MethodPut, c.Url+"/ftp", bytes.NewBuffer(jsonData))
+		req, err := http.NewRequestWithContext(ctx, http.MethodPut, c.Url+"/ftp", bytes.NewBuffer(jsonData))
 		if err != nil {
 			return fmt.Errorf("error creating FTP update request: %v", err)
 		}
 		resp, err := c.HttpClient.Do(req)
 		if err != nil {
-			return fmt.Errorf("error executing the active FTP update request: %v", err)
+			return fmt.Errorf("error executing the active FTP update request: %w", err)
 		}
 		if resp.StatusCode != http.StatusOK {
 			return fmt.Errorf("FTP update request failed: %v", resp.Status)
 		} else {
 			// wait 5 seconds for the imported certifcate to become available
-			time.Sleep(5 * time.Second)
+			if err := sleep(ctx, 5*time.Second); err != nil {
+				return err
+			}
 			log.Printf("updated the active FTP certificate to use %s", certName)
 		}
 		defer resp.Body.Close()
@@ -354,7 +490,7 @@ func addAsFTPCertificate(c *TrueNASRest) error {
 	return nil
 }
 
-func addAsUICertificate(client *TrueNASRest) error {
+func addAsUICertificate(ctx context.Context, client *TrueNASRest) error {
 	if id, ok := certsList[certName]; ok {
 		data := struct {
 			CertId int64 `json:"ui_certificate"`
@@ -366,19 +502,21 @@ func addAsUICertificate(client *TrueNASRest) error {
 			return fmt.Errorf("could not marshal ui update message: %v", err)
 		}
 		// update active UI certificate
-		req, err := http.NewRequest(http.MethodPut, client.Url+"/system/general", bytes.NewBuffer(jsonData))
+		req, err := http.NewRequestWithContext(ctx, http.MethodPut, client.Url+"/system/general", bytes.NewBuffer(jsonData))
 		if err != nil {
 			return fmt.Errorf("error creating UI update request: %v", err)
 		}
 		resp, err := client.HttpClient.Do(req)
 		if err != nil {
-			return fmt.Errorf("error executing the active UI update request: %v", err)
+			return fmt.Errorf("error executing the active UI update request: %w", err)
 		}
 		if resp.StatusCode != http.StatusOK {
 			return fmt.Errorf("UI update request failed: %v", resp.Status)
 		} else {
 			// wait 5 seconds for the imported certifcate to become available
-			time.Sleep(5 * time.Second)
+			if err := sleep(ctx, 5*time.Second); err != nil {
+				return err
+			}
 			log.Printf("updated the active UI certificate to use %s", certName)
 		}
 		defer resp.Body.Close()
@@ -388,12 +526,9 @@ func addAsUICertificate(client *TrueNASRest) error {
 	return nil
 }
 
-func deleteCertificates(client *TrueNASRest) error {
-	log.Printf("deleting old certificates with prefix '%s'", client.Cfg.CertBasename)
+func deleteCertificates(ctx context.Context, client *TrueNASRest) error {
+	log.Printf("deleting old certificates matching '%s'", client.Cfg.CertNameRegexp())
 
-	// Prepare regex
-	pattern := fmt.Sprintf(`^%s-\d{4}-\d{2}-\d{2}-\d+$`, regexp.QuoteMeta(client.Cfg.CertBasename))
-	re := regexp.MustCompile(pattern)
 	var basenameMatch bool
 
 	for k, v := range certsList {
@@ -401,20 +536,15 @@ func deleteCertificates(client *TrueNASRest) error {
 			log.Printf("skip the deletion of the active UI certificate %s", certName)
 			continue
 		}
-		if client.Cfg.StrictBasenameMatch {
-			basenameMatch = re.MatchString(k)
-			log.Printf("Regex match %s against %s: %v", client.Cfg.CertBasename, k, basenameMatch)
-		} else {
-			basenameMatch = strings.HasPrefix(k, client.Cfg.CertBasename)
-			log.Printf("Prefix match %s against %s: %v", client.Cfg.CertBasename, k, basenameMatch)
-		}
+		basenameMatch = client.Cfg.MatchCertName(k)
+		log.Printf("Name match %s against %s: %v", client.Cfg.CertNameRegexp(), k, basenameMatch)
 
 		if basenameMatch {
 			URL := fmt.Sprintf("%s/certificate/id/%d", client.Url, v)
-			r, err := http.NewRequest(http.MethodDelete, URL, nil)
-			resp, err := client.HttpClient.Do(r)
+			r, err := http.NewRequestWithContext(ctx, http.MethodDelete, URL, nil)
+			resp, err := client.withTimeout(client.Cfg.JobTimeout).Do(r)
 			if err != nil {
-				return fmt.Errorf("error executing certificate deletion: %v", err)
+				return fmt.Errorf("error executing certificate deletion: %w", err)
 			}
 			if resp.StatusCode != http.StatusOK {
 				return fmt.Errorf("error deleting certificate %s: %v", certName, resp.Status)
@@ -428,17 +558,17 @@ func deleteCertificates(client *TrueNASRest) error {
 	return nil
 }
 
-func getCertificateList(client *TrueNASRest) error {
+func getCertificateList(ctx context.Context, client *TrueNASRest) error {
 	// fetch the list a list of certificates
 	var respData interface{}
 	// certificate list get request
-	req, err := http.NewRequest(http.MethodGet, client.Url+"/certificate?limit=0", nil)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, client.Url+"/certificate?limit=0", nil)
 	if err != nil {
 		return fmt.Errorf("error creating certificate list request: %v", err)
 	}
 	resp, err := client.HttpClient.Do(req)
 	if err != nil {
-		return fmt.Errorf("error executing certificate list request: %v", err)
+		return fmt.Errorf("error executing certificate list request: %w", err)
 	}
 	if resp.StatusCode != http.StatusOK {
 		return fmt.Errorf("certificate list request failed: %v", resp.Status)
@@ -468,17 +598,17 @@ func getCertificateList(client *TrueNASRest) error {
 	return nil
 }
 
-func getSystemInfo(client *TrueNASRest) error {
+func getSystemInfo(ctx context.Context, client *TrueNASRest) error {
 	// fetch the system information.
 	var respData interface{}
 	// system info request
-	req, err := http.NewRequest(http.MethodGet, client.Url+"/system/info", nil)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, client.Url+"/system/info", nil)
 	if err != nil {
 		return fmt.Errorf("error creating system info request: %v", err)
 	}
 	resp, err := client.HttpClient.Do(req)
 	if err != nil {
-		return fmt.Errorf("error executing system info request: %v", err)
+		return fmt.Errorf("error executing system info request: %w", err)
 	}
 	if resp.StatusCode != http.StatusOK {
 		return fmt.Errorf("system info request failed: %v", resp.Status)
@@ -501,15 +631,15 @@ func getSystemInfo(client *TrueNASRest) error {
 
 }
 
-func importCertificate(client *TrueNASRest) error {
-	log.Printf("importing the %s certificate", client.Cfg.CertName())
-	certPem, err := os.ReadFile(client.Cfg.FullChainPath)
+func importCertificate(ctx context.Context, client *TrueNASRest) error {
+	name, err := client.Cfg.CertName(ctx)
 	if err != nil {
-		return fmt.Errorf("error reading the certificate file: %v", err)
+		return err
 	}
-	keyPem, err := os.ReadFile(client.Cfg.PrivateKeyPath)
+	log.Printf("importing the %s certificate", name)
+	keyPair, err := client.Cfg.LoadKeyPair(ctx)
 	if err != nil {
-		return fmt.Errorf("error reading the private key file: %v", err)
+		return err
 	}
 
 	data := struct {
@@ -520,8 +650,8 @@ func importCertificate(client *TrueNASRest) error {
 	}{
 		Name:        certName,
 		CreateType:  "CERTIFICATE_CREATE_IMPORTED",
-		Certificate: string(certPem),
-		PrivateKey:  string(keyPem),
+		Certificate: string(keyPair.CertificatePEM),
+		PrivateKey:  string(keyPair.PrivateKeyPEM),
 	}
 	jsonData, err := json.Marshal(data)
 	if err != nil {
@@ -529,19 +659,21 @@ func importCertificate(client *TrueNASRest) error {
 	}
 
 	// certificate import post request
-	req, err := http.NewRequest(http.MethodPost, client.Url+"/certificate", bytes.NewBuffer(jsonData))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, client.Url+"/certificate", bytes.NewBuffer(jsonData))
 	if err != nil {
 		return fmt.Errorf("error creating certificate import request: %v", err)
 	}
-	resp, err := client.HttpClient.Do(req)
+	resp, err := client.withTimeout(client.Cfg.JobTimeout).Do(req)
 	if err != nil {
-		return fmt.Errorf("error executing the import request: %v", err)
+		return fmt.Errorf("error executing the import request: %w", err)
 	}
 	if resp.StatusCode != http.StatusOK {
 		return fmt.Errorf("certificate import request failed: %v", resp.Status)
 	} else {
 		// wait 5 seconds for the imported certifcate to become available
-		time.Sleep(5 * time.Second)
+		if err := sleep(ctx, 5*time.Second); err != nil {
+			return err
+		}
 		log.Printf("successfully imported the %s certificate", certName)
 	}
 	defer resp.Body.Close()
@@ -549,15 +681,15 @@ func importCertificate(client *TrueNASRest) error {
 	return nil
 }
 
-func restartUI(client *TrueNASRest) error {
+func restartUI(ctx context.Context, client *TrueNASRest) error {
 	// restart the UI request
-	req, err := http.NewRequest(http.MethodGet, client.Url+"/system/general/ui_restart", nil)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, client.Url+"/system/general/ui_restart", nil)
 	if err != nil {
 		return fmt.Errorf("error creating the UI restart request: %v", err)
 	}
-	resp, err := client.HttpClient.Do(req)
+	resp, err := client.withTimeout(client.Cfg.UIRestartTimeout).Do(req)
 	if err != nil {
-		return fmt.Errorf("error executing the UI restart request: %v", err)
+		return fmt.Errorf("error executing the UI restart request: %w", err)
 	}
 	if resp.StatusCode != http.StatusOK {
 		return fmt.Errorf("failed to restart the UI: %v", resp.Status)
@@ -566,3 +698,44 @@ func restartUI(client *TrueNASRest) error {
 
 	return nil
 }
+
+// returns a copy of the HTTP client with a timeout other than the
+// call_timeout, for the requests that may take longer or must fail sooner.
+func (c *TrueNASRest) withTimeout(timeout time.Duration) *http.Client {
+	httpClient := *c.HttpClient
+	httpClient.Timeout = timeout
+	return &httpClient
+}
+
+// sends a request to the REST API and decodes the response into v.
+func getJSON(ctx context.Context, client *TrueNASRest, method string, path string, body []byte, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, method, client.Url+path, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("error creating the %s request: %v", path, err)
+	}
+	resp, err := client.HttpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("error executing the %s request: %w", path, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("the %s request failed: %v", path, resp.Status)
+	}
+	if err = json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("error decoding the %s response: %v", path, err)
+	}
+	return nil
+}
+
+// waits for the given duration, returning early with the context error if the
+// context is cancelled first.
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return context.Cause(ctx)
+	}
+}
@@ -19,11 +19,21 @@ package restapi
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
+	"tnascert-deploy/clients"
 	"tnascert-deploy/config"
 )
 
@@ -31,16 +41,36 @@ import (
 type MockRoundTripper struct {
 	Response *http.Response
 	Err      error
+	Request  *http.Request
 }
 
 // returns a mock data response.
 func (m *MockRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	m.Request = req
 	if m.Err != nil {
 		return nil, m.Err
 	}
 	return m.Response, nil
 }
 
+// returns mock data responses by request path.
+type RouteRoundTripper map[string]string
+
+// returns the mock response for the request path, 404 if there is none.
+func (r RouteRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	body, ok := r[req.URL.Path]
+	status := http.StatusOK
+	if !ok {
+		status = http.StatusNotFound
+	}
+	return &http.Response{
+		StatusCode: status,
+		Status:     http.StatusText(status),
+		Body:       io.NopCloser(bytes.NewBufferString(body)),
+		Header:     make(http.Header),
+	}, nil
+}
+
 // loads the test configuration.
 func getConfig() (*config.Config, error) {
 	configFile := "test_files/tnas-cert.ini"
@@ -55,6 +85,16 @@ func getConfig() (*config.Config, error) {
 	return cfg, nil
 }
 
+// returns the name of the certificate deployed with the test configuration.
+func testCertName(t *testing.T, cfg *config.Config) string {
+	t.Helper()
+	name, err := cfg.CertName(context.Background())
+	if err != nil {
+		t.Fatalf("CertName() failed: %v", err)
+	}
+	return name
+}
+
 // builds and returns a new mock client with a round tripper to provide mock data responses
 func NewClientWithMockRoundTripper(cfg *config.Config, rt *MockRoundTripper) (*TrueNASRest, error) {
 	serverURL := strings.TrimRight(cfg.ServerURL(), "/") + EndPoint
@@ -93,7 +133,7 @@ func TestAddAsUICertificate(t *testing.T) {
 	certsList["tnas-cert-deploy-2021-10-28-1761686579"] = 1
 	certsList["tnas-cert-deploy-2020-10-28-1777168992"] = 2
 	if certName == "" {
-		certName = cfg.CertName()
+		certName = testCertName(t, cfg)
 	}
 	certsList[certName] = 100
 
@@ -102,7 +142,7 @@ func TestAddAsUICertificate(t *testing.T) {
 	if err != nil {
 		t.Errorf("creating the mock client failed: %v", err)
 	}
-	err = addAsUICertificate(mockClient)
+	err = addAsUICertificate(context.Background(), mockClient)
 	if err != nil {
 		t.Errorf("addAsUICertificate() test failed: %v", err)
 	}
@@ -120,7 +160,7 @@ func TestAddAsFTPCertificate(t *testing.T) {
 	if err != nil {
 		t.Errorf("creating the mock client failed: %v", err)
 	}
-	err = addAsFTPCertificate(mockClient)
+	err = addAsFTPCertificate(context.Background(), mockClient)
 	if err != nil {
 		t.Errorf("addAsFTPCertificate() failed: %v", err)
 	}
@@ -138,7 +178,7 @@ func TestClientLogin(t *testing.T) {
 	mockClient, err := NewClientWithMockRoundTripper(cfg, mockRT)
 
 	// 200 response
-	err = mockClient.Login()
+	err = mockClient.Login(context.Background())
 	if err != nil {
 		t.Errorf("login() with test failed: %v", err)
 	}
@@ -146,12 +186,45 @@ func TestClientLogin(t *testing.T) {
 	// 401 response
 	mockRT = NewMockRoundTripper(http.StatusUnauthorized, `{"unauthorized"}`)
 	mockClient, err = NewClientWithMockRoundTripper(cfg, mockRT)
-	err = mockClient.Login()
+	err = mockClient.Login(context.Background())
 	if err == nil {
 		t.Errorf("expected a login failure: %v", err)
 	}
 }
 
+func TestLoginSecretReference(t *testing.T) {
+	cfg, err := getConfig()
+	if err != nil {
+		t.Fatalf("loading the test config file failed: %v", err)
+	}
+	secretFile := filepath.Join(t.TempDir(), "api_key")
+	if err = os.WriteFile(secretFile, []byte("secretapikey\n"), 0600); err != nil {
+		t.Fatalf("writing the secret file failed: %v", err)
+	}
+	cfg.ApiKey = "file:" + secretFile
+
+	// the api_key is read from the file at login
+	mockRT := NewMockRoundTripper(http.StatusOK, `{"pong"}`)
+	mockClient, err := NewClientWithMockRoundTripper(cfg, mockRT)
+	if err != nil {
+		t.Fatalf("creating the mock client failed: %v", err)
+	}
+	mockClient.HttpClient.Transport = &AuthRoundTripper{Transport: mockRT}
+	if err = mockClient.Login(context.Background()); err != nil {
+		t.Fatalf("Login() failed: %v", err)
+	}
+	if auth := mockRT.Request.Header.Get("Authorization"); auth != "Bearer secretapikey" {
+		t.Errorf("the Authorization header should use the api_key from the file, got %q", auth)
+	}
+
+	// a missing secret file fails the login
+	cfg.ApiKey = "file:" + secretFile + ".missing"
+	mockClient.HttpClient.Transport = &AuthRoundTripper{Transport: mockRT}
+	if err = mockClient.Login(context.Background()); err == nil {
+		t.Errorf("expected a login failure with a missing secret file")
+	}
+}
+
 func TestClose(t *testing.T) {
 	cfg, err := getConfig()
 	if err != nil {
@@ -164,7 +237,7 @@ func TestClose(t *testing.T) {
 	if err != nil {
 		t.Errorf("creating the mock client failed: %v", err)
 	}
-	err = mockClient.Close()
+	err = mockClient.Close(context.Background())
 	if err != nil {
 		t.Errorf("PostInstall() Close() test failed: %v", err)
 	}
@@ -178,7 +251,7 @@ func TestDeleteCertificate(t *testing.T) {
 	cfg.Debug = true
 
 	if certName == "" {
-		certName = cfg.CertName()
+		certName = testCertName(t, cfg)
 	}
 
 	certsList["tnas-cert-deploy-2021-10-28-1761686579"] = 1
@@ -192,7 +265,7 @@ func TestDeleteCertificate(t *testing.T) {
 	if err != nil {
 		t.Errorf("creating the mock client failed: %v", err)
 	}
-	err = deleteCertificates(mockClient)
+	err = deleteCertificates(context.Background(), mockClient)
 	if err != nil {
 		t.Errorf("deleteCertificate() test failed: %v", err)
 	}
@@ -217,7 +290,7 @@ func TestGetCertificateList(t *testing.T) {
 	if err != nil {
 		t.Errorf("creating the mock client failed: %v", err)
 	}
-	err = getCertificateList(mockClient)
+	err = getCertificateList(context.Background(), mockClient)
 	if err != nil {
 		t.Errorf("expected certificate to not be found in certificates list: %v", err)
 	}
@@ -225,7 +298,7 @@ func TestGetCertificateList(t *testing.T) {
 	mockRT = NewMockRoundTripper(http.StatusOK, certs)
 	mockClient, err = NewClientWithMockRoundTripper(cfg, mockRT)
 	certsList[certName] = 100
-	err = getCertificateList(mockClient)
+	err = getCertificateList(context.Background(), mockClient)
 	if err != nil {
 		t.Errorf("getCertificateList() test failed: %v", err)
 	}
@@ -238,13 +311,13 @@ func TestImportCertificate(t *testing.T) {
 	}
 	cfg.Debug = true
 
-	certs := fmt.Sprintf("[{\"id\": 1, \"name\": \"%s\"},{\"id\": 2, \"name\": \"tnas-cert-deploy\"}]", cfg.CertName())
+	certs := fmt.Sprintf("[{\"id\": 1, \"name\": \"%s\"},{\"id\": 2, \"name\": \"tnas-cert-deploy\"}]", testCertName(t, cfg))
 	mockRT := NewMockRoundTripper(http.StatusOK, certs)
 	mockClient, err := NewClientWithMockRoundTripper(cfg, mockRT)
 	if err != nil {
 		t.Errorf("creating the mock client failed: %v", err)
 	}
-	err = importCertificate(mockClient)
+	err = importCertificate(context.Background(), mockClient)
 	if err != nil {
 		t.Errorf("importCertificate() test  failed: %v", err)
 	}
@@ -256,14 +329,14 @@ func TestInstall(t *testing.T) {
 		t.Errorf("loading the test config file failed: %v", err)
 	}
 	cfg.Debug = true
-	certList := fmt.Sprintf("[{\"id\": 1, \"name\": \"%s\"},{\"id\": 2, \"name\": \"tnas-cert-deploy\"}]", cfg.CertName())
+	certList := fmt.Sprintf("[{\"id\": 1, \"name\": \"%s\"},{\"id\": 2, \"name\": \"tnas-cert-deploy\"}]", testCertName(t, cfg))
 
 	mockRT := NewMockRoundTripper(http.StatusOK, certList)
 	mockClient, err := NewClientWithMockRoundTripper(cfg, mockRT)
 	if err != nil {
 		t.Errorf("creating the mock client failed: %v", err)
 	}
-	err = mockClient.Install()
+	err = mockClient.Install(context.Background())
 	if err != nil {
 		t.Errorf("Install() test failed: %v", err)
 	}
@@ -301,6 +374,88 @@ func TestNewClient(t *testing.T) {
 	}
 }
 
+func TestTimeouts(t *testing.T) {
+	// a REST API stand-in answering the ping and the UI restart after a second
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(time.Second)
+		w.Write([]byte(`"pong"`))
+	}))
+	defer server.Close()
+
+	cfg, err := getConfig()
+	if err != nil {
+		t.Fatalf("loading the test config file failed: %v", err)
+	}
+	host, port, _ := net.SplitHostPort(strings.TrimPrefix(server.URL, "http://"))
+	cfg = cfg.WithConnectHost(host).WithClientApi("restapi")
+	cfg.Protocol = "http"
+	cfg.Port, _ = strconv.ParseUint(port, 10, 16)
+	cfg.ConnectTimeout = 200 * time.Millisecond
+	cfg.CallTimeout = 200 * time.Millisecond
+	cfg.UIRestartTimeout = 5 * time.Second
+
+	cl, err := NewClient(cfg)
+	if err != nil {
+		t.Fatalf("NewClient() failed: %v", err)
+	}
+	client := cl.(*TrueNASRest)
+	if client.HttpClient.Timeout != cfg.CallTimeout {
+		t.Errorf("the HTTP client timeout should be the call_timeout, got %v", client.HttpClient.Timeout)
+	}
+
+	// the login fails once the connect_timeout expires
+	if err = client.Login(context.Background()); err == nil {
+		t.Errorf("Login() should fail after the connect_timeout")
+	}
+	// the UI restart may take up to the ui_restart_timeout
+	if err = restartUI(context.Background(), client); err != nil {
+		t.Errorf("restartUI() should wait for the ui_restart_timeout: %v", err)
+	}
+	if client.HttpClient.Timeout != cfg.CallTimeout {
+		t.Errorf("withTimeout() should not change the HTTP client, got %v", client.HttpClient.Timeout)
+	}
+}
+
+func TestProxy(t *testing.T) {
+	// an HTTP proxy stand-in answering the requests for TrueNAS itself
+	requests := make(chan *http.Request, 1)
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests <- r
+		w.Write([]byte(`"pong"`))
+	}))
+	defer proxy.Close()
+
+	cfg, err := getConfig()
+	if err != nil {
+		t.Fatalf("loading the test config file failed: %v", err)
+	}
+	cfg = cfg.WithConnectHost("nas01.example").WithClientApi("restapi")
+	cfg.Protocol = "http"
+	cfg.Proxy = "http://deploy@" + proxy.Listener.Addr().String()
+	cfg.ProxyPassword = "proxy-secret"
+
+	client, err := NewClient(cfg)
+	if err != nil {
+		t.Fatalf("NewClient() failed: %v", err)
+	}
+	if err = client.Login(context.Background()); err != nil {
+		t.Fatalf("Login() through the proxy failed: %v", err)
+	}
+	r := <-requests
+	if r.URL.String() != "http://nas01.example:443/api/v2.0/core/ping" {
+		t.Errorf("the proxy was asked for %s", r.URL)
+	}
+	if user, password, ok := parseProxyAuth(r.Header.Get("Proxy-Authorization")); !ok || user != "deploy" || password != "proxy-secret" {
+		t.Errorf("unexpected proxy credentials %s:%s", user, password)
+	}
+}
+
+// decodes a Basic Proxy-Authorization header.
+func parseProxyAuth(auth string) (string, string, bool) {
+	r := &http.Request{Header: http.Header{"Authorization": {auth}}}
+	return r.BasicAuth()
+}
+
 func TestPostInstall(t *testing.T) {
 	cfg, err := getConfig()
 	if err != nil {
@@ -318,7 +473,7 @@ func TestPostInstall(t *testing.T) {
 	if err != nil {
 		t.Errorf("creating the mock client failed: %v", err)
 	}
-	err = mockClient.PostInstall()
+	err = mockClient.PostInstall(context.Background())
 	if err != nil {
 		t.Errorf("PostInstall() addAsUICertificate() test failed: %v", err)
 	}
@@ -340,7 +495,7 @@ func TestPostInstall(t *testing.T) {
 	if err != nil {
 		t.Errorf("creating the mock client failed: %v", err)
 	}
-	err = mockClient.PostInstall()
+	err = mockClient.PostInstall(context.Background())
 	if err != nil {
 		t.Errorf("PostInstall() addAsFTPCertificate() test failed: %v", err)
 	}
@@ -367,14 +522,14 @@ func TestPostInstall(t *testing.T) {
 	}
 	mockClient.Version = "TrueNAS-SCALE-24.10.2.4"
 
-	err = mockClient.PostInstall()
+	err = mockClient.PostInstall(context.Background())
 	if err != nil {
 		t.Errorf("PostInstall() addAsAppCertificate() (empty AppLIst) test failed: %v", err)
 	}
 
 	// now add an app
 	cfg.AppList = "gitea"
-	err = mockClient.PostInstall()
+	err = mockClient.PostInstall(context.Background())
 	if err != nil {
 		t.Errorf("PostInstall() addAsAppCertificate() (AppList) test failed: %v", err)
 	}
@@ -392,14 +547,14 @@ func TestPostInstall(t *testing.T) {
 	if err != nil {
 		t.Errorf("creating the mock client failed: %v", err)
 	}
-	err = mockClient.PostInstall()
+	err = mockClient.PostInstall(context.Background())
 	if err != nil {
 		t.Errorf("PostInstall() addAsAppCertificate() app with no cert configured test failed: %v", err)
 	}
 
 	// version is not TrueNAS-SCALE
 	mockClient.Version = "TrueNAS-CORE-8.1"
-	err = mockClient.PostInstall()
+	err = mockClient.PostInstall(context.Background())
 	if err != nil {
 		t.Errorf("PostInstall() addAsAppCertificate() (AppList) test failed: %v", err)
 	}
@@ -422,7 +577,7 @@ func TestPreInstall(t *testing.T) {
 
 	mockRT := NewMockRoundTripper(http.StatusOK, versionBody)
 	mockClient, err := NewClientWithMockRoundTripper(cfg, mockRT)
-	err = mockClient.PreInstall()
+	err = mockClient.PreInstall(context.Background())
 	if err != nil {
 		t.Errorf("PreInstall() test failed: %v", err)
 	}
@@ -439,8 +594,92 @@ func TestRestartUI(t *testing.T) {
 	if err != nil {
 		t.Errorf("creating the mock client failed: %v", err)
 	}
-	err = restartUI(mockClient)
+	err = restartUI(context.Background(), mockClient)
 	if err != nil {
 		t.Errorf("restartUI() test failed: %v", err)
 	}
 }
+
+func TestSleep(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	start := time.Now()
+	err := sleep(ctx, 5*time.Second)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("expected sleep() to return context.Canceled, got: %v", err)
+	}
+	if time.Since(start) > time.Second {
+		t.Errorf("sleep() did not return early when the context was cancelled")
+	}
+
+	err = sleep(context.Background(), 10*time.Millisecond)
+	if err != nil {
+		t.Errorf("sleep() test failed: %v", err)
+	}
+}
+
+func TestBindings(t *testing.T) {
+	cfg, err := getConfig()
+	if err != nil {
+		t.Fatalf("loading the test config file failed: %v", err)
+	}
+	routes := RouteRoundTripper{
+		EndPoint + "/system/info":    `{"version": "TrueNAS-SCALE-24.10.2"}`,
+		EndPoint + "/certificate":    `[{"id": 1, "name": "truenas_default"}, {"id": 7, "name": "tnas-cert-deploy-2025-01-01-1735689600"}]`,
+		EndPoint + "/system/general": `{"ui_certificate": {"id": 7, "name": "tnas-cert-deploy-2025-01-01-1735689600"}}`,
+		EndPoint + "/ftp":            `{"ssltls_certificate": null}`,
+		EndPoint + "/app":            `[{"name": "frigate"}, {"name": "plex"}]`,
+		EndPoint + "/app/config":     `{"network": {"certificate_id": 7}}`,
+	}
+	client := &TrueNASRest{Url: strings.TrimRight(cfg.ServerURL(), "/") + EndPoint, HttpClient: &http.Client{Transport: routes}, Cfg: cfg}
+
+	bindings, err := client.Bindings(context.Background())
+	if err != nil {
+		t.Fatalf("Bindings() test failed: %v", err)
+	}
+	if bindings.Version != "TrueNAS-SCALE-24.10.2" || bindings.UICertificate != "tnas-cert-deploy-2025-01-01-1735689600" ||
+		bindings.FTPCertificate != "" || strings.Join(bindings.Apps, ",") != "frigate,plex" {
+		t.Errorf("unexpected bindings: %+v", *bindings)
+	}
+
+	// TrueNAS CORE has no apps
+	routes[EndPoint+"/system/info"] = `{"version": "TrueNAS-13.0-U6.2"}`
+	delete(routes, EndPoint+"/app")
+	bindings, err = client.Bindings(context.Background())
+	if err != nil || len(bindings.Apps) != 0 {
+		t.Errorf("expected no apps on TrueNAS CORE, got %v %v", bindings, err)
+	}
+}
+
+func TestBoundCertificates(t *testing.T) {
+	cfg, err := getConfig()
+	if err != nil {
+		t.Fatalf("loading the test config file failed: %v", err)
+	}
+	certPem, err := os.ReadFile(cfg.FullChainPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certs, _ := json.Marshal([]map[string]interface{}{
+		{"id": 1, "name": "truenas_default", "certificate": string(certPem)},
+		{"id": 7, "name": "tnas-cert-deploy-2025-01-01-1735689600", "certificate": string(certPem)},
+	})
+	routes := RouteRoundTripper{
+		EndPoint + "/certificate":    string(certs),
+		EndPoint + "/system/general": `{"ui_certificate": {"id": 7, "name": "tnas-cert-deploy-2025-01-01-1735689600"}}`,
+		EndPoint + "/ftp":            `{"ssltls_certificate": 1}`,
+	}
+	client := &TrueNASRest{Url: strings.TrimRight(cfg.ServerURL(), "/") + EndPoint, HttpClient: &http.Client{Transport: routes}, Cfg: cfg}
+
+	bound, err := client.BoundCertificates(context.Background())
+	if err != nil {
+		t.Fatalf("BoundCertificates() test failed: %v", err)
+	}
+	if len(bound) != 2 || bound[0].Service != "UI" || bound[0].PEM != string(certPem) || bound[1].Name != "truenas_default" {
+		t.Fatalf("unexpected bound certificates: %+v", bound)
+	}
+	// redeploying the bound certificate is not a downgrade, whatever its name
+	if err = clients.CheckDowngrade(context.Background(), cfg, bound); err != nil {
+		t.Errorf("CheckDowngrade() failed: %v", err)
+	}
+}
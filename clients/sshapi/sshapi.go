@@ -0,0 +1,324 @@
+/*
+ * Copyright (C) 2025 by John J. Rushford jrushford@apache.org
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package sshapi
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"tnascert-deploy/clients"
+	"tnascert-deploy/clients/wsapi"
+	"tnascert-deploy/config"
+
+	"github.com/truenas/api_client_golang/truenas_api"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// the Python script run on the connect_host making a call with the
+// middleware client that midclt uses.  The JSON parameters are read from its
+// stdin, one per line, so that the certificate and its key are neither in the
+// command sent over SSH nor in the argv of a process on the NAS, where any
+// local user could read them.  The script takes the method and, for a job,
+// a second argument.  It must not hold single quotes.
+const midcltScript = `
+import json, sys
+try:
+    from truenas_api_client import Client
+except ImportError:
+    from middlewared.client import Client
+params = [json.loads(line) for line in sys.stdin if line.strip()]
+try:
+    with Client() as c:
+        result = c.call(sys.argv[1], *params, job=len(sys.argv) > 2)
+except Exception as e:
+    sys.stderr.write(str(e) + "\n")
+    sys.exit(1)
+json.dump(result, sys.stdout)
+`
+
+// the remote command running the midcltScript, the %s are the method and
+// the optional job argument.
+const midcltCommand = "python3 -c '" + midcltScript + "' %s%s"
+
+// MidcltClient runs the TrueNAS API calls over SSH with the middleware client
+// of midclt, each call in its own SSH session.  It is the WSClient of the
+// wsapi flow, the output of the calls is returned as a JSON-RPC response to
+// be parsed the same way.
+type MidcltClient struct {
+	client *ssh.Client
+
+	mu     sync.Mutex // guards the fields below
+	callID int
+}
+
+// NewClient connects to the connect_host over SSH with the ssh_key_path,
+// the host key is verified with the ssh_known_hosts.  The returned client
+// runs the wsapi deployment with midclt.
+func NewClient(cfg *config.Config) (clients.Client, error) {
+	sshConfig, err := clientConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	address := net.JoinHostPort(cfg.ConnectHost, strconv.FormatUint(cfg.SSHPort, 10))
+
+	// the connection and the SSH handshake must complete within the
+	// connect_timeout
+	conn, err := net.DialTimeout("tcp", address, cfg.ConnectTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %s: %w", address, err)
+	}
+	conn.SetDeadline(time.Now().Add(cfg.ConnectTimeout))
+	sshConn, chans, reqs, err := ssh.NewClientConn(conn, address, sshConfig)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("SSH connection to %s failed: %w", address, err)
+	}
+	conn.SetDeadline(time.Time{})
+
+	ssh_client := wsapi.TrueNASWebSocket{
+		Url:      "ssh://" + cfg.SSHUser + "@" + address,
+		WSClient: &MidcltClient{client: ssh.NewClient(sshConn, chans, reqs)},
+		Cfg:      cfg,
+	}
+	return ssh_client, nil
+}
+
+// returns the SSH configuration authenticating the ssh_user with the
+// ssh_key_path and verifying the host key with the ssh_known_hosts.
+func clientConfig(cfg *config.Config) (*ssh.ClientConfig, error) {
+	keyPem, err := os.ReadFile(cfg.SSHKeyPath)
+	if err != nil {
+		return nil, fmt.Errorf("error reading the ssh_key_path: %v", err)
+	}
+	signer, err := ssh.ParsePrivateKey(keyPem)
+	var passphraseErr *ssh.PassphraseMissingError
+	if errors.As(err, &passphraseErr) {
+		return nil, fmt.Errorf("the ssh_key_path '%s' is encrypted, use a key without a passphrase", cfg.SSHKeyPath)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error parsing the ssh_key_path '%s': %v", cfg.SSHKeyPath, err)
+	}
+
+	knownHosts := cfg.SSHKnownHosts
+	if knownHosts == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, fmt.Errorf("no ssh_known_hosts is set and the home directory is unknown: %v", err)
+		}
+		knownHosts = filepath.Join(home, ".ssh", "known_hosts")
+	}
+	hostKeyCallback, err := knownhosts.New(knownHosts)
+	if err != nil {
+		return nil, fmt.Errorf("error reading the ssh_known_hosts: %v", err)
+	}
+	return &ssh.ClientConfig{
+		User:            cfg.SSHUser,
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		HostKeyCallback: hostKeyCallback,
+		Timeout:         cfg.ConnectTimeout,
+	}, nil
+}
+
+// Login is not used, midclt is authenticated as the ssh_user.
+func (c *MidcltClient) Login(username string, password string, apiKey string) error {
+	return errors.New("the midclt calls are authenticated as the ssh_user")
+}
+
+// Call runs the midcltScript and returns its result as a JSON-RPC response, a
+// failed call is returned as a response with an error.  The call fails when
+// the script does not exit within timeout seconds.
+func (c *MidcltClient) Call(method string, timeout int64, params interface{}) (json.RawMessage, error) {
+	session, stdout, stderr, err := c.start(method, false, params)
+	if err != nil {
+		return nil, err
+	}
+	defer session.Close()
+	done := make(chan error, 1)
+	go func() {
+		done <- session.Wait()
+	}()
+	t := time.NewTimer(time.Duration(timeout) * time.Second)
+	defer t.Stop()
+	select {
+	case err = <-done:
+	case <-t.C:
+		session.Signal(ssh.SIGKILL)
+		return nil, fmt.Errorf("the %s call timed out after %ds", method, timeout)
+	}
+	return c.response(method, stdout.Bytes(), stderr.String(), err)
+}
+
+// CallWithJob runs the midcltScript for a job, which waits for the job to
+// finish.  The returned job has no ID as the script does not print it, its
+// DoneCh receives the job error, empty on success, once the script exits.
+func (c *MidcltClient) CallWithJob(method string, params interface{}, callback func(progress float64, state string, desc string)) (*truenas_api.Job, error) {
+	session, stdout, stderr, err := c.start(method, true, params)
+	if err != nil {
+		return nil, err
+	}
+	job := &truenas_api.Job{
+		Method:     method,
+		State:      "RUNNING",
+		ProgressCh: make(chan float64, 1),
+		DoneCh:     make(chan string, 1),
+		Callback:   callback,
+	}
+	go func() {
+		defer session.Close()
+		err := session.Wait()
+		res, err := c.response(method, stdout.Bytes(), stderr.String(), err)
+		var response struct {
+			Result interface{} `json:"result"`
+			Error  struct {
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		if err == nil {
+			err = json.Unmarshal(res, &response)
+		}
+		jobErr := response.Error.Message
+		if err != nil {
+			jobErr = err.Error()
+		}
+		job.State = "SUCCESS"
+		if jobErr != "" {
+			job.State = "FAILED"
+		}
+		job.Result = response.Result
+		if callback != nil {
+			callback(100, job.State, "")
+		}
+		job.DoneCh <- jobErr
+		close(job.DoneCh)
+	}()
+	return job, nil
+}
+
+// SubscribeToJobs does nothing, the midcltScript follows the job itself.
+func (c *MidcltClient) SubscribeToJobs() error {
+	return nil
+}
+
+// Close closes the SSH connection.
+func (c *MidcltClient) Close() error {
+	err := c.client.Close()
+	if errors.Is(err, net.ErrClosed) {
+		return nil
+	}
+	return err
+}
+
+// starts the midcltScript in a new session with the JSON parameters on its
+// stdin.
+func (c *MidcltClient) start(method string, job bool, params interface{}) (*ssh.Session, *bytes.Buffer, *bytes.Buffer, error) {
+	stdin, err := encodeParams(params)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("error encoding the %s parameters: %v", method, err)
+	}
+	session, err := c.client.NewSession()
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to open an SSH session for the %s call: %v", method, err)
+	}
+	var stdout, stderr bytes.Buffer
+	session.Stdin = bytes.NewReader(stdin)
+	session.Stdout = &stdout
+	session.Stderr = &stderr
+	flag := ""
+	if job {
+		flag = " job"
+	}
+	if err = session.Start(fmt.Sprintf(midcltCommand, method, flag)); err != nil {
+		session.Close()
+		return nil, nil, nil, fmt.Errorf("failed to run the %s call: %v", method, err)
+	}
+	return session, &stdout, &stderr, nil
+}
+
+// returns the JSON-RPC response of a call from the output of the
+// midcltScript, which exits with an error status when the call fails.
+func (c *MidcltClient) response(method string, stdout []byte, stderr string, err error) (json.RawMessage, error) {
+	c.mu.Lock()
+	c.callID++
+	id := c.callID
+	c.mu.Unlock()
+
+	response := map[string]interface{}{"jsonrpc": "2.0", "id": id}
+	var exitErr *ssh.ExitError
+	switch {
+	case errors.As(err, &exitErr):
+		message := strings.TrimSpace(stderr)
+		if message == "" {
+			message = fmt.Sprintf("the %s call exited with status %d", method, exitErr.ExitStatus())
+		}
+		response["error"] = map[string]interface{}{"message": message}
+	case err != nil:
+		return nil, fmt.Errorf("the %s call failed: %v", method, err)
+	default:
+		response["result"] = decodeOutput(stdout)
+	}
+	return json.Marshal(response)
+}
+
+// encodes the parameters of a call as the lines of JSON values read by the
+// midcltScript.
+func encodeParams(params interface{}) ([]byte, error) {
+	data, err := json.Marshal(params)
+	if err != nil {
+		return nil, err
+	}
+	var args []json.RawMessage
+	if err = json.Unmarshal(data, &args); err != nil {
+		// a single parameter
+		args = []json.RawMessage{data}
+	}
+	var b bytes.Buffer
+	for _, arg := range args {
+		// json.Marshal escapes the newlines of the strings
+		b.Write(arg)
+		b.WriteByte('\n')
+	}
+	return b.Bytes(), nil
+}
+
+// decodes the output of a call, JSON, or the strings and the booleans
+// printed as Python does, as midclt prints them.
+func decodeOutput(stdout []byte) json.RawMessage {
+	out := bytes.TrimSpace(stdout)
+	switch string(out) {
+	case "":
+		return json.RawMessage("null")
+	case "True":
+		return json.RawMessage("true")
+	case "False":
+		return json.RawMessage("false")
+	}
+	if json.Valid(out) {
+		return out
+	}
+	s, _ := json.Marshal(string(out))
+	return s
+}
@@ -0,0 +1,405 @@
+/*
+ * Copyright (C) 2025 by John J. Rushford jrushford@apache.org
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package sshapi
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"tnascert-deploy/clients/wsapi"
+	"tnascert-deploy/config"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// a midclt call received by the SSH server stand-in.
+type midcltCall struct {
+	command string
+	method  string
+	job     bool
+	params  []json.RawMessage
+}
+
+// answers a midclt call with its output, the error output and the exit
+// status.
+type midcltHandler func(call midcltCall) (string, string, uint32)
+
+// the remote command, only the method and the job argument follow the
+// midcltScript.
+var midcltPattern = regexp.MustCompile(`^python3 -c '([^']*)' ([\w.]+)( job)?$`)
+
+func getConfig(t *testing.T) *config.Config {
+	configFile := "test_files/tnas-cert.ini"
+	cfgList, err := config.LoadConfig(configFile)
+	if err != nil {
+		t.Fatalf("error loading config file '%s': %v", configFile, err)
+	}
+	cfg, ok := cfgList["deploy_default"]
+	if !ok {
+		t.Fatalf("invalid section 'deploy_default'")
+	}
+	return cfg
+}
+
+// starts an SSH server stand-in running the midclt calls with the handler
+// and returns the configuration connecting to it, with a generated client
+// key and known_hosts.  The calls received are recorded in calls.
+func sshServer(t *testing.T, handler midcltHandler) (*config.Config, func() []midcltCall) {
+	_, hostKey, _ := ed25519.GenerateKey(rand.Reader)
+	hostSigner, err := ssh.NewSignerFromKey(hostKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientPub, clientKey, _ := ed25519.GenerateKey(rand.Reader)
+	authorized, err := ssh.NewPublicKey(clientPub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverConfig := &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if conn.User() == "root" && bytes.Equal(key.Marshal(), authorized.Marshal()) {
+				return nil, nil
+			}
+			return nil, fmt.Errorf("unknown key for %s", conn.User())
+		},
+	}
+	serverConfig.AddHostKey(hostSigner)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen failed: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	var mu sync.Mutex
+	var calls []midcltCall
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				_, chans, reqs, err := ssh.NewServerConn(conn, serverConfig)
+				if err != nil {
+					return
+				}
+				go ssh.DiscardRequests(reqs)
+				for newChannel := range chans {
+					channel, requests, err := newChannel.Accept()
+					if err != nil {
+						continue
+					}
+					go func() {
+						defer channel.Close()
+						for req := range requests {
+							if req.Type != "exec" {
+								req.Reply(false, nil)
+								continue
+							}
+							var exec struct{ Command string }
+							ssh.Unmarshal(req.Payload, &exec)
+							req.Reply(true, nil)
+
+							call := midcltCall{command: exec.Command}
+							stdin, _ := io.ReadAll(channel)
+							for _, line := range strings.Split(strings.TrimSuffix(string(stdin), "\n"), "\n") {
+								if line != "" {
+									call.params = append(call.params, json.RawMessage(line))
+								}
+							}
+							status := uint32(127)
+							stdout, stderr := "", "sh: unexpected command\n"
+							if m := midcltPattern.FindStringSubmatch(exec.Command); m != nil && m[1] == midcltScript {
+								call.method, call.job = m[2], m[3] != ""
+								stdout, stderr, status = handler(call)
+							}
+							mu.Lock()
+							calls = append(calls, call)
+							mu.Unlock()
+							io.WriteString(channel, stdout)
+							io.WriteString(channel.Stderr(), stderr)
+							channel.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{status}))
+							return
+						}
+					}()
+				}
+			}()
+		}
+	}()
+
+	dir := t.TempDir()
+	cfg := getConfig(t)
+	host, port, _ := net.SplitHostPort(listener.Addr().String())
+	cfg = cfg.WithConnectHost(host)
+	cfg.SSHPort, _ = strconv.ParseUint(port, 10, 16)
+	cfg.SSHKeyPath = filepath.Join(dir, "id_ed25519")
+	block, err := ssh.MarshalPrivateKey(clientKey, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(cfg.SSHKeyPath, pem.EncodeToMemory(block), 0600); err != nil {
+		t.Fatal(err)
+	}
+	cfg.SSHKnownHosts = filepath.Join(dir, "known_hosts")
+	line := knownhosts.Line([]string{knownhosts.Normalize(listener.Addr().String())}, hostSigner.PublicKey())
+	if err = os.WriteFile(cfg.SSHKnownHosts, []byte(line+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return cfg, func() []midcltCall {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]midcltCall(nil), calls...)
+	}
+}
+
+func TestInstall(t *testing.T) {
+	var cfg *config.Config
+	cfg, calls := sshServer(t, func(call midcltCall) (string, string, uint32) {
+		switch call.method {
+		case "auth.me":
+			return `{"pw_name": "root", "pw_uid": 0}`, "", 0
+		case "system.info":
+			return `{"version": "25.04.2.5"}`, "", 0
+		case "certificate.create":
+			return `{"id": 12}`, "", 0
+		case "app.certificate_choices":
+			name, err := cfg.CertName(context.Background())
+			if err != nil {
+				return "", err.Error(), 1
+			}
+			return fmt.Sprintf(`[{"id": 12, "name": "%s"}]`, name), "", 0
+		}
+		return "", "[ENOMETHOD] Method does not exist\n", 1
+	})
+
+	client, err := NewClient(cfg)
+	if err != nil {
+		t.Fatalf("NewClient() failed: %v", err)
+	}
+	defer client.Close(context.Background())
+	ctx := context.Background()
+	if err = client.Login(ctx); err != nil {
+		t.Fatalf("Login() failed: %v", err)
+	}
+	if err = client.PreInstall(ctx); err != nil {
+		t.Fatalf("PreInstall() failed: %v", err)
+	}
+	if err = client.Install(ctx); err != nil {
+		t.Fatalf("Install() failed: %v", err)
+	}
+
+	keyPem, _ := os.ReadFile(cfg.PrivateKeyPath)
+	var created bool
+	for _, call := range calls() {
+		if strings.Contains(call.command, "PRIVATE KEY") {
+			t.Errorf("the private key was sent in the command: %s", call.command)
+		}
+		if call.method != "certificate.create" {
+			continue
+		}
+		created = true
+		var params map[string]string
+		if !call.job || len(call.params) != 1 || json.Unmarshal(call.params[0], &params) != nil {
+			t.Fatalf("unexpected certificate.create call: %+v", call)
+		}
+		name, err := cfg.CertName(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if params["privatekey"] != string(keyPem) || params["name"] != name {
+			t.Errorf("the certificate.create parameters were not received on stdin: %+v", params)
+		}
+	}
+	if !created {
+		t.Errorf("certificate.create was not called")
+	}
+}
+
+func TestMidcltClient(t *testing.T) {
+	cfg, _ := sshServer(t, func(call midcltCall) (string, string, uint32) {
+		switch call.method {
+		case "core.ping":
+			return "pong\n", "", 0
+		case "ftp.update":
+			return "True\n", "", 0
+		case "certificate.delete":
+			return "", "[EFAULT] the certificate is in use\n", 1
+		case "app.update":
+			return fmt.Sprintf(`{"name": %s}`, call.params[0]), "", 0
+		}
+		return "", "[ENOMETHOD] Method does not exist\n", 1
+	})
+	client, err := NewClient(cfg)
+	if err != nil {
+		t.Fatalf("NewClient() failed: %v", err)
+	}
+	defer client.Close(context.Background())
+	midclt := client.(wsapi.TrueNASWebSocket).WSClient.(*MidcltClient)
+
+	// the strings and booleans printed by midclt are JSON results
+	tests := []struct {
+		method string
+		want   string
+	}{
+		{"core.ping", `"result":"pong"`},
+		{"ftp.update", `"result":true`},
+		{"system.reboot", `"error":{"message":"[ENOMETHOD] Method does not exist"}`},
+	}
+	for _, test := range tests {
+		res, err := midclt.Call(test.method, 5, []interface{}{})
+		if err != nil || !strings.Contains(string(res), test.want) {
+			t.Errorf("Call(%s) returned %s, %v, expected %s", test.method, res, err, test.want)
+		}
+	}
+
+	// the jobs finish when midclt exits
+	job, err := midclt.CallWithJob("app.update", [2]interface{}{"grafana", map[string]interface{}{}}, nil)
+	if err != nil {
+		t.Fatalf("CallWithJob() failed: %v", err)
+	}
+	if jobErr := <-job.DoneCh; jobErr != "" || job.State != "SUCCESS" {
+		t.Errorf("the app.update job finished with '%s' in state %s", jobErr, job.State)
+	}
+	if result, ok := job.Result.(map[string]interface{}); !ok || result["name"] != "grafana" {
+		t.Errorf("unexpected app.update job result %v", job.Result)
+	}
+	job, err = midclt.CallWithJob("certificate.delete", []int64{3}, nil)
+	if err != nil {
+		t.Fatalf("CallWithJob() failed: %v", err)
+	}
+	if jobErr := <-job.DoneCh; !strings.Contains(jobErr, "in use") || job.State != "FAILED" {
+		t.Errorf("the certificate.delete job finished with '%s' in state %s", jobErr, job.State)
+	}
+}
+
+func TestHostKeyVerification(t *testing.T) {
+	cfg, _ := sshServer(t, func(call midcltCall) (string, string, uint32) {
+		return "", "", 0
+	})
+
+	// a host key that is not in the known_hosts is refused
+	otherKey, _, _ := ed25519.GenerateKey(rand.Reader)
+	otherPub, err := ssh.NewPublicKey(otherKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := net.JoinHostPort(cfg.ConnectHost, strconv.FormatUint(cfg.SSHPort, 10))
+	line := knownhosts.Line([]string{knownhosts.Normalize(address)}, otherPub)
+	if err = os.WriteFile(cfg.SSHKnownHosts, []byte(line+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = NewClient(cfg); err == nil || !strings.Contains(err.Error(), "key mismatch") {
+		t.Errorf("NewClient() should refuse the host key, got: %v", err)
+	}
+
+	// as is a host missing from the known_hosts
+	if err = os.WriteFile(cfg.SSHKnownHosts, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = NewClient(cfg); err == nil || !strings.Contains(err.Error(), "key is unknown") {
+		t.Errorf("NewClient() should refuse an unknown host, got: %v", err)
+	}
+}
+
+// a middleware client stand-in for the midcltScript, the calls return their
+// method, parameters and the command line of the process.
+const fakeClient = `
+import sys
+class Client:
+    def __enter__(self):
+        return self
+    def __exit__(self, *args):
+        pass
+    def call(self, method, *params, job=False):
+        if method == "certificate.delete":
+            raise Exception("[EFAULT] the certificate is in use")
+        with open("/proc/self/cmdline", "rb") as f:
+            cmdline = f.read().decode()
+        return {"method": method, "params": list(params), "job": job, "argv": sys.argv, "cmdline": cmdline}
+`
+
+func TestMidcltScript(t *testing.T) {
+	if _, err := exec.LookPath("python3"); err != nil {
+		t.Skip("python3 is not installed")
+	}
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "truenas_api_client.py"), []byte(fakeClient), 0600); err != nil {
+		t.Fatal(err)
+	}
+	keyPem, err := os.ReadFile("test_files/privkey.pem")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	run := func(method string, job string, params interface{}) (string, error) {
+		stdin, err := encodeParams(params)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cmd := exec.Command("sh", "-c", fmt.Sprintf(midcltCommand, method, job))
+		cmd.Env = append(os.Environ(), "PYTHONPATH="+dir)
+		cmd.Stdin = bytes.NewReader(stdin)
+		out, err := cmd.CombinedOutput()
+		return string(out), err
+	}
+
+	// the private key is only read from stdin
+	params := map[string]string{"name": "deploy", "privatekey": string(keyPem)}
+	out, err := run("certificate.create", " job", []interface{}{params})
+	if err != nil {
+		t.Fatalf("the midcltScript failed: %v %s", err, out)
+	}
+	var result struct {
+		Method  string              `json:"method"`
+		Params  []map[string]string `json:"params"`
+		Job     bool                `json:"job"`
+		Argv    []string            `json:"argv"`
+		Cmdline string              `json:"cmdline"`
+	}
+	if err = json.Unmarshal([]byte(out), &result); err != nil {
+		t.Fatalf("unexpected output %s: %v", out, err)
+	}
+	if result.Method != "certificate.create" || !result.Job || len(result.Params) != 1 || result.Params[0]["privatekey"] != string(keyPem) {
+		t.Errorf("the call was not made with the parameters of stdin: %+v", result)
+	}
+	if strings.Contains(result.Cmdline, "PRIVATE KEY") || strings.Contains(strings.Join(result.Argv, " "), "PRIVATE KEY") {
+		t.Errorf("the private key is in the command line of the process: %s", result.Cmdline)
+	}
+
+	// a failed call exits with its error
+	out, err = run("certificate.delete", "", []int64{3})
+	if err == nil || !strings.Contains(out, "in use") {
+		t.Errorf("the failed call should exit with its error, got %v %s", err, out)
+	}
+}
@@ -0,0 +1,225 @@
+/*
+ * Copyright (C) 2025 by John J. Rushford jrushford@apache.org
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package clients
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"tnascert-deploy/config"
+)
+
+// guards the reads and writes of the trust_store files.
+var trustStoreMu sync.Mutex
+
+// PinError is returned when the public key of the certificate served by a
+// host does not match its pin_sha256 or the pin recorded in the trust_store.
+type PinError struct {
+	Address string
+	Pin     string // the pin of the served certificate
+	Source  string // where the expected pins come from
+}
+
+func (e *PinError) Error() string {
+	return fmt.Sprintf("the certificate of %s has the public key pin %s that does not match the %s", e.Address, e.Pin, e.Source)
+}
+
+// SPKIPin returns the base64 SHA-256 hash of the public key of a
+// certificate, the value of a pin_sha256.
+func SPKIPin(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// TLSConfig returns the TLS configuration of the connections to the
+// connect_host of cfg, presenting the client_cert_path certificate to a
+// reverse proxy that requires one.  The certificate of the host is verified
+// with the CAs of the ca_file, or of the system.  With a pin_sha256, or else
+// a trust_store, the public key of the certificate must match the pin
+// instead, so that a self-signed or expired certificate is trusted without
+// tls_skip_verify.  The certificate is still verified when a ca_file is
+// given too.  A host missing from the trust_store is trusted on first use
+// and its pin recorded.
+func TLSConfig(cfg *config.Config) (*tls.Config, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: cfg.TlsSkipVerify}
+	if cfg.CAFile != "" {
+		data, err := os.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("error reading the ca_file: %v", err)
+		}
+		roots := x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no certificate was found in the ca_file '%s'", cfg.CAFile)
+		}
+		tlsConfig.RootCAs = roots
+	}
+	if cfg.ClientCertPath != "" {
+		clientCert, err := tls.LoadX509KeyPair(cfg.ClientCertPath, cfg.ClientKeyPath)
+		if err != nil {
+			return nil, fmt.Errorf("error loading the client certificate: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{clientCert}
+	}
+
+	pins := cfg.Pins()
+	if len(pins) == 0 && cfg.TrustStore == "" {
+		return tlsConfig, nil
+	}
+	if cfg.CAFile == "" {
+		// the pin replaces the verification of the certificate chain
+		tlsConfig.InsecureSkipVerify = true
+	}
+	address := net.JoinHostPort(cfg.ConnectHost, strconv.FormatUint(cfg.Port, 10))
+	tlsConfig.VerifyConnection = func(cs tls.ConnectionState) error {
+		if len(cs.PeerCertificates) == 0 {
+			return fmt.Errorf("%s did not send a certificate", address)
+		}
+		pin := SPKIPin(cs.PeerCertificates[0])
+		if len(pins) > 0 {
+			if !slices.Contains(pins, pin) {
+				return &PinError{Address: address, Pin: pin, Source: "pin_sha256"}
+			}
+			return nil
+		}
+		return trustOnFirstUse(cfg.TrustStore, address, pin)
+	}
+	return tlsConfig, nil
+}
+
+// checks the pin of a host against the trust_store, the pin of a host that
+// is not in the store yet is recorded.
+func trustOnFirstUse(store string, address string, pin string) error {
+	trustStoreMu.Lock()
+	defer trustStoreMu.Unlock()
+	pins, err := readTrustStore(store)
+	if err != nil {
+		return err
+	}
+	known, ok := pins[address]
+	if ok && known != pin {
+		return &PinError{Address: address, Pin: pin, Source: fmt.Sprintf("pin %s recorded in the trust_store '%s'", known, store)}
+	}
+	if !ok {
+		log.Printf("trusting the certificate of %s on first use, recording its public key pin %s in '%s'", address, pin, store)
+		return writeTrustStore(store, address, pin)
+	}
+	return nil
+}
+
+// TrustDeployedCertificate records the public key pin of the deployed
+// certificate for the connect_host in the trust_store, once it is served as
+// the UI certificate.  A pin_sha256 that does not match it is reported.
+func TrustDeployedCertificate(ctx context.Context, cfg *config.Config) error {
+	leaf, err := loadLeaf(ctx, cfg)
+	if err != nil {
+		return err
+	}
+	pin := SPKIPin(leaf)
+	address := net.JoinHostPort(cfg.ConnectHost, strconv.FormatUint(cfg.Port, 10))
+	if pins := cfg.Pins(); len(pins) > 0 && !slices.Contains(pins, pin) {
+		log.Printf("the pin_sha256 does not match the deployed certificate, set it to %s to connect to %s again", pin, address)
+	}
+	if cfg.TrustStore == "" {
+		return nil
+	}
+	trustStoreMu.Lock()
+	defer trustStoreMu.Unlock()
+	if err = writeTrustStore(cfg.TrustStore, address, pin); err != nil {
+		return err
+	}
+	log.Printf("recorded the public key pin %s of the deployed certificate for %s in '%s'", pin, address, cfg.TrustStore)
+	return nil
+}
+
+// reads the pins of a trust_store, a line holds an address and its pin.  A
+// missing store is empty.
+func readTrustStore(store string) (map[string]string, error) {
+	pins := make(map[string]string)
+	data, err := os.ReadFile(store)
+	if errors.Is(err, os.ErrNotExist) {
+		return pins, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading the trust_store: %v", err)
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("invalid line %d in the trust_store '%s', expected an address and a pin", line, store)
+		}
+		pins[fields[0]] = fields[1]
+	}
+	return pins, nil
+}
+
+// sets the pin of an address in a trust_store, the store is replaced
+// atomically.
+func writeTrustStore(store string, address string, pin string) error {
+	pins, err := readTrustStore(store)
+	if err != nil {
+		return err
+	}
+	pins[address] = pin
+	addresses := make([]string, 0, len(pins))
+	for a := range pins {
+		addresses = append(addresses, a)
+	}
+	slices.Sort(addresses)
+
+	var b bytes.Buffer
+	b.WriteString("# public key pins of the TrueNAS hosts, written by tnascert-deploy\n")
+	for _, a := range addresses {
+		fmt.Fprintf(&b, "%s %s\n", a, pins[a])
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(store), filepath.Base(store)+".*")
+	if err != nil {
+		return fmt.Errorf("error writing the trust_store: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err = tmp.Write(b.Bytes()); err == nil {
+		err = tmp.Close()
+	} else {
+		tmp.Close()
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), store)
+	}
+	if err != nil {
+		return fmt.Errorf("error writing the trust_store: %v", err)
+	}
+	return nil
+}
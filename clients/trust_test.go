@@ -0,0 +1,208 @@
+/*
+ * Copyright (C) 2025 by John J. Rushford jrushford@apache.org
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package clients
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"tnascert-deploy/config"
+)
+
+// connects to the test server with the TLS configuration of cfg.
+func dialTLS(t *testing.T, server *httptest.Server, cfg *tls.Config) error {
+	conn, err := tls.Dial("tcp", server.Listener.Addr().String(), cfg)
+	if err == nil {
+		conn.Close()
+	}
+	return err
+}
+
+func TestTLSConfig(t *testing.T) {
+	server := httptest.NewTLSServer(http.NotFoundHandler())
+	defer server.Close()
+	pin := SPKIPin(server.Certificate())
+	dir := t.TempDir()
+
+	// the self-signed test certificate is not trusted by default
+	cfg := probeConfig(t, server, false)
+	tlsConfig, err := TLSConfig(cfg)
+	if err != nil {
+		t.Fatalf("TLSConfig() failed: %v", err)
+	}
+	if err = dialTLS(t, server, tlsConfig); err == nil {
+		t.Errorf("the test certificate should not be trusted")
+	}
+
+	// it is with a ca_file
+	cfg.CAFile = filepath.Join(dir, "ca.pem")
+	caPem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	if err = os.WriteFile(cfg.CAFile, caPem, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if tlsConfig, err = TLSConfig(cfg); err != nil {
+		t.Fatalf("TLSConfig() with a ca_file failed: %v", err)
+	}
+	if err = dialTLS(t, server, tlsConfig); err != nil {
+		t.Errorf("the test certificate should be trusted with the ca_file: %v", err)
+	}
+
+	// or with its pin, a wrong pin is refused even with the ca_file
+	tests := []struct {
+		pin    string
+		caFile string
+		ok     bool
+	}{
+		{pin, "", true},
+		{"AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=," + pin, "", true},
+		{"AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=", "", false},
+		{"AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=", cfg.CAFile, false},
+	}
+	for _, test := range tests {
+		cfg := probeConfig(t, server, false)
+		cfg.PinSHA256 = test.pin
+		cfg.CAFile = test.caFile
+		if tlsConfig, err = TLSConfig(cfg); err != nil {
+			t.Fatalf("TLSConfig() failed: %v", err)
+		}
+		err = dialTLS(t, server, tlsConfig)
+		if test.ok && err != nil {
+			t.Errorf("the pin_sha256 '%s' should be accepted: %v", test.pin, err)
+		}
+		if !test.ok && (err == nil || !strings.Contains(err.Error(), pin)) {
+			t.Errorf("the pin_sha256 '%s' should be refused, got: %v", test.pin, err)
+		}
+	}
+}
+
+func TestTrustStore(t *testing.T) {
+	server := httptest.NewTLSServer(http.NotFoundHandler())
+	defer server.Close()
+	pin := SPKIPin(server.Certificate())
+
+	cfg := probeConfig(t, server, false)
+	cfg.TrustStore = filepath.Join(t.TempDir(), "known_pins")
+	tlsConfig, err := TLSConfig(cfg)
+	if err != nil {
+		t.Fatalf("TLSConfig() failed: %v", err)
+	}
+
+	// the certificate is trusted on first use and its pin recorded
+	if err = dialTLS(t, server, tlsConfig); err != nil {
+		t.Fatalf("the first connection should be trusted: %v", err)
+	}
+	pins, err := readTrustStore(cfg.TrustStore)
+	if err != nil || pins[server.Listener.Addr().String()] != pin {
+		t.Fatalf("the pin should be recorded, got %v %v", pins, err)
+	}
+	if err = dialTLS(t, server, tlsConfig); err != nil {
+		t.Errorf("the recorded certificate should be trusted: %v", err)
+	}
+
+	// a certificate with another key is refused
+	other := httptest.NewUnstartedServer(http.NotFoundHandler())
+	other.TLS = &tls.Config{Certificates: []tls.Certificate{loadPair(t)}}
+	other.StartTLS()
+	defer other.Close()
+	otherCfg := probeConfig(t, other, false)
+	otherCfg.TrustStore = cfg.TrustStore
+	if err = writeTrustStore(cfg.TrustStore, other.Listener.Addr().String(), pin); err != nil {
+		t.Fatal(err)
+	}
+	if tlsConfig, err = TLSConfig(otherCfg); err != nil {
+		t.Fatalf("TLSConfig() failed: %v", err)
+	}
+	err = dialTLS(t, other, tlsConfig)
+	if err == nil || !strings.Contains(err.Error(), "trust_store") {
+		t.Errorf("a certificate not matching the trust_store should be refused, got: %v", err)
+	}
+
+	// until the deployed certificate is recorded
+	otherCfg.FullChainPath = "test_files/fullchain.pem"
+	if err = TrustDeployedCertificate(context.Background(), otherCfg); err != nil {
+		t.Fatalf("TrustDeployedCertificate() failed: %v", err)
+	}
+	if err = dialTLS(t, other, tlsConfig); err != nil {
+		t.Errorf("the deployed certificate should be trusted: %v", err)
+	}
+	if pins, _ = readTrustStore(cfg.TrustStore); pins[server.Listener.Addr().String()] != pin {
+		t.Errorf("the pins of the other hosts should be kept: %v", pins)
+	}
+	if info, err := os.Stat(cfg.TrustStore); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("the trust_store should only be readable by its owner: %v", err)
+	}
+}
+
+// loads the test certificate and key.
+func loadPair(t *testing.T) tls.Certificate {
+	cert, err := tls.LoadX509KeyPair("test_files/fullchain.pem", "test_files/privkey.pem")
+	if err != nil {
+		t.Fatalf("error loading the test certificate: %v", err)
+	}
+	return cert
+}
+
+func TestClientCertificate(t *testing.T) {
+	// a reverse proxy stand-in requiring a client certificate
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(r.TLS.PeerCertificates) == 0 {
+			http.Error(w, "no client certificate", http.StatusBadRequest)
+		}
+	}))
+	server.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+	server.StartTLS()
+	defer server.Close()
+
+	get := func(cfg *config.Config) error {
+		tlsConfig, err := TLSConfig(cfg)
+		if err != nil {
+			return err
+		}
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}}
+		resp, err := client.Get(server.URL)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("%s", resp.Status)
+		}
+		return nil
+	}
+
+	cfg := probeConfig(t, server, true)
+	if err := get(cfg); err == nil {
+		t.Errorf("the request without a client certificate should fail")
+	}
+	cfg.ClientCertPath = "test_files/fullchain.pem"
+	cfg.ClientKeyPath = "test_files/privkey.pem"
+	if err := get(cfg); err != nil {
+		t.Errorf("the request with the client certificate failed: %v", err)
+	}
+	cfg.ClientKeyPath = "test_files/expired-key.pem"
+	if _, err := TLSConfig(cfg); err == nil {
+		t.Errorf("a client key that does not match the certificate should be refused")
+	}
+}
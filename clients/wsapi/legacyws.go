@@ -0,0 +1,379 @@
+/*
+ * Copyright (C) 2025 by John J. Rushford jrushford@apache.org
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package wsapi
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"tnascert-deploy/clients"
+	"tnascert-deploy/config"
+
+	"github.com/gorilla/websocket"
+	"github.com/truenas/api_client_golang/truenas_api"
+)
+
+// LegacyEndPoint is the DDP websocket API of TrueNAS CORE 13 and SCALE 22
+// to 24.
+const LegacyEndPoint = "/websocket"
+
+// DDPClient is a client of the DDP websocket API that TrueNAS served before
+// the JSON-RPC 2.0 API.  Its calls are 'method' messages answered by
+// 'result' messages, the jobs are followed with a 'sub' to core.get_jobs.
+type DDPClient struct {
+	conn        *websocket.Conn
+	callTimeout time.Duration
+	writeMu     sync.Mutex // serializes the writes to conn
+
+	mu      sync.Mutex // guards the fields below
+	callID  int
+	pending map[string]*pendingCall
+	ready   map[string]chan struct{} // the subscriptions waiting to be ready
+	jobs    *jobTracker
+	closed  bool
+	done    chan struct{} // closed when the connection is closed
+}
+
+// the messages received from the DDP websocket API.
+type ddpMessage struct {
+	Msg        string          `json:"msg"`
+	ID         json.RawMessage `json:"id"` // a call ID, or a job ID in a collection update
+	Session    string          `json:"session"`
+	Result     json.RawMessage `json:"result"`
+	Error      json.RawMessage `json:"error"`
+	Subs       []string        `json:"subs"`
+	Collection string          `json:"collection"`
+	Fields     jobFields       `json:"fields"`
+}
+
+// NewLegacyClient connects to the DDP websocket API of the connect_host,
+// the deployment then runs as with the JSON-RPC 2.0 API.
+func NewLegacyClient(cfg *config.Config) (clients.Client, error) {
+	serverURL := strings.TrimRight(cfg.ServerURL(), "/") + LegacyEndPoint
+
+	// the connection must be established within the connect_timeout
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.ConnectTimeout)
+	defer cancel()
+	tlsConfig, err := clients.TLSConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	dialer := &websocket.Dialer{
+		Proxy:            clients.ProxyFunc(cfg),
+		TLSClientConfig:  tlsConfig,
+		HandshakeTimeout: cfg.ConnectTimeout,
+	}
+	cl, err := DialDDP(ctx, dialer, serverURL, cfg.CallTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("error: %w", err)
+	}
+
+	legacy_client := TrueNASWebSocket{
+		Url:       serverURL,
+		VerifySSL: !cfg.TlsSkipVerify,
+		WSClient:  cl,
+		Cfg:       cfg,
+	}
+	return legacy_client, nil
+}
+
+// DialDDP connects to the DDP websocket API at url and opens the DDP
+// session, both must complete before ctx is done.
+func DialDDP(ctx context.Context, dialer *websocket.Dialer, url string, callTimeout time.Duration) (*DDPClient, error) {
+	conn, resp, err := dialer.DialContext(ctx, url, nil)
+	if err != nil {
+		if resp != nil {
+			return nil, fmt.Errorf("failed to connect to %s: %s", url, resp.Status)
+		}
+		return nil, fmt.Errorf("failed to connect to %s: %w", url, err)
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetReadDeadline(deadline)
+		conn.SetWriteDeadline(deadline)
+	}
+	var connected ddpMessage
+	err = conn.WriteJSON(map[string]interface{}{"msg": "connect", "version": "1", "support": []string{"1"}})
+	if err == nil {
+		err = conn.ReadJSON(&connected)
+	}
+	if err == nil && connected.Msg != "connected" {
+		err = fmt.Errorf("the server answered '%s'", connected.Msg)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to open the DDP session on %s: %w", url, err)
+	}
+	conn.SetReadDeadline(time.Time{})
+	conn.SetWriteDeadline(time.Time{})
+
+	c := &DDPClient{
+		conn:        conn,
+		callTimeout: callTimeout,
+		pending:     make(map[string]*pendingCall),
+		ready:       make(map[string]chan struct{}),
+		jobs:        newJobTracker(),
+		done:        make(chan struct{}),
+	}
+	go c.listen()
+	return c, nil
+}
+
+// Login authenticates with the API key, or else with the username and
+// password.
+func (c *DDPClient) Login(username string, password string, apiKey string) error {
+	method, params := "auth.login_with_api_key", []interface{}{apiKey}
+	if apiKey == "" {
+		if username == "" || password == "" {
+			return errors.New("either username/password or API key must be provided")
+		}
+		method, params = "auth.login", []interface{}{username, password}
+	}
+	res, err := c.call(method, c.callTimeout, params, nil)
+	if err != nil {
+		return fmt.Errorf("login failed: %w", err)
+	}
+	var response ddpMessage
+	if err = json.Unmarshal(res, &response); err != nil {
+		return fmt.Errorf("failed to parse login response: %v", err)
+	}
+	if len(response.Error) > 0 && string(response.Error) != "null" {
+		return fmt.Errorf("login error: %s", response.Error)
+	}
+	if string(response.Result) != "true" {
+		return errors.New("login failed, unexpected response")
+	}
+	return nil
+}
+
+// Call sends a call and returns the whole result message, the call fails
+// when no result is received within timeout seconds.
+func (c *DDPClient) Call(method string, timeout int64, params interface{}) (json.RawMessage, error) {
+	return c.call(method, time.Duration(timeout)*time.Second, params, nil)
+}
+
+// CallWithJob sends a call starting a job and returns the job, its DoneCh
+// receives the job error, empty on success, once the job is finished.
+func (c *DDPClient) CallWithJob(method string, params interface{}, callback func(progress float64, state string, desc string)) (*truenas_api.Job, error) {
+	job := &truenas_api.Job{
+		Method:     method,
+		State:      "PENDING",
+		ProgressCh: make(chan float64, 1),
+		DoneCh:     make(chan string, 1),
+		Callback:   callback,
+	}
+	res, err := c.call(method, c.callTimeout, params, job)
+	if err != nil {
+		return nil, err
+	}
+	var response ddpMessage
+	if err = json.Unmarshal(res, &response); err != nil {
+		return nil, fmt.Errorf("failed to parse response: %v", err)
+	}
+	if len(response.Error) > 0 && string(response.Error) != "null" {
+		return nil, fmt.Errorf("API error: %s", response.Error)
+	}
+	if job.ID == 0 {
+		return nil, fmt.Errorf("unexpected response format for job")
+	}
+	return job, nil
+}
+
+// SubscribeToJobs subscribes to core.get_jobs and waits until the
+// subscription is ready, the updates tell when the jobs started by
+// CallWithJob finish.
+func (c *DDPClient) SubscribeToJobs() error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return errors.New("core.get_jobs subscription failed: the connection is closed")
+	}
+	c.callID++
+	id := "sub-" + strconv.Itoa(c.callID)
+	ready := make(chan struct{})
+	c.ready[id] = ready
+	c.mu.Unlock()
+
+	if err := c.write(map[string]interface{}{"msg": "sub", "id": id, "name": "core.get_jobs"}); err != nil {
+		return fmt.Errorf("failed to subscribe to core.get_jobs: %v", err)
+	}
+	t := time.NewTimer(c.callTimeout)
+	defer t.Stop()
+	select {
+	case <-ready:
+		return nil
+	case <-t.C:
+		return fmt.Errorf("the core.get_jobs subscription was not ready after %v", c.callTimeout)
+	case <-c.done:
+		return errors.New("core.get_jobs subscription failed: the connection was closed")
+	}
+}
+
+// Close closes the connection.
+func (c *DDPClient) Close() error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil
+	}
+	c.closed = true
+	close(c.done)
+	c.mu.Unlock()
+
+	c.writeMu.Lock()
+	err := c.conn.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+	c.writeMu.Unlock()
+	if closeErr := c.conn.Close(); err == nil {
+		err = closeErr
+	}
+	if errors.Is(err, websocket.ErrCloseSent) {
+		return nil
+	}
+	return err
+}
+
+// writes a message, within the call timeout.
+func (c *DDPClient) write(msg interface{}) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	c.conn.SetWriteDeadline(time.Now().Add(c.callTimeout))
+	return c.conn.WriteJSON(msg)
+}
+
+// sends a call and waits for its result.  The job of a call starting a job
+// is registered before any later update of the job is handled, and receives
+// the update handled before the result.
+func (c *DDPClient) call(method string, timeout time.Duration, params interface{}, job *truenas_api.Job) (json.RawMessage, error) {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil, fmt.Errorf("%s call failed: the connection is closed", method)
+	}
+	c.callID++
+	id := strconv.Itoa(c.callID)
+	p := &pendingCall{method: method, response: make(chan json.RawMessage, 1), job: job}
+	c.pending[id] = p
+	if job != nil {
+		c.jobs.start()
+	}
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		delete(c.pending, id)
+		if job != nil {
+			c.jobs.end()
+		}
+		c.mu.Unlock()
+	}()
+
+	if params == nil {
+		params = []interface{}{}
+	}
+	err := c.write(map[string]interface{}{"msg": "method", "id": id, "method": method, "params": params})
+	if err != nil {
+		return nil, fmt.Errorf("failed to send the %s call: %v", method, err)
+	}
+
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+	select {
+	case res := <-p.response:
+		return res, nil
+	case <-t.C:
+		return nil, fmt.Errorf("the %s call timed out after %v", method, timeout)
+	case <-c.done:
+		return nil, fmt.Errorf("%s call failed: the connection was closed", method)
+	}
+}
+
+// reads the messages until the connection is closed, delivering the
+// results to the pending calls and the job updates to the jobs.  The pings
+// of the server are answered.
+func (c *DDPClient) listen() {
+	defer c.Close()
+	for {
+		_, data, err := c.conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		var msg ddpMessage
+		if err := json.Unmarshal(data, &msg); err != nil {
+			continue
+		}
+		switch msg.Msg {
+		case "ping":
+			pong := map[string]interface{}{"msg": "pong"}
+			if len(msg.ID) > 0 {
+				pong["id"] = msg.ID
+			}
+			c.write(pong)
+		case "result":
+			var id string
+			if json.Unmarshal(msg.ID, &id) != nil {
+				continue
+			}
+			var job *truenas_api.Job
+			var early *jobFields
+			c.mu.Lock()
+			if p, ok := c.pending[id]; ok {
+				var jobID int64
+				if p.job != nil && json.Unmarshal(msg.Result, &jobID) == nil && jobID > 0 {
+					p.job.ID = jobID
+					job, early = p.job, c.jobs.register(p.job)
+				}
+				p.response <- data
+			}
+			c.mu.Unlock()
+			if early != nil {
+				deliverJobUpdate(job, early)
+			}
+		case "ready":
+			c.mu.Lock()
+			for _, id := range msg.Subs {
+				if ready, ok := c.ready[id]; ok {
+					close(ready)
+					delete(c.ready, id)
+				}
+			}
+			c.mu.Unlock()
+		case "added", "changed":
+			if msg.Collection == "core.get_jobs" {
+				c.updateJob(&msg)
+			}
+		}
+	}
+}
+
+// handles an update of a job started by this client.
+func (c *DDPClient) updateJob(msg *ddpMessage) {
+	var jobID int64
+	if json.Unmarshal(msg.ID, &jobID) != nil {
+		return
+	}
+	c.mu.Lock()
+	job, ok := c.jobs.update(jobID, &msg.Fields)
+	c.mu.Unlock()
+	if ok {
+		deliverJobUpdate(job, &msg.Fields)
+	}
+}
@@ -0,0 +1,86 @@
+/*
+ * Copyright (C) 2025 by John J. Rushford jrushford@apache.org
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package wsapi
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"tnascert-deploy/clients"
+	"tnascert-deploy/config"
+
+	"github.com/gorilla/websocket"
+)
+
+// the URL of the websocket API served on the middlewared socket, the host
+// is not used.
+const localURL = "ws://localhost" + EndPoint
+
+// NewLocalClient connects to the websocket API over the middlewared Unix
+// socket of the local_socket, for a deployment run on the TrueNAS host
+// itself.  The connection does not go through the UI, so it survives the
+// UI restart and needs neither TLS nor a proxy.
+func NewLocalClient(cfg *config.Config) (clients.Client, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.ConnectTimeout)
+	defer cancel()
+	dialer := &websocket.Dialer{
+		NetDialContext: func(ctx context.Context, network string, addr string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", cfg.LocalSocket)
+		},
+		HandshakeTimeout: cfg.ConnectTimeout,
+	}
+	cl, err := DialRPC(ctx, dialer, localURL, cfg.CallTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to the middlewared socket '%s': %w", cfg.LocalSocket, err)
+	}
+
+	local_client := TrueNASWebSocket{
+		Url:      localURL,
+		WSClient: cl,
+		Cfg:      cfg,
+	}
+	return local_client, nil
+}
+
+// checks that middlewared authenticated the connection with the peer
+// credentials of the process, as it does for root and for the local users
+// allowed to use the API.  With client_api = ssh the process is the midclt
+// run by the ssh_user.
+func loginLocal(ctx context.Context, client *TrueNASWebSocket) error {
+	origin := fmt.Sprintf("the middlewared socket '%s'", client.Cfg.LocalSocket)
+	user := fmt.Sprintf("uid %d", os.Getuid())
+	if client.Cfg.ClientApi == "ssh" {
+		origin = fmt.Sprintf("midclt on %s", client.Cfg.ConnectHost)
+		user = fmt.Sprintf("the ssh_user '%s'", client.Cfg.SSHUser)
+	}
+	if client.Cfg.Debug {
+		log.Printf("logging in to %s with the peer credentials", origin)
+	}
+	var me struct {
+		Username string `json:"pw_name"`
+		UID      int    `json:"pw_uid"`
+	}
+	if err := callResult(ctx, client, "auth.me", &me); err != nil {
+		return fmt.Errorf("%s did not authenticate %s, use root or a user allowed to use the API: %w", origin, user, err)
+	}
+	log.Printf("authenticated to %s as %s (uid %d)", origin, me.Username, me.UID)
+	return nil
+}
@@ -18,6 +18,7 @@
 package wsapi
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"github.com/truenas/api_client_golang/truenas_api"
@@ -36,10 +37,14 @@ type MockWebSocketClient struct {
 func (m *MockWebSocketClient) Call(method string, timeout int64, params interface{}) (json.RawMessage, error) {
 	if method == "app.certificate_choices" {
 		var resp json.RawMessage
+		certName, err := m.cfg.CertName(context.Background())
+		if err != nil {
+			return nil, err
+		}
 		certs := []map[string]interface{}{
 			{"id": 1, "name": "truenas_default"},
 			{"id": 2, "name": "tnas-cert-deploy-2024-12-31-0801683628"},
-			{"id": 3, "name": m.cfg.CertName()},
+			{"id": 3, "name": certName},
 		}
 
 		var args map[string]interface{} = make(map[string]interface{})
@@ -118,6 +123,15 @@ func (m *MockWebSocketClient) Call(method string, timeout int64, params interfac
 			resp := json.RawMessage(res)
 			return resp, nil
 		}
+	} else if method == "certificate.query" {
+		jsonResp := `{"jsonrpc": "2.0","result": [{"id": 1, "name": "truenas_default"}, {"id": 65, "name": "tnas-cert-deploy-2024-12-31-0801683628"}]}`
+		return json.RawMessage(jsonResp), nil
+	} else if method == "system.general.config" {
+		jsonResp := `{"jsonrpc": "2.0","result": {"ui_certificate": {"id": 65, "name": "tnas-cert-deploy-2024-12-31-0801683628"}}}`
+		return json.RawMessage(jsonResp), nil
+	} else if method == "ftp.config" {
+		jsonResp := `{"jsonrpc": "2.0","result": {"ssltls_certificate": 1}}`
+		return json.RawMessage(jsonResp), nil
 	} else if method == "system.general.ui_restart" {
 		return nil, nil
 	} else if method == "system.info" {
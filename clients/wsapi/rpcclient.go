@@ -0,0 +1,378 @@
+/*
+ * Copyright (C) 2025 by John J. Rushford jrushford@apache.org
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package wsapi
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/truenas/api_client_golang/truenas_api"
+)
+
+// RPCClient is a JSON-RPC 2.0 client of the TrueNAS websocket API.  Unlike
+// the truenas_api client it is dialed with a websocket.Dialer configured by
+// the caller and it bounds the calls starting a job with its call timeout.
+type RPCClient struct {
+	conn        *websocket.Conn
+	callTimeout time.Duration
+	writeMu     sync.Mutex // serializes the writes to conn
+
+	mu      sync.Mutex // guards the fields below
+	callID  int
+	pending map[int]*pendingCall
+	jobs    *jobTracker
+	closed  bool
+	done    chan struct{} // closed when the connection is closed
+}
+
+// a call waiting for its response.
+type pendingCall struct {
+	method   string
+	response chan json.RawMessage
+	job      *truenas_api.Job // set for a call starting a job
+}
+
+// the messages received from the websocket API, a response to a call or a
+// notification.
+type rpcMessage struct {
+	ID     *int            `json:"id"`
+	Method string          `json:"method"`
+	Result json.RawMessage `json:"result"`
+	Error  json.RawMessage `json:"error"`
+	Params struct {
+		Collection string    `json:"collection"`
+		ID         int64     `json:"id"`
+		Fields     jobFields `json:"fields"`
+	} `json:"params"`
+}
+
+// the fields of a job update in core.get_jobs.
+type jobFields struct {
+	State    string      `json:"state"`
+	Result   interface{} `json:"result"`
+	Error    string      `json:"error"`
+	Progress struct {
+		Percent     float64 `json:"percent"`
+		Description string  `json:"description"`
+	} `json:"progress"`
+}
+
+// reports whether the job of a state is finished.
+func (f *jobFields) finished() bool {
+	return f.State == "SUCCESS" || f.State == "FAILED" || f.State == "ABORTED"
+}
+
+// tracks the jobs started by a client.  A job update may be received before
+// the response to the call starting the job, the last update of such a job
+// is kept until the response registers the job, as long as a call starting
+// a job is pending.  It is guarded by the mutex of the client.
+type jobTracker struct {
+	jobs  map[int64]*truenas_api.Job
+	early map[int64]jobFields // the last update of the jobs not registered yet
+	calls int                 // the pending calls starting a job
+}
+
+func newJobTracker() *jobTracker {
+	return &jobTracker{
+		jobs:  make(map[int64]*truenas_api.Job),
+		early: make(map[int64]jobFields),
+	}
+}
+
+// records a pending call starting a job.
+func (t *jobTracker) start() {
+	t.calls++
+}
+
+// records the end of a call starting a job, the updates kept for the jobs
+// that were not registered are dropped once no such call is pending.
+func (t *jobTracker) end() {
+	t.calls--
+	if t.calls == 0 {
+		clear(t.early)
+	}
+}
+
+// registers the job started by a call, its update received before the
+// response is returned to be delivered.
+func (t *jobTracker) register(job *truenas_api.Job) *jobFields {
+	fields, ok := t.early[job.ID]
+	delete(t.early, job.ID)
+	if !ok || !fields.finished() {
+		t.jobs[job.ID] = job
+	}
+	if ok {
+		return &fields
+	}
+	return nil
+}
+
+// returns the registered job of an update, a finished job is forgotten.  The
+// update of a job that is not registered is kept while a call starting a job
+// is pending.
+func (t *jobTracker) update(id int64, fields *jobFields) (*truenas_api.Job, bool) {
+	job, ok := t.jobs[id]
+	switch {
+	case ok && fields.finished():
+		delete(t.jobs, id)
+	case !ok && t.calls > 0:
+		t.early[id] = *fields
+	}
+	return job, ok
+}
+
+// DialRPC connects to the websocket API at url, the dial and the websocket
+// handshake must complete before ctx is done.
+func DialRPC(ctx context.Context, dialer *websocket.Dialer, url string, callTimeout time.Duration) (*RPCClient, error) {
+	conn, resp, err := dialer.DialContext(ctx, url, nil)
+	if err != nil {
+		if resp != nil {
+			return nil, fmt.Errorf("failed to connect to %s: %s", url, resp.Status)
+		}
+		return nil, fmt.Errorf("failed to connect to %s: %w", url, err)
+	}
+	c := &RPCClient{
+		conn:        conn,
+		callTimeout: callTimeout,
+		pending:     make(map[int]*pendingCall),
+		jobs:        newJobTracker(),
+		done:        make(chan struct{}),
+	}
+	go c.listen()
+	return c, nil
+}
+
+// Login authenticates with the API key, or else with the username and
+// password.
+func (c *RPCClient) Login(username string, password string, apiKey string) error {
+	method, params := "auth.login_with_api_key", []interface{}{apiKey}
+	if apiKey == "" {
+		if username == "" || password == "" {
+			return errors.New("either username/password or API key must be provided")
+		}
+		method, params = "auth.login", []interface{}{username, password}
+	}
+	res, err := c.call(method, c.callTimeout, params, nil)
+	if err != nil {
+		return fmt.Errorf("login failed: %w", err)
+	}
+	var response rpcMessage
+	if err = json.Unmarshal(res, &response); err != nil {
+		return fmt.Errorf("failed to parse login response: %v", err)
+	}
+	if len(response.Error) > 0 && string(response.Error) != "null" {
+		return fmt.Errorf("login error: %s", response.Error)
+	}
+	if string(response.Result) != "true" {
+		return errors.New("login failed, unexpected response")
+	}
+	return nil
+}
+
+// Call sends a call and returns the whole response, the call fails when no
+// response is received within timeout seconds.
+func (c *RPCClient) Call(method string, timeout int64, params interface{}) (json.RawMessage, error) {
+	return c.call(method, time.Duration(timeout)*time.Second, params, nil)
+}
+
+// CallWithJob sends a call starting a job and returns the job, its DoneCh
+// receives the job error, empty on success, once the job is finished.
+func (c *RPCClient) CallWithJob(method string, params interface{}, callback func(progress float64, state string, desc string)) (*truenas_api.Job, error) {
+	job := &truenas_api.Job{
+		Method:     method,
+		State:      "PENDING",
+		ProgressCh: make(chan float64, 1),
+		DoneCh:     make(chan string, 1),
+		Callback:   callback,
+	}
+	res, err := c.call(method, c.callTimeout, params, job)
+	if err != nil {
+		return nil, err
+	}
+	var response rpcMessage
+	if err = json.Unmarshal(res, &response); err != nil {
+		return nil, fmt.Errorf("failed to parse response: %v", err)
+	}
+	if len(response.Error) > 0 && string(response.Error) != "null" {
+		return nil, fmt.Errorf("API error: %s", response.Error)
+	}
+	if job.ID == 0 {
+		return nil, fmt.Errorf("unexpected response format for job")
+	}
+	return job, nil
+}
+
+// SubscribeToJobs subscribes to the job updates, they are needed to learn
+// when the jobs started by CallWithJob finish.
+func (c *RPCClient) SubscribeToJobs() error {
+	_, err := c.call("core.subscribe", c.callTimeout, []interface{}{"core.get_jobs"}, nil)
+	return err
+}
+
+// Close closes the connection.
+func (c *RPCClient) Close() error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil
+	}
+	c.closed = true
+	close(c.done)
+	c.mu.Unlock()
+
+	c.writeMu.Lock()
+	err := c.conn.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+	c.writeMu.Unlock()
+	if closeErr := c.conn.Close(); err == nil {
+		err = closeErr
+	}
+	if errors.Is(err, websocket.ErrCloseSent) {
+		return nil
+	}
+	return err
+}
+
+// sends a call and waits for its response.  The job of a call starting a job
+// is registered before any later update of the job is handled, and receives
+// the update handled before the response.
+func (c *RPCClient) call(method string, timeout time.Duration, params interface{}, job *truenas_api.Job) (json.RawMessage, error) {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil, fmt.Errorf("%s call failed: the connection is closed", method)
+	}
+	c.callID++
+	id := c.callID
+	p := &pendingCall{method: method, response: make(chan json.RawMessage, 1), job: job}
+	c.pending[id] = p
+	if job != nil {
+		c.jobs.start()
+	}
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		delete(c.pending, id)
+		if job != nil {
+			c.jobs.end()
+		}
+		c.mu.Unlock()
+	}()
+
+	request := map[string]interface{}{
+		"jsonrpc": "2.0",
+		"method":  method,
+		"id":      id,
+		"params":  params,
+	}
+	c.writeMu.Lock()
+	c.conn.SetWriteDeadline(time.Now().Add(timeout))
+	err := c.conn.WriteJSON(request)
+	c.writeMu.Unlock()
+	if err != nil {
+		return nil, fmt.Errorf("failed to send the %s call: %v", method, err)
+	}
+
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+	select {
+	case res := <-p.response:
+		return res, nil
+	case <-t.C:
+		return nil, fmt.Errorf("the %s call timed out after %v", method, timeout)
+	case <-c.done:
+		return nil, fmt.Errorf("%s call failed: the connection was closed", method)
+	}
+}
+
+// reads the messages until the connection is closed, delivering the
+// responses to the pending calls and the job updates to the jobs.
+func (c *RPCClient) listen() {
+	defer c.Close()
+	for {
+		_, data, err := c.conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		var msg rpcMessage
+		if err := json.Unmarshal(data, &msg); err != nil {
+			continue
+		}
+		switch {
+		case msg.Method == "collection_update" && msg.Params.Collection == "core.get_jobs":
+			c.updateJob(&msg)
+		case msg.ID != nil:
+			var job *truenas_api.Job
+			var early *jobFields
+			c.mu.Lock()
+			if p, ok := c.pending[*msg.ID]; ok {
+				var jobID int64
+				if p.job != nil && json.Unmarshal(msg.Result, &jobID) == nil && jobID > 0 {
+					p.job.ID = jobID
+					job, early = p.job, c.jobs.register(p.job)
+				}
+				p.response <- data
+			}
+			c.mu.Unlock()
+			if early != nil {
+				deliverJobUpdate(job, early)
+			}
+		}
+	}
+}
+
+// handles an update of a job started by this client.
+func (c *RPCClient) updateJob(msg *rpcMessage) {
+	fields := msg.Params.Fields
+	c.mu.Lock()
+	job, ok := c.jobs.update(msg.Params.ID, &fields)
+	c.mu.Unlock()
+	if ok {
+		deliverJobUpdate(job, &fields)
+	}
+}
+
+// delivers a job update to the job, its callback and its progress channel,
+// the job error is sent to its DoneCh once it is finished.
+func deliverJobUpdate(job *truenas_api.Job, fields *jobFields) {
+	if job.Callback != nil {
+		job.Callback(fields.Progress.Percent, fields.State, fields.Progress.Description)
+	}
+	if fields.finished() {
+		jobErr := fields.Error
+		if fields.State != "SUCCESS" && jobErr == "" {
+			jobErr = "the job state is " + fields.State
+		}
+		job.State = fields.State
+		job.Result = fields.Result
+		job.Progress = fields.Progress.Percent
+		job.DoneCh <- jobErr
+		close(job.DoneCh)
+		return
+	}
+	// the progress is dropped when the previous one was not read
+	select {
+	case job.ProgressCh <- fields.Progress.Percent:
+	default:
+	}
+}
@@ -18,15 +18,16 @@
 package wsapi
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"log"
-	"os"
-	"regexp"
 	"strings"
+	"time"
 	"tnascert-deploy/clients"
 	"tnascert-deploy/config"
 
+	"github.com/gorilla/websocket"
 	"github.com/truenas/api_client_golang/truenas_api"
 )
 
@@ -56,56 +57,161 @@ type WSClient interface {
 
 type CertificateListResponse struct {
 	JsonRPC string                   `json:"jsonrpc"`
-	ID      int                      `json:"id"`
+	ID      json.RawMessage          `json:"id"` // a number, or a string with the DDP API
 	Result  []map[string]interface{} `json:"result"`
 }
 
-func (c TrueNASWebSocket) Close() error {
-	err := c.WSClient.Close()
+// Bindings returns the certificates used by the UI, the FTP service and the
+// installed apps.
+func (c TrueNASWebSocket) Bindings(ctx context.Context) (*clients.Bindings, error) {
+	err := getSystemInfo(ctx, &c)
 	if err != nil {
-		return fmt.Errorf("error closing the websocket client connection: %v", err)
+		return nil, fmt.Errorf("could not get system info: %w", err)
+	}
+	bindings := &clients.Bindings{Version: c.Version}
+
+	var certs []struct {
+		ID   int64  `json:"id"`
+		Name string `json:"name"`
+	}
+	if err = callResult(ctx, &c, "certificate.query", &certs); err != nil {
+		return nil, err
+	}
+	names := make(map[int64]string)
+	for _, cert := range certs {
+		names[cert.ID] = cert.Name
+	}
+
+	var general struct {
+		UICertificate interface{} `json:"ui_certificate"`
+	}
+	if err = callResult(ctx, &c, "system.general.config", &general); err != nil {
+		return nil, err
+	}
+	bindings.UICertificate = clients.CertificateName(general.UICertificate, names)
+
+	var ftp struct {
+		Certificate interface{} `json:"ssltls_certificate"`
+	}
+	if err = callResult(ctx, &c, "ftp.config", &ftp); err != nil {
+		return nil, err
+	}
+	bindings.FTPCertificate = clients.CertificateName(ftp.Certificate, names)
+
+	var apps []struct {
+		Name string `json:"name"`
+	}
+	if err = callResult(ctx, &c, "app.query", &apps); err != nil {
+		return nil, err
+	}
+	for _, app := range apps {
+		var appConfig struct {
+			Network map[string]interface{} `json:"network"`
+		}
+		if err = callResult(ctx, &c, "app.config", &appConfig, app.Name); err != nil {
+			return nil, err
+		}
+		if appConfig.Network["certificate_id"] != nil {
+			bindings.Apps = append(bindings.Apps, app.Name)
+		}
+	}
+	return bindings, nil
+}
+
+// BoundCertificates returns the certificates of the UI and FTP services.
+func (c TrueNASWebSocket) BoundCertificates(ctx context.Context) ([]clients.BoundCertificate, error) {
+	var records []clients.CertificateRecord
+	if err := callResult(ctx, &c, "certificate.query", &records); err != nil {
+		return nil, err
+	}
+	var general struct {
+		UICertificate interface{} `json:"ui_certificate"`
+	}
+	if err := callResult(ctx, &c, "system.general.config", &general); err != nil {
+		return nil, err
+	}
+	var ftp struct {
+		Certificate interface{} `json:"ssltls_certificate"`
+	}
+	if err := callResult(ctx, &c, "ftp.config", &ftp); err != nil {
+		return nil, err
+	}
+	return clients.Bound(records, general.UICertificate, ftp.Certificate), nil
+}
+
+func (c TrueNASWebSocket) Close(ctx context.Context) error {
+	done := make(chan error, 1)
+	go func() {
+		done <- c.WSClient.Close()
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			return fmt.Errorf("error closing the websocket client connection: %v", err)
+		}
+	case <-ctx.Done():
+		return fmt.Errorf("error closing the websocket client connection: %w", context.Cause(ctx))
 	}
 	return nil
 }
 
-func (c TrueNASWebSocket) Install() error {
+func (c TrueNASWebSocket) Install(ctx context.Context) error {
 	if c.Cfg.Debug {
 		log.Println("running install tasks")
 	}
-	certName = c.Cfg.CertName()
+	var err error
+	if certName, err = c.Cfg.CertName(ctx); err != nil {
+		return fmt.Errorf("could not build the certificate name: %v", err)
+	}
 
 	// import the certificate
-	err := importCertificate(&c)
+	err = importCertificate(ctx, &c)
 	if err != nil {
-		return fmt.Errorf("could not import certificate: %v", err)
+		return fmt.Errorf("could not import certificate: %w", err)
 	}
 
 	// collect a certificate list
-	err = getCertificateList(&c)
+	err = getCertificateList(ctx, &c)
 	if err != nil {
-		return fmt.Errorf("could not get certificate list: %v", err)
+		return fmt.Errorf("could not get certificate list: %w", err)
 	}
 
 	return nil
 }
 
-func (c TrueNASWebSocket) Login() error {
+func (c TrueNASWebSocket) Login(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return context.Cause(ctx)
+	}
+	// without credentials the middlewared socket authenticates the process,
+	// the midclt calls over SSH are always made as the ssh_user
+	if c.Cfg.ClientApi == "ssh" || (c.Cfg.ClientApi == "local" && c.Cfg.ApiKey == "" && c.Cfg.Username == "") {
+		return loginLocal(ctx, &c)
+	}
 	// preferred login is with the API key
 	if c.Cfg.ApiKey != "" {
 		if c.Cfg.Debug {
-			log.Printf("logging in to %s with the ApiKey", c.Cfg.ConnectHost)
+			log.Printf("logging in to %s with the ApiKey", c.Cfg.HostName())
+		}
+		apiKey, err := c.Cfg.ResolveApiKey(ctx)
+		if err != nil {
+			return err
 		}
-		err := c.WSClient.Login(c.Cfg.Username, c.Cfg.Password, c.Cfg.ApiKey)
+		err = c.WSClient.Login(c.Cfg.Username, "", apiKey)
 		if err != nil {
-			return fmt.Errorf("error logging in to %s with the ApiKey: %v", c.Cfg.ConnectHost, err)
+			return fmt.Errorf("error logging in to %s with the ApiKey: %v", c.Cfg.HostName(), err)
 		}
 	} else if c.Cfg.Username != "" && c.Cfg.Password != "" {
 		if c.Cfg.Debug {
-			log.Printf("logging in to %s with the Username and Password\n", c.Cfg.ConnectHost)
+			log.Printf("logging in to %s with the Username and Password\n", c.Cfg.HostName())
 		}
-		err := c.WSClient.Login(c.Cfg.Username, c.Cfg.Password, "")
+		password, err := c.Cfg.ResolvePassword(ctx)
 		if err != nil {
-			return fmt.Errorf("error logging in to %s with the Username and Password: %v", c.Cfg.ConnectHost, err)
+			return err
+		}
+		err = c.WSClient.Login(c.Cfg.Username, password, "")
+		if err != nil {
+			return fmt.Errorf("error logging in to %s with the Username and Password: %v", c.Cfg.HostName(), err)
 		}
 	} else {
 		return fmt.Errorf("you need to specify a valid ApiKey or Username and Password")
@@ -121,9 +227,22 @@ func NewClient(cfg *config.Config) (clients.Client, error) {
 		verifySSL = true
 	}
 	serverURL := strings.TrimRight(cfg.ServerURL(), "/") + EndPoint
-	cl, err := truenas_api.NewClient(serverURL, verifySSL)
+
+	// the connection must be established within the connect_timeout
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.ConnectTimeout)
+	defer cancel()
+	tlsConfig, err := clients.TLSConfig(cfg)
 	if err != nil {
-		return nil, fmt.Errorf("error: %v", err)
+		return nil, err
+	}
+	dialer := &websocket.Dialer{
+		Proxy:            clients.ProxyFunc(cfg),
+		TLSClientConfig:  tlsConfig,
+		HandshakeTimeout: cfg.ConnectTimeout,
+	}
+	cl, err := DialRPC(ctx, dialer, serverURL, cfg.CallTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("error: %w", err)
 	}
 
 	websocket_client := TrueNASWebSocket{
@@ -136,22 +255,22 @@ func NewClient(cfg *config.Config) (clients.Client, error) {
 	return websocket_client, nil
 }
 
-func (c TrueNASWebSocket) PostInstall() error {
+func (c TrueNASWebSocket) PostInstall(ctx context.Context) error {
 	var activated bool = false
 	if c.Cfg.Debug {
 		log.Println("running post install tasks")
 	}
-	err := getSystemInfo(&c)
+	err := getSystemInfo(ctx, &c)
 	if err != nil {
-		return fmt.Errorf("could not get system info: %v", err)
+		return fmt.Errorf("could not get system info: %w", err)
 	}
 
 	// update the UI to use the newly
 	// imported certificate
 	if c.Cfg.AddAsUiCertificate {
-		err := addAsUICertificate(c)
+		err := addAsUICertificate(ctx, c)
 		if err != nil {
-			return fmt.Errorf("failed to set %s as the UI certificate: %v", certName, err)
+			return fmt.Errorf("failed to set %s as the UI certificate: %w", certName, err)
 		}
 		activated = true
 	}
@@ -159,9 +278,9 @@ func (c TrueNASWebSocket) PostInstall() error {
 	// update the FTP service to use the newly
 	// imported certificate
 	if c.Cfg.AddAsFTPCertificate {
-		err := addAsFTPCertificate(c)
+		err := addAsFTPCertificate(ctx, c)
 		if err != nil {
-			return fmt.Errorf("failed to set %s as the FTP certificate: %v", certName, err)
+			return fmt.Errorf("failed to set %s as the FTP certificate: %w", certName, err)
 		}
 	}
 
@@ -173,8 +292,14 @@ func (c TrueNASWebSocket) PostInstall() error {
 			if strings.HasPrefix(c.Version, "TrueNAS-SCALE") {
 				appList := strings.Split(c.Cfg.AppList, ",")
 				for _, app := range appList {
-					err := addAsAppCertificate(&c, strings.TrimSpace(app))
+					if err := ctx.Err(); err != nil {
+						return fmt.Errorf("stopped before updating the '%s' app: %w", strings.TrimSpace(app), context.Cause(ctx))
+					}
+					err := addAsAppCertificate(ctx, &c, strings.TrimSpace(app))
 					if err != nil {
+						if ctx.Err() != nil {
+							return fmt.Errorf("failed to add the '%s' certificate to the '%s' app: %w", certName, app, err)
+						}
 						log.Printf("failed to add the '%s' certificate to the '%s' app: %v", certName, app, err)
 					}
 				}
@@ -186,33 +311,41 @@ func (c TrueNASWebSocket) PostInstall() error {
 
 	if activated {
 		if c.Cfg.DeleteOldCerts {
-			err := deleteCertificates(c)
+			err := deleteCertificates(ctx, c)
 			if err != nil {
+				if ctx.Err() != nil {
+					return fmt.Errorf("error deleting old certificates: %w", err)
+				}
 				log.Printf("error deleting old certificates: %v", err)
 			}
 		}
 
 		// restart the UI
-		err := restartUI(&c)
+		err := restartUI(ctx, &c)
 		if err != nil {
-			return fmt.Errorf("failed to restart the UI")
+			return fmt.Errorf("failed to restart the UI: %w", err)
 		}
 	}
 
 	return nil
 }
 
-func (c TrueNASWebSocket) PreInstall() error {
+func (c TrueNASWebSocket) PreInstall(ctx context.Context) error {
 	if c.Cfg.Debug {
 		log.Printf("running preinstall tasks")
 	}
 
-	err := getSystemInfo(&c)
+	err := getSystemInfo(ctx, &c)
+	if err != nil {
+		return fmt.Errorf("could not get system info: %w", err)
+	}
+
+	err = c.Cfg.LoadCertName(ctx)
 	if err != nil {
-		return fmt.Errorf("could not get system info: %v", err)
+		return fmt.Errorf("could not build the certificate name: %v", err)
 	}
 
-	err = clients.VerifyCertificateKeyPair(c.Cfg.FullChainPath, c.Cfg.PrivateKeyPath)
+	err = clients.VerifyCertificateKeyPair(ctx, c.Cfg)
 	if err != nil {
 		return fmt.Errorf("failed certificate verification: %v", err)
 	}
@@ -220,14 +353,17 @@ func (c TrueNASWebSocket) PreInstall() error {
 	return nil
 }
 
-func addAsAppCertificate(client *TrueNASWebSocket, appName string) error {
+func addAsAppCertificate(ctx context.Context, client *TrueNASWebSocket, appName string) error {
 	var args []interface{}
 	var response map[string]interface{}
 	args = []interface{}{appName}
 	log.Printf("processing certificate update for the '%s' application\n", appName)
 
-	resp, err := client.WSClient.Call("app.config", client.Cfg.TimeoutSeconds, args)
+	resp, err := call(ctx, client, "app.config", client.Cfg.CallTimeout, args)
 	if err != nil {
+		if ctx.Err() != nil {
+			return fmt.Errorf("error retrieving the app config for %s: %w", appName, err)
+		}
 		log.Printf("error retrieving the app config for %s: %v", appName, err)
 		return nil
 	}
@@ -266,32 +402,21 @@ func addAsAppCertificate(client *TrueNASWebSocket, appName string) error {
 				log.Printf("app update message for '%s': %s\n", appName, string(jsonData))
 			}
 			params := [2]interface{}{appName, updateMap}
-			job, err := client.WSClient.CallWithJob("app.update", params, func(progress float64, state string, desc string) {
+			job, err := callWithJob(ctx, client, "app.update", params, func(progress float64, state string, desc string) {
 				if client.Cfg.Debug {
 					log.Printf("job progress: %.2f%%, state: %s, description: %s", progress, state, desc)
 				}
 			})
 			if err != nil {
-				return fmt.Errorf("failed to update the app certificate, %v", err)
+				return fmt.Errorf("failed to update the app certificate, %w", err)
 			}
 			log.Printf("started the app update job with ID: %d", job.ID)
 
-			// Monitor the progress of the job.
-			for !job.Finished {
-				select {
-				case progress := <-job.ProgressCh:
-					if client.Cfg.Debug {
-						log.Printf("job progress: %.2f%%", progress)
-					}
-				case err := <-job.DoneCh:
-					if err != "" {
-						return fmt.Errorf("job failed: %v", err)
-					} else {
-						log.Println("job completed successfully!")
-						break
-					}
-				}
+			// Monitor the progress of the job, pulling the images may take a while.
+			if err := waitForJob(ctx, client, job, "app_update_timeout", client.Cfg.AppUpdateTimeout); err != nil {
+				return err
 			}
+			log.Println("job completed successfully!")
 		}
 	}
 
@@ -300,8 +425,11 @@ func addAsAppCertificate(client *TrueNASWebSocket, appName string) error {
 	return nil
 }
 
-func addAsFTPCertificate(client TrueNASWebSocket) error {
-	var certName = client.Cfg.CertName()
+func addAsFTPCertificate(ctx context.Context, client TrueNASWebSocket) error {
+	certName, err := client.Cfg.CertName(ctx)
+	if err != nil {
+		return err
+	}
 	ID, ok := certsList[certName]
 	if !ok {
 		return fmt.Errorf("certificate %s was not found in the certificates list", certName)
@@ -310,9 +438,9 @@ func addAsFTPCertificate(client TrueNASWebSocket) error {
 		"ssltls_certificate": ID,
 	}
 	args := []interface{}{pmap}
-	_, err := client.WSClient.Call("ftp.update", client.Cfg.TimeoutSeconds, args)
+	_, err = call(ctx, &client, "ftp.update", client.Cfg.CallTimeout, args)
 	if err != nil {
-		return fmt.Errorf("updating the FTP service certificate failed, %v", err)
+		return fmt.Errorf("updating the FTP service certificate failed, %w", err)
 	} else {
 		log.Printf("the FTP service certificate updated successfully to %s", certName)
 	}
@@ -320,8 +448,11 @@ func addAsFTPCertificate(client TrueNASWebSocket) error {
 	return nil
 }
 
-func addAsUICertificate(client TrueNASWebSocket) error {
-	var certName = client.Cfg.CertName()
+func addAsUICertificate(ctx context.Context, client TrueNASWebSocket) error {
+	certName, err := client.Cfg.CertName(ctx)
+	if err != nil {
+		return err
+	}
 	ID, ok := certsList[certName]
 	if !ok {
 		return fmt.Errorf("certificate %s was not found in the certificates list", certName)
@@ -330,23 +461,23 @@ func addAsUICertificate(client TrueNASWebSocket) error {
 		"ui_certificate": ID,
 	}
 	args := []interface{}{pmap}
-	_, err := client.WSClient.Call("system.general.update", client.Cfg.TimeoutSeconds, args)
+	_, err = call(ctx, &client, "system.general.update", client.Cfg.CallTimeout, args)
 	if err != nil {
-		return fmt.Errorf("system.general.update of ui_certificate failed, %v", err)
+		return fmt.Errorf("system.general.update of ui_certificate failed, %w", err)
 	}
 	return nil
 }
 
-func deleteCertificates(client TrueNASWebSocket) error {
-	var certName = client.Cfg.CertName()
+func deleteCertificates(ctx context.Context, client TrueNASWebSocket) error {
+	certName, err := client.Cfg.CertName(ctx)
+	if err != nil {
+		return err
+	}
 	_, ok := certsList[certName]
 	if !ok {
 		return fmt.Errorf("certificate %s was not found in the certificates list", certName)
 	}
 
-	// Prepare regex
-	pattern := fmt.Sprintf(`^%s-\d{4}-\d{2}-\d{2}-\d+$`, regexp.QuoteMeta(client.Cfg.CertBasename))
-	re := regexp.MustCompile(pattern)
 	var basenameMatch bool
 
 	for k, v := range certsList {
@@ -357,26 +488,24 @@ func deleteCertificates(client TrueNASWebSocket) error {
 			continue
 		}
 		// skip if the certificate name prefix does not match the CertBasename
-		if client.Cfg.StrictBasenameMatch {
-			basenameMatch = re.MatchString(k)
-			log.Printf("Regex match %s against %s: %v", client.Cfg.CertBasename, k, basenameMatch)
-		} else {
-			basenameMatch = strings.HasPrefix(k, client.Cfg.CertBasename)
-			log.Printf("Prefix match %s against %s: %v", client.Cfg.CertBasename, k, basenameMatch)
-		}
+		basenameMatch = client.Cfg.MatchCertName(k)
+		log.Printf("Name match %s against %s: %v", client.Cfg.CertNameRegexp(), k, basenameMatch)
 
 		if !basenameMatch {
 			continue
 		}
+		if err := ctx.Err(); err != nil {
+			return fmt.Errorf("stopped before deleting certificate %v: %w", k, context.Cause(ctx))
+		}
 
 		arg := []int64{v}
-		job, err := client.WSClient.CallWithJob("certificate.delete", arg, func(progress float64, state string, desc string) {
+		job, err := callWithJob(ctx, &client, "certificate.delete", arg, func(progress float64, state string, desc string) {
 			if client.Cfg.Debug {
 				log.Printf("job progress: %.2f%%, state: %s, description: %s", progress, state, desc)
 			}
 		})
 		if err != nil {
-			return fmt.Errorf("certificate deletion failed, %v", err)
+			return fmt.Errorf("certificate deletion failed, %w", err)
 		}
 		if client.Cfg.Debug {
 			log.Printf("deleting old certificate, job info: %v, ", job)
@@ -384,31 +513,25 @@ func deleteCertificates(client TrueNASWebSocket) error {
 		log.Printf("deleting old certificate %v, with job ID: %d", k, job.ID)
 
 		// Monitor the progress of the job.
-		for !job.Finished {
-			select {
-			case progress := <-job.ProgressCh:
-				if client.Cfg.Debug {
-					log.Printf("job progress: %.2f%%", progress)
-				}
-			case err := <-job.DoneCh:
-				if err != "" {
-					return fmt.Errorf("job failed: %v", err)
-				} else {
-					log.Printf("job completed successfully, certificate %v was deleted", k)
-					break
-				}
-			}
+		if err := waitForJob(ctx, &client, job, "job_timeout", client.Cfg.JobTimeout); err != nil {
+			return err
 		}
+		log.Printf("job completed successfully, certificate %v was deleted", k)
 	}
 	return nil
 }
 
-func getCertificateList(client *TrueNASWebSocket) error {
+func getCertificateList(ctx context.Context, client *TrueNASWebSocket) error {
 	var found = false
 	args := []interface{}{}
-	resp, err := client.WSClient.Call("app.certificate_choices", client.Cfg.TimeoutSeconds, args)
+	// app.certificate_choices is only served by the JSON-RPC 2.0 API
+	method := "app.certificate_choices"
+	if client.Cfg.ClientApi == "legacyws" {
+		method = "certificate.query"
+	}
+	resp, err := call(ctx, client, method, client.Cfg.CallTimeout, args)
 	if err != nil {
-		return fmt.Errorf("certificate list request failed: %v", err)
+		return fmt.Errorf("certificate list request failed: %w", err)
 	}
 	if client.Cfg.Debug {
 		log.Printf("received certificate list request response: %v", string(resp))
@@ -433,8 +556,8 @@ func getCertificateList(client *TrueNASWebSocket) error {
 			var name = cert["name"].(string)
 			idValue := cert["id"].(float64)
 			id := int64(idValue)
-			// only add certs that match the Cert_basename to the list
-			if strings.HasPrefix(name, client.Cfg.CertBasename) {
+			// only add certs named from the cert_name_template to the list
+			if name == certName || client.Cfg.MatchCertName(name) {
 				certsList[name] = id
 				if client.Cfg.Debug {
 					log.Printf("cert list, name: %v, id: %d", cert["name"], id)
@@ -454,11 +577,11 @@ func getCertificateList(client *TrueNASWebSocket) error {
 	return nil
 }
 
-func getSystemInfo(client *TrueNASWebSocket) error {
+func getSystemInfo(ctx context.Context, client *TrueNASWebSocket) error {
 
-	res, err := client.WSClient.Call("system.info", 10, []interface{}{})
+	res, err := call(ctx, client, "system.info", client.Cfg.CallTimeout, []interface{}{})
 	if err != nil {
-		log.Fatalf("failed to call system.info: %v", err)
+		return fmt.Errorf("failed to call system.info: %w", err)
 	}
 
 	var respData interface{}
@@ -469,24 +592,29 @@ func getSystemInfo(client *TrueNASWebSocket) error {
 	respMap, ok := respData.(map[string]interface{})
 	if ok {
 		resultMap := respMap["result"]
-		version := resultMap.(map[string]interface{})["version"]
-		client.Version = fmt.Sprintf("TrueNAS-SCALE-%s", version)
-		log.Printf("%s is running version '%s'", client.Cfg.ConnectHost, client.Version)
+		version := fmt.Sprint(resultMap.(map[string]interface{})["version"])
+		// the DDP API returns the whole version, such as TrueNAS-13.0-U6.1
+		if strings.HasPrefix(version, "TrueNAS-") {
+			client.Version = version
+		} else {
+			client.Version = fmt.Sprintf("TrueNAS-SCALE-%s", version)
+		}
+		log.Printf("%s is running version '%s'", client.Cfg.HostName(), client.Version)
 	} else {
-		log.Printf("unable to get the version of TrueNAS for '%s'", client.Cfg.ConnectHost)
+		log.Printf("unable to get the version of TrueNAS for '%s'", client.Cfg.HostName())
 	}
 	return nil
 }
 
-func importCertificate(client *TrueNASWebSocket) error {
-	log.Printf("importing the %s certificate", client.Cfg.CertName())
-	certPem, err := os.ReadFile(client.Cfg.FullChainPath)
+func importCertificate(ctx context.Context, client *TrueNASWebSocket) error {
+	name, err := client.Cfg.CertName(ctx)
 	if err != nil {
-		return fmt.Errorf("error reading the certificate file: %v", err)
+		return err
 	}
-	keyPem, err := os.ReadFile(client.Cfg.PrivateKeyPath)
+	log.Printf("importing the %s certificate", name)
+	keyPair, err := client.Cfg.LoadKeyPair(ctx)
 	if err != nil {
-		return fmt.Errorf("error reading the private key file: %v", err)
+		return err
 	}
 	if err = client.WSClient.SubscribeToJobs(); err != nil {
 		return fmt.Errorf("error subscribing to job notifications: %v", err)
@@ -494,20 +622,20 @@ func importCertificate(client *TrueNASWebSocket) error {
 
 	params := map[string]string{
 		"name":        certName,
-		"certificate": string(certPem),
-		"privatekey":  string(keyPem),
+		"certificate": string(keyPair.CertificatePEM),
+		"privatekey":  string(keyPair.PrivateKeyPEM),
 		"create_type": "CERTIFICATE_CREATE_IMPORTED",
 	}
 	args := []interface{}{params}
 
 	// call the api to create and deploy the certificate
-	job, err := client.WSClient.CallWithJob("certificate.create", args, func(progress float64, state string, desc string) {
+	job, err := callWithJob(ctx, client, "certificate.create", args, func(progress float64, state string, desc string) {
 		if client.Cfg.Debug {
 			log.Printf("job progress: %.2f%%, state: %s, description: %s", progress, state, desc)
 		}
 	})
 	if err != nil {
-		return fmt.Errorf("failed to create the certificate job,  %v", err)
+		return fmt.Errorf("failed to create the certificate job,  %w", err)
 	}
 
 	if job.ID > 0 {
@@ -515,6 +643,108 @@ func importCertificate(client *TrueNASWebSocket) error {
 	}
 
 	// Monitor the progress of the job.
+	if err := waitForJob(ctx, client, job, "job_timeout", client.Cfg.JobTimeout); err != nil {
+		return err
+	}
+	log.Println("job completed successfully!")
+
+	return nil
+}
+
+func restartUI(ctx context.Context, client *TrueNASWebSocket) error {
+	args := []interface{}{}
+	_, err := call(ctx, client, "system.general.ui_restart", client.Cfg.UIRestartTimeout, args)
+	if err != nil {
+		return fmt.Errorf("failed to restart the  UI: %w", err)
+	} else {
+		log.Printf("restarted the UI")
+	}
+	return nil
+}
+
+// runs a websocket API call, returning early with the context error if the
+// context is cancelled before the call completes.
+func call(ctx context.Context, client *TrueNASWebSocket, method string, timeout time.Duration, params interface{}) (json.RawMessage, error) {
+	type result struct {
+		resp json.RawMessage
+		err  error
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, context.Cause(ctx)
+	}
+	done := make(chan result, 1)
+	go func() {
+		resp, err := client.WSClient.Call(method, seconds(timeout), params)
+		done <- result{resp, err}
+	}()
+	select {
+	case r := <-done:
+		return r.resp, r.err
+	case <-ctx.Done():
+		return nil, fmt.Errorf("%s call interrupted: %w", method, context.Cause(ctx))
+	}
+}
+
+// runs a websocket API call and decodes its result into v.
+func callResult(ctx context.Context, client *TrueNASWebSocket, method string, v interface{}, params ...interface{}) error {
+	if params == nil {
+		params = []interface{}{}
+	}
+	resp, err := call(ctx, client, method, client.Cfg.CallTimeout, params)
+	if err != nil {
+		return fmt.Errorf("%s call failed: %w", method, err)
+	}
+	var response struct {
+		Result json.RawMessage `json:"result"`
+		Error  interface{}     `json:"error"`
+	}
+	if err = json.Unmarshal(resp, &response); err != nil {
+		return fmt.Errorf("error decoding the %s response: %v", method, err)
+	}
+	if response.Error != nil {
+		return fmt.Errorf("%s call failed: %v", method, response.Error)
+	}
+	if err = json.Unmarshal(response.Result, v); err != nil {
+		return fmt.Errorf("error decoding the %s result: %v", method, err)
+	}
+	return nil
+}
+
+// returns a timeout in whole seconds, rounded up, as used by the websocket
+// API client.
+func seconds(d time.Duration) int64 {
+	return int64((d + time.Second - 1) / time.Second)
+}
+
+// starts a websocket API job, returning early with the context error if the
+// context is cancelled before the job is started.
+func callWithJob(ctx context.Context, client *TrueNASWebSocket, method string, params interface{}, callback func(progress float64, state string, desc string)) (*truenas_api.Job, error) {
+	type result struct {
+		job *truenas_api.Job
+		err error
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, context.Cause(ctx)
+	}
+	done := make(chan result, 1)
+	go func() {
+		job, err := client.WSClient.CallWithJob(method, params, callback)
+		done <- result{job, err}
+	}()
+	select {
+	case r := <-done:
+		return r.job, r.err
+	case <-ctx.Done():
+		return nil, fmt.Errorf("%s job was not started: %w", method, context.Cause(ctx))
+	}
+}
+
+// monitors the progress of a job until it finishes, the timeout set by the
+// named key expires or the context is cancelled.
+func waitForJob(ctx context.Context, client *TrueNASWebSocket, job *truenas_api.Job, key string, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeoutCause(ctx, timeout, fmt.Errorf("the %s of %v expired", key, timeout))
+	defer cancel()
+
 	for !job.Finished {
 		select {
 		case progress := <-job.ProgressCh:
@@ -524,23 +754,13 @@ func importCertificate(client *TrueNASWebSocket) error {
 		case err := <-job.DoneCh:
 			if err != "" {
 				return fmt.Errorf("job failed: %v", err)
-			} else {
-				log.Println("job completed successfully!")
-				break
 			}
+			return nil
+		case <-ctx.Done():
+			// the job keeps running on the server, its completion is left
+			// unread in the buffered DoneCh and does not block the listener
+			return fmt.Errorf("stopped waiting for the %s job with ID %d: %w", job.Method, job.ID, context.Cause(ctx))
 		}
 	}
-
-	return nil
-}
-
-func restartUI(client *TrueNASWebSocket) error {
-	args := []interface{}{}
-	_, err := client.WSClient.Call("system.general.ui_restart", client.Cfg.TimeoutSeconds, args)
-	if err != nil {
-		return fmt.Errorf("failed to restart the  UI: %v", err)
-	} else {
-		log.Printf("restarted the UI")
-	}
 	return nil
 }
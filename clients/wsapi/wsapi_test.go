@@ -18,9 +18,21 @@
 package wsapi
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 	"tnascert-deploy/config"
+
+	"github.com/gorilla/websocket"
+	"github.com/truenas/api_client_golang/truenas_api"
 )
 
 func getConfig() (*config.Config, error) {
@@ -36,6 +48,16 @@ func getConfig() (*config.Config, error) {
 	return cfg, nil
 }
 
+// returns the name of the certificate deployed with the test configuration.
+func testCertName(t *testing.T, cfg *config.Config) string {
+	t.Helper()
+	name, err := cfg.CertName(context.Background())
+	if err != nil {
+		t.Fatalf("CertName() failed: %v", err)
+	}
+	return name
+}
+
 func TestAddAsAppCertificate(t *testing.T) {
 	cfg, err := getConfig()
 	if err != nil {
@@ -49,7 +71,7 @@ func TestAddAsAppCertificate(t *testing.T) {
 	}
 
 	client.Version = "TrueNAS-SCALE-25.0.0.0"
-	err = addAsAppCertificate(client, "grafana")
+	err = addAsAppCertificate(context.Background(), client, "grafana")
 	if err != nil {
 		t.Errorf("error adding app certificate: %v", err)
 	}
@@ -66,8 +88,8 @@ func TestAddAsFTPCertificate(t *testing.T) {
 
 		t.Fatalf("error creating the mock websocket client: %v", err)
 	}
-	certsList[cfg.CertName()] = 102
-	err = addAsFTPCertificate(*client)
+	certsList[testCertName(t, cfg)] = 102
+	err = addAsFTPCertificate(context.Background(), *client)
 	if err != nil {
 		t.Errorf("error adding app certificate: %v", err)
 	}
@@ -84,8 +106,8 @@ func TestAddAsUICertificate(t *testing.T) {
 
 		t.Fatalf("error creating the mock websocket client: %v", err)
 	}
-	certsList[cfg.CertName()] = 102
-	err = addAsUICertificate(*client)
+	certsList[testCertName(t, cfg)] = 102
+	err = addAsUICertificate(context.Background(), *client)
 	if err != nil {
 		t.Errorf("error adding app certificate: %v", err)
 	}
@@ -102,10 +124,10 @@ func TestDeleteCertificates(t *testing.T) {
 
 		t.Fatalf("error creating the mock websocket client: %v", err)
 	}
-	certsList[cfg.CertName()] = 102
+	certsList[testCertName(t, cfg)] = 102
 	certsList["tnas-cert-deploy-2024-01-01-08080808"] = 101
 	certsList["tnas-cert-deploy-2024-02-01-09090909"] = 100
-	err = deleteCertificates(*client)
+	err = deleteCertificates(context.Background(), *client)
 	if err != nil {
 		t.Errorf("error adding app certificate: %v", err)
 	}
@@ -122,7 +144,7 @@ func TestInstall(t *testing.T) {
 		t.Fatalf("error creating the mock websocket client: %v", err)
 	}
 
-	err = client.Install()
+	err = client.Install(context.Background())
 	if err != nil {
 		t.Errorf("Install() test failed: %v", err)
 	}
@@ -141,7 +163,7 @@ func TestLogin(t *testing.T) {
 
 	// test with a valid test ApiKey
 	client.Cfg.ApiKey = "test"
-	err = client.Login()
+	err = client.Login(context.Background())
 	if err != nil {
 		t.Fatalf("Login() test failed: %v", err)
 	}
@@ -150,7 +172,7 @@ func TestLogin(t *testing.T) {
 	client.Cfg.Username = "admin"
 	client.Cfg.Password = "admin"
 	// test with valid test username and password
-	err = client.Login()
+	err = client.Login(context.Background())
 	if err != nil {
 		t.Fatalf("Login() test failed: %v", err)
 	}
@@ -158,7 +180,7 @@ func TestLogin(t *testing.T) {
 	// test with empty credentials
 	client.Cfg.Username = ""
 	client.Cfg.Password = ""
-	err = client.Login()
+	err = client.Login(context.Background())
 	if err == nil {
 		t.Fatalf("expected Login() to fail due to no valid credentials")
 	}
@@ -175,8 +197,8 @@ func TestPostInstall(t *testing.T) {
 		t.Fatalf("error creating the mock websocket client: %v", err)
 	}
 
-	certsList[cfg.CertName()] = 101
-	err = client.PostInstall()
+	certsList[testCertName(t, cfg)] = 101
+	err = client.PostInstall(context.Background())
 	if err != nil {
 		t.Errorf("PostInstall() test failed: %v", err)
 	}
@@ -193,7 +215,7 @@ func TestPreInstall(t *testing.T) {
 		t.Fatalf("error creating the mock websocket client: %v", err)
 	}
 
-	err = client.PreInstall()
+	err = client.PreInstall(context.Background())
 	if err != nil {
 		t.Errorf("PreInstall() test failed: %v", err)
 	}
@@ -209,8 +231,408 @@ func TestRestartUI(t *testing.T) {
 		t.Fatalf("error creating the mock websocket client: %v", err)
 	}
 
-	err = restartUI(client)
+	err = restartUI(context.Background(), client)
 	if err != nil {
 		t.Errorf("error testing app restart: %v", err)
 	}
 }
+
+func TestWaitForJob(t *testing.T) {
+	cfg, err := getConfig()
+	if err != nil {
+		t.Fatalf("error loading config: %v", err)
+	}
+	client, err := NewMockWebSocketClient(cfg)
+	if err != nil {
+		t.Fatalf("error creating the mock websocket client: %v", err)
+	}
+
+	// a job that never finishes is abandoned once the context is cancelled
+	job := &truenas_api.Job{ID: 200, Method: "certificate.create", ProgressCh: make(chan float64), DoneCh: make(chan string)}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = waitForJob(ctx, client, job, "job_timeout", client.Cfg.JobTimeout)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("expected waitForJob() to return context.Canceled, got: %v", err)
+	}
+
+	// and once the timeout expires, the error names its key
+	job = &truenas_api.Job{ID: 201, Method: "app.update", ProgressCh: make(chan float64), DoneCh: make(chan string)}
+	err = waitForJob(context.Background(), client, job, "app_update_timeout", time.Second)
+	if err == nil || !strings.Contains(err.Error(), "app_update_timeout") {
+		t.Errorf("expected waitForJob() to fail with an app_update_timeout error, got: %v", err)
+	}
+}
+
+func TestInstallCancelled(t *testing.T) {
+	cfg, err := getConfig()
+	if err != nil {
+		t.Fatalf("error loading config: %v", err)
+	}
+	client, err := NewMockWebSocketClient(cfg)
+	if err != nil {
+		t.Fatalf("error creating the mock websocket client: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = client.Install(ctx)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("expected Install() to return context.Canceled, got: %v", err)
+	}
+}
+
+func TestBindings(t *testing.T) {
+	cfg, err := getConfig()
+	if err != nil {
+		t.Fatalf("error loading config: %v", err)
+	}
+	client, err := NewMockWebSocketClient(cfg)
+	if err != nil {
+		t.Fatalf("error creating the mock websocket client: %v", err)
+	}
+
+	bindings, err := client.Bindings(context.Background())
+	if err != nil {
+		t.Fatalf("Bindings() test failed: %v", err)
+	}
+	if bindings.Version != "TrueNAS-SCALE-25.04.2.5" || bindings.UICertificate != "tnas-cert-deploy-2024-12-31-0801683628" ||
+		bindings.FTPCertificate != "truenas_default" || len(bindings.Apps) != 1 || bindings.Apps[0] != "testapp" {
+		t.Errorf("unexpected bindings: %+v", *bindings)
+	}
+}
+
+// a websocket API stand-in answering the calls of the RPCClient.  A
+// certificate.create call starts job 7 that finishes at once, an app.update
+// call starts job 8 whose update is sent before the response, core.ping is
+// never answered.
+func rpcHandler() http.HandlerFunc {
+	upgrader := websocket.Upgrader{}
+	return func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			var req struct {
+				ID     int           `json:"id"`
+				Method string        `json:"method"`
+				Params []interface{} `json:"params"`
+			}
+			if err := conn.ReadJSON(&req); err != nil {
+				return
+			}
+			switch req.Method {
+			case "auth.login_with_api_key":
+				conn.WriteJSON(map[string]interface{}{"jsonrpc": "2.0", "id": req.ID, "result": req.Params[0] == "test"})
+			case "auth.me":
+				conn.WriteJSON(map[string]interface{}{"jsonrpc": "2.0", "id": req.ID, "result": map[string]interface{}{"pw_name": "root", "pw_uid": 0}})
+			case "core.subscribe":
+				conn.WriteJSON(map[string]interface{}{"jsonrpc": "2.0", "id": req.ID, "result": "sub-1"})
+			case "certificate.create":
+				conn.WriteJSON(map[string]interface{}{"jsonrpc": "2.0", "id": req.ID, "result": 7})
+				conn.WriteJSON(map[string]interface{}{"jsonrpc": "2.0", "method": "collection_update", "params": map[string]interface{}{
+					"msg": "changed", "collection": "core.get_jobs", "id": 7,
+					"fields": map[string]interface{}{"id": 7, "state": "SUCCESS", "progress": map[string]interface{}{"percent": 100}},
+				}})
+			case "app.update":
+				conn.WriteJSON(map[string]interface{}{"jsonrpc": "2.0", "method": "collection_update", "params": map[string]interface{}{
+					"msg": "changed", "collection": "core.get_jobs", "id": 8,
+					"fields": map[string]interface{}{"id": 8, "state": "FAILED", "error": "image pull failed"},
+				}})
+				conn.WriteJSON(map[string]interface{}{"jsonrpc": "2.0", "id": req.ID, "result": 8})
+			case "system.info":
+				conn.WriteJSON(map[string]interface{}{"jsonrpc": "2.0", "id": req.ID, "result": map[string]interface{}{"version": "25.04.2.5"}})
+			}
+		}
+	}
+}
+
+func TestRPCClient(t *testing.T) {
+	server := httptest.NewServer(rpcHandler())
+	defer server.Close()
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + EndPoint
+
+	client, err := DialRPC(context.Background(), &websocket.Dialer{}, url, time.Second)
+	if err != nil {
+		t.Fatalf("DialRPC() failed: %v", err)
+	}
+	defer client.Close()
+
+	if err = client.Login("", "", "wrong"); err == nil {
+		t.Errorf("Login() with a wrong api key should fail")
+	}
+	if err = client.Login("", "", "test"); err != nil {
+		t.Errorf("Login() failed: %v", err)
+	}
+	if err = client.SubscribeToJobs(); err != nil {
+		t.Errorf("SubscribeToJobs() failed: %v", err)
+	}
+	res, err := client.Call("system.info", 1, []interface{}{})
+	if err != nil || !strings.Contains(string(res), "25.04.2.5") {
+		t.Errorf("Call() returned %s, %v", res, err)
+	}
+
+	// the job is tracked even when it finishes before CallWithJob returns
+	job, err := client.CallWithJob("certificate.create", []interface{}{}, nil)
+	if err != nil {
+		t.Fatalf("CallWithJob() failed: %v", err)
+	}
+	select {
+	case jobErr := <-job.DoneCh:
+		if job.ID != 7 || jobErr != "" {
+			t.Errorf("job %d finished with '%s'", job.ID, jobErr)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("the job did not finish")
+	}
+
+	// and when its update is received before the response to the call
+	job, err = client.CallWithJob("app.update", []interface{}{}, nil)
+	if err != nil {
+		t.Fatalf("CallWithJob() failed: %v", err)
+	}
+	select {
+	case jobErr := <-job.DoneCh:
+		if job.ID != 8 || jobErr != "image pull failed" || job.State != "FAILED" {
+			t.Errorf("job %d finished in state %s with '%s'", job.ID, job.State, jobErr)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("the job updated before the response did not finish")
+	}
+	client.mu.Lock()
+	if len(client.jobs.early) != 0 || len(client.jobs.jobs) != 0 {
+		t.Errorf("the finished jobs should be forgotten: %+v", client.jobs)
+	}
+	client.mu.Unlock()
+
+	// a call that is not answered fails after its timeout
+	start := time.Now()
+	if _, err = client.Call("core.ping", 1, []interface{}{}); err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Errorf("Call() should time out, got: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Errorf("Call() timed out after %v", elapsed)
+	}
+}
+
+func TestConnectTimeout(t *testing.T) {
+	// a listener that never completes the websocket handshake
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen failed: %v", err)
+	}
+	defer listener.Close()
+
+	cfg, err := getConfig()
+	if err != nil {
+		t.Fatalf("error loading config: %v", err)
+	}
+	host, port, _ := net.SplitHostPort(listener.Addr().String())
+	cfg = cfg.WithConnectHost(host).WithClientApi("wsapi")
+	cfg.Protocol = "ws"
+	cfg.Port, _ = strconv.ParseUint(port, 10, 16)
+	cfg.ConnectTimeout = 500 * time.Millisecond
+
+	start := time.Now()
+	if _, err = NewClient(cfg); err == nil {
+		t.Fatalf("NewClient() should fail")
+	}
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Errorf("NewClient() failed after %v, the connect_timeout is %v", elapsed, cfg.ConnectTimeout)
+	}
+}
+
+func TestLocalClient(t *testing.T) {
+	// a middlewared socket stand-in
+	socket := filepath.Join(t.TempDir(), "middlewared.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatalf("listen failed: %v", err)
+	}
+	server := &http.Server{Handler: rpcHandler()}
+	go server.Serve(listener)
+	defer server.Close()
+
+	cfg, err := getConfig()
+	if err != nil {
+		t.Fatalf("error loading config: %v", err)
+	}
+	cfg = cfg.WithClientApi("local")
+	cfg.ApiKey = ""
+	cfg.LocalSocket = socket
+
+	client, err := NewLocalClient(cfg)
+	if err != nil {
+		t.Fatalf("NewLocalClient() failed: %v", err)
+	}
+	defer client.Close(context.Background())
+	if err = client.Login(context.Background()); err != nil {
+		t.Errorf("Login() with the peer credentials failed: %v", err)
+	}
+	c := client.(TrueNASWebSocket)
+	if err = getSystemInfo(context.Background(), &c); err != nil || c.Version != "TrueNAS-SCALE-25.04.2.5" {
+		t.Errorf("getSystemInfo() over the socket returned '%s', %v", c.Version, err)
+	}
+
+	cfg.LocalSocket = filepath.Join(t.TempDir(), "missing.sock")
+	if _, err = NewLocalClient(cfg); err == nil || !strings.Contains(err.Error(), "missing.sock") {
+		t.Errorf("NewLocalClient() of a missing socket should fail, got: %v", err)
+	}
+}
+
+// a DDP websocket API stand-in.  It pings the client once the session is
+// open and reports the pong on pongs.  A certificate.create call starts job
+// 9 that reports its progress before it finishes, app.update starts job 11
+// whose update is sent before the result and certificate.query lists the
+// certificate named name.
+func ddpHandler(name string, pongs chan<- struct{}) http.HandlerFunc {
+	upgrader := websocket.Upgrader{}
+	return func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		result := func(id string, result interface{}) {
+			conn.WriteJSON(map[string]interface{}{"msg": "result", "id": id, "result": result})
+		}
+		for {
+			var req struct {
+				Msg    string        `json:"msg"`
+				ID     string        `json:"id"`
+				Name   string        `json:"name"`
+				Method string        `json:"method"`
+				Params []interface{} `json:"params"`
+			}
+			if err := conn.ReadJSON(&req); err != nil {
+				return
+			}
+			switch req.Msg {
+			case "connect":
+				conn.WriteJSON(map[string]interface{}{"msg": "connected", "session": "s-1"})
+				conn.WriteJSON(map[string]interface{}{"msg": "ping", "id": "p-1"})
+			case "pong":
+				pongs <- struct{}{}
+			case "sub":
+				if req.Name == "core.get_jobs" {
+					conn.WriteJSON(map[string]interface{}{"msg": "ready", "subs": []string{req.ID}})
+				}
+			case "method":
+				switch req.Method {
+				case "auth.login_with_api_key":
+					result(req.ID, req.Params[0] == "test")
+				case "system.info":
+					result(req.ID, map[string]interface{}{"version": "TrueNAS-13.0-U6.1"})
+				case "certificate.query":
+					result(req.ID, []map[string]interface{}{{"id": 4, "name": "old"}, {"id": 5, "name": name}})
+				case "certificate.create":
+					result(req.ID, 9)
+					for _, state := range []string{"RUNNING", "SUCCESS"} {
+						conn.WriteJSON(map[string]interface{}{"msg": "changed", "collection": "core.get_jobs", "id": 9,
+							"fields": map[string]interface{}{"id": 9, "state": state, "progress": map[string]interface{}{"percent": 50}}})
+					}
+				case "app.update":
+					conn.WriteJSON(map[string]interface{}{"msg": "changed", "collection": "core.get_jobs", "id": 11,
+						"fields": map[string]interface{}{"id": 11, "state": "SUCCESS", "progress": map[string]interface{}{"percent": 100}}})
+					result(req.ID, 11)
+				case "certificate.delete":
+					result(req.ID, 10)
+					conn.WriteJSON(map[string]interface{}{"msg": "changed", "collection": "core.get_jobs", "id": 10,
+						"fields": map[string]interface{}{"id": 10, "state": "FAILED", "error": "[EFAULT] in use"}})
+				default:
+					conn.WriteJSON(map[string]interface{}{"msg": "result", "id": req.ID,
+						"error": map[string]interface{}{"error": 2, "reason": "Method does not exist"}})
+				}
+			}
+		}
+	}
+}
+
+func TestDDPClient(t *testing.T) {
+	pongs := make(chan struct{}, 1)
+	server := httptest.NewServer(ddpHandler("new", pongs))
+	defer server.Close()
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + LegacyEndPoint
+
+	client, err := DialDDP(context.Background(), &websocket.Dialer{}, url, time.Second)
+	if err != nil {
+		t.Fatalf("DialDDP() failed: %v", err)
+	}
+	defer client.Close()
+	select {
+	case <-pongs:
+	case <-time.After(time.Second):
+		t.Errorf("the ping of the server was not answered")
+	}
+
+	if err = client.Login("", "", "wrong"); err == nil {
+		t.Errorf("Login() with a wrong api key should fail")
+	}
+	if err = client.Login("", "", "test"); err != nil {
+		t.Errorf("Login() failed: %v", err)
+	}
+	res, err := client.Call("system.reboot", 1, []interface{}{})
+	if err != nil || !strings.Contains(string(res), "Method does not exist") {
+		t.Errorf("Call() should return the error, got %s, %v", res, err)
+	}
+	if err = client.SubscribeToJobs(); err != nil {
+		t.Fatalf("SubscribeToJobs() failed: %v", err)
+	}
+
+	// the jobs are tracked with the core.get_jobs updates
+	tests := []struct {
+		method string
+		id     int64
+		err    string
+	}{
+		{"certificate.create", 9, ""},
+		{"certificate.delete", 10, "[EFAULT] in use"},
+		{"app.update", 11, ""},
+	}
+	for _, test := range tests {
+		job, err := client.CallWithJob(test.method, []interface{}{}, nil)
+		if err != nil {
+			t.Fatalf("CallWithJob(%s) failed: %v", test.method, err)
+		}
+		select {
+		case jobErr := <-job.DoneCh:
+			if job.ID != test.id || jobErr != test.err {
+				t.Errorf("job %d of %s finished with '%s'", job.ID, test.method, jobErr)
+			}
+		case <-time.After(time.Second):
+			t.Errorf("the %s job did not finish", test.method)
+		}
+	}
+}
+
+func TestLegacyInstall(t *testing.T) {
+	cfg, err := getConfig()
+	if err != nil {
+		t.Fatalf("error loading config: %v", err)
+	}
+	server := httptest.NewServer(ddpHandler(testCertName(t, cfg), make(chan struct{}, 1)))
+	defer server.Close()
+	host, port, _ := net.SplitHostPort(strings.TrimPrefix(server.URL, "http://"))
+	cfg = cfg.WithConnectHost(host).WithClientApi("legacyws")
+	cfg.Protocol = "ws"
+	cfg.Port, _ = strconv.ParseUint(port, 10, 16)
+
+	client, err := NewLegacyClient(cfg)
+	if err != nil {
+		t.Fatalf("NewLegacyClient() failed: %v", err)
+	}
+	defer client.Close(context.Background())
+	ctx := context.Background()
+	if err = client.Login(ctx); err != nil {
+		t.Fatalf("Login() failed: %v", err)
+	}
+	if err = client.Install(ctx); err != nil {
+		t.Fatalf("Install() failed: %v", err)
+	}
+	c := client.(TrueNASWebSocket)
+	if err = getSystemInfo(ctx, &c); err != nil || c.Version != "TrueNAS-13.0-U6.1" {
+		t.Errorf("getSystemInfo() returned '%s', %v", c.Version, err)
+	}
+}
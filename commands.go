@@ -0,0 +1,140 @@
+/*
+ * Copyright (C) 2025 by John J. Rushford jrushford@apache.org
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"tnascert-deploy/config"
+)
+
+// usage of the config sub-commands
+const configUsage = `Usage: tnascert-deploy [-c value] config command [arguments]
+
+Commands:
+  convert source destination   convert a configuration file to another format,
+                               the formats are chosen by the file extensions
+                               .ini, .yaml, .yml, .toml or .json
+  show section                 print a section of the configuration file after
+                               inheritance is resolved, showing where each
+                               value came from, secrets are redacted
+  check [--strict]             check every section of the configuration file,
+                               report all the errors, unknown keys and risky
+                               settings, exits non-zero on errors, or on
+                               warnings too with --strict
+  encrypt-value [recipient ...]
+                               encrypt a value read from the standard input and
+                               print it as an 'enc:' value, the recipients are
+                               age public keys or recipient files, the identity
+                               file recipient is used when none is given
+  rekey [recipient ...]        decrypt the 'enc:' values of the configuration
+                               file and encrypt them again to the recipients
+`
+
+// runs a 'config' sub-command and returns the process exit status.
+func configCommand(args []string, configFile string) int {
+	if len(args) == 0 {
+		fmt.Fprint(os.Stderr, configUsage)
+		return 2
+	}
+	switch args[0] {
+	case "convert":
+		if len(args) != 3 {
+			fmt.Fprint(os.Stderr, configUsage)
+			return 2
+		}
+		if err := config.Convert(args[1], args[2]); err != nil {
+			fmt.Fprintf(os.Stderr, "error converting '%s' to '%s': %v\n", args[1], args[2], err)
+			return 1
+		}
+		fmt.Printf("converted '%s' to '%s'\n", args[1], args[2])
+		return 0
+	case "show":
+		if len(args) != 2 {
+			fmt.Fprint(os.Stderr, configUsage)
+			return 2
+		}
+		if err := config.Show(os.Stdout, configFile, args[1]); err != nil {
+			fmt.Fprintf(os.Stderr, "error showing section '%s' of '%s': %v\n", args[1], configFile, err)
+			return 1
+		}
+		return 0
+	case "check":
+		strict := len(args) == 2 && args[1] == "--strict"
+		if len(args) > 2 || (len(args) == 2 && !strict) {
+			fmt.Fprint(os.Stderr, configUsage)
+			return 2
+		}
+		problems, err := config.Check(configFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error checking '%s': %v\n", configFile, err)
+			return 1
+		}
+		errors, warnings := 0, 0
+		for _, p := range problems {
+			fmt.Println(p)
+			if p.Warning {
+				warnings++
+			} else {
+				errors++
+			}
+		}
+		fmt.Printf("%s: %d errors, %d warnings\n", configFile, errors, warnings)
+		if errors > 0 || (strict && warnings > 0) {
+			return 1
+		}
+		return 0
+	case "encrypt-value":
+		recipients, err := config.ParseRecipients(args[1:])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error reading the recipients: %v\n", err)
+			return 1
+		}
+		value, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error reading the value: %v\n", err)
+			return 1
+		}
+		enc, err := config.EncryptValue(strings.TrimRight(string(value), "\r\n"), recipients)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error encrypting the value: %v\n", err)
+			return 1
+		}
+		fmt.Println(enc)
+		return 0
+	case "rekey":
+		recipients, err := config.ParseRecipients(args[1:])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error reading the recipients: %v\n", err)
+			return 1
+		}
+		rekeyed, err := config.Rekey(configFile, recipients)
+		for _, r := range rekeyed {
+			fmt.Printf("encrypted %d values of '%s' again\n", r.Count, r.Path)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error rekeying '%s': %v\n", configFile, err)
+			return 1
+		}
+		return 0
+	}
+	fmt.Fprintf(os.Stderr, "unknown config command '%s'\n\n%s", args[0], configUsage)
+	return 2
+}
@@ -0,0 +1,298 @@
+/*
+ * Copyright (C) 2025 by John J. Rushford jrushford@apache.org
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package config
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/ncruces/go-strftime"
+)
+
+// the certificate name used when no cert_name_template is set.
+const Default_cert_name_template = "{basename}-{now:%Y-%m-%d-%s}"
+
+// the placeholders of a cert_name_template, the regular expression matches
+// the values of the placeholder in the names of other certificates.
+var placeholders = map[string]struct {
+	format   string // the default date format, empty if the placeholder takes none
+	pattern  string
+	distinct bool // true if the value differs between two certificates
+}{
+	"basename": {},
+	"cn":       {pattern: `[A-Za-z0-9_-]+`},
+	"san":      {pattern: `[A-Za-z0-9_-]+`},
+	"issuer":   {pattern: `[A-Za-z0-9_-]+`},
+	"serial":   {pattern: `[0-9a-f]+`, distinct: true},
+	"fp8":      {pattern: `[0-9a-f]{8}`, distinct: true},
+	"notafter": {format: "%Y-%m-%d", distinct: true},
+	"now":      {format: "%Y-%m-%d-%s", distinct: true},
+}
+
+// the regular expressions matching the strftime conversions.
+var strftimePatterns = map[byte]string{
+	'Y': `\d{4}`, 'C': `\d{2}`, 'y': `\d{2}`, 'm': `\d{2}`, 'd': `\d{2}`, 'e': `[-\d]\d`,
+	'H': `\d{2}`, 'I': `\d{2}`, 'M': `\d{2}`, 'S': `\d{2}`, 'j': `\d{3}`, 'U': `\d{2}`,
+	'W': `\d{2}`, 'V': `\d{2}`, 'G': `\d{4}`, 'g': `\d{2}`, 'u': `\d`, 'w': `\d`, 's': `\d+`,
+	'F': `\d{4}-\d{2}-\d{2}`, 'D': `\d{2}-\d{2}-\d{2}`, 'T': `\d{2}-\d{2}-\d{2}`,
+	'b': `[A-Za-z]+`, 'h': `[A-Za-z]+`, 'B': `[A-Za-z]+`, 'a': `[A-Za-z]+`, 'A': `[A-Za-z]+`, 'p': `[A-Za-z]+`,
+}
+
+// a literal text or a placeholder of a cert_name_template.
+type templatePart struct {
+	literal string
+	name    string // the placeholder name, empty for a literal text
+	format  string // the date format of notafter and now
+}
+
+// parses a cert_name_template.
+func parseTemplate(template string) ([]templatePart, error) {
+	var parts []templatePart
+	distinct := false
+	for rest := template; rest != ""; {
+		open := strings.IndexByte(rest, '{')
+		if open < 0 {
+			parts = append(parts, templatePart{literal: rest})
+			break
+		}
+		if open > 0 {
+			parts = append(parts, templatePart{literal: rest[:open]})
+		}
+		end := strings.IndexByte(rest[open:], '}')
+		if end < 0 {
+			return nil, fmt.Errorf("'{' is not closed in '%s'", template)
+		}
+		name, format, hasFormat := strings.Cut(rest[open+1:open+end], ":")
+		p, ok := placeholders[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown placeholder '{%s}' in '%s', use {basename}, {cn}, {san}, {serial}, {issuer}, {notafter:format}, {now:format} or {fp8}", name, template)
+		}
+		if hasFormat && p.format == "" {
+			return nil, fmt.Errorf("the placeholder '{%s}' does not take a format in '%s'", name, template)
+		}
+		if !hasFormat {
+			format = p.format
+		}
+		distinct = distinct || p.distinct
+		parts = append(parts, templatePart{name: name, format: format})
+		rest = rest[open+end+1:]
+	}
+	if !distinct {
+		return nil, fmt.Errorf("'%s' must use {serial}, {fp8}, {notafter} or {now} to tell the certificates apart", template)
+	}
+	return parts, nil
+}
+
+// returns the cert_name_template, or the default template.
+func (c *Config) certNameTemplate() string {
+	if c.CertNameTemplate == "" {
+		return Default_cert_name_template
+	}
+	return c.CertNameTemplate
+}
+
+// LoadCertName builds the name of the certificate deployed to TrueNAS from
+// the cert_name_template and the certificate of the full_chain_path or
+// pkcs12_path.  The error is returned when the certificate cannot be read.
+func (c *Config) LoadCertName(ctx context.Context) error {
+	if c.certName != "" {
+		return nil
+	}
+	name, err := c.buildCertName(ctx, c.certNameTemplate(), time.Now())
+	if err != nil {
+		return err
+	}
+	c.certName = name
+	return nil
+}
+
+// builds a certificate name from the template.
+func (c *Config) buildCertName(ctx context.Context, template string, now time.Time) (string, error) {
+	parts, err := parseTemplate(template)
+	if err != nil {
+		return "", err
+	}
+	var cert *x509.Certificate
+	var b strings.Builder
+	for _, p := range parts {
+		if p.name == "" {
+			b.WriteString(sanitize(p.literal))
+			continue
+		}
+		if p.name != "basename" && p.name != "now" && cert == nil {
+			if cert, err = c.readLeaf(ctx); err != nil {
+				return "", err
+			}
+		}
+		switch p.name {
+		case "basename":
+			b.WriteString(c.CertBasename)
+		case "now":
+			b.WriteString(sanitize(strftime.Format(p.format, now)))
+		case "cn":
+			cn := cert.Subject.CommonName
+			if cn == "" {
+				cn = firstSAN(cert)
+			}
+			b.WriteString(sanitize(cn))
+		case "san":
+			b.WriteString(sanitize(firstSAN(cert)))
+		case "issuer":
+			issuer := cert.Issuer.CommonName
+			if len(cert.Issuer.Organization) > 0 {
+				issuer = cert.Issuer.Organization[0]
+			}
+			b.WriteString(sanitize(issuer))
+		case "serial":
+			b.WriteString(cert.SerialNumber.Text(16))
+		case "fp8":
+			sum := sha256.Sum256(cert.Raw)
+			b.WriteString(hex.EncodeToString(sum[:4]))
+		case "notafter":
+			b.WriteString(sanitize(strftime.Format(p.format, cert.NotAfter.UTC())))
+		}
+	}
+	return b.String(), nil
+}
+
+// CertNameRegexp returns the regular expression matching the names built
+// from the cert_name_template for any certificate.
+func (c *Config) CertNameRegexp() *regexp.Regexp {
+	parts, err := parseTemplate(c.certNameTemplate())
+	if err != nil {
+		// the template is validated when the configuration is loaded
+		return regexp.MustCompile(`^$`)
+	}
+	var b strings.Builder
+	b.WriteString("^")
+	for _, p := range parts {
+		switch {
+		case p.name == "":
+			b.WriteString(regexp.QuoteMeta(sanitize(p.literal)))
+		case p.name == "basename":
+			b.WriteString(regexp.QuoteMeta(c.CertBasename))
+		case p.format != "":
+			b.WriteString(strftimeRegexp(p.format))
+		default:
+			b.WriteString(placeholders[p.name].pattern)
+		}
+	}
+	b.WriteString("$")
+	return regexp.MustCompile(b.String())
+}
+
+// CertNamePrefix returns the fixed text at the start of the names built
+// from the cert_name_template, it may be empty.
+func (c *Config) CertNamePrefix() string {
+	parts, err := parseTemplate(c.certNameTemplate())
+	if err != nil {
+		return ""
+	}
+	var b strings.Builder
+	for _, p := range parts {
+		switch p.name {
+		case "":
+			b.WriteString(sanitize(p.literal))
+		case "basename":
+			b.WriteString(c.CertBasename)
+		default:
+			return b.String()
+		}
+	}
+	return b.String()
+}
+
+// MatchCertName returns true if a certificate name was built from the
+// cert_name_template.  With strict_basename_match, or when the names do not
+// start with a fixed text, the whole name must match, otherwise its prefix.
+func (c *Config) MatchCertName(name string) bool {
+	prefix := c.CertNamePrefix()
+	if c.StrictBasenameMatch || prefix == "" {
+		return c.CertNameRegexp().MatchString(name)
+	}
+	return strings.HasPrefix(name, prefix)
+}
+
+// returns the regular expression matching the dates formatted with a
+// strftime format.
+func strftimeRegexp(format string) string {
+	var b strings.Builder
+	for i := 0; i < len(format); i++ {
+		if format[i] == '%' && i+1 < len(format) {
+			i++
+			if pattern, ok := strftimePatterns[format[i]]; ok {
+				b.WriteString(pattern)
+			} else if format[i] == '%' {
+				b.WriteString(regexp.QuoteMeta(sanitize("%")))
+			} else {
+				b.WriteString(`[A-Za-z0-9_-]+?`)
+			}
+			continue
+		}
+		b.WriteString(regexp.QuoteMeta(sanitize(format[i : i+1])))
+	}
+	return b.String()
+}
+
+// returns a value with only the characters allowed in TrueNAS certificate
+// names, letters, digits, '-' and '_'.  A wildcard is written 'wildcard',
+// dots, spaces, colons and slashes become '-' and other characters are
+// dropped.
+func sanitize(value string) string {
+	var b strings.Builder
+	for _, r := range value {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '_':
+			b.WriteRune(r)
+		case r == '*':
+			b.WriteString("wildcard")
+		case r == '.', r == ' ', r == ':', r == '/':
+			b.WriteRune('-')
+		}
+	}
+	return b.String()
+}
+
+// returns the first subject alternative name of a certificate.
+func firstSAN(cert *x509.Certificate) string {
+	if len(cert.DNSNames) > 0 {
+		return cert.DNSNames[0]
+	}
+	if len(cert.IPAddresses) > 0 {
+		return cert.IPAddresses[0].String()
+	}
+	if len(cert.EmailAddresses) > 0 {
+		return cert.EmailAddresses[0]
+	}
+	return ""
+}
+
+// returns the leaf certificate of the key pair.
+func (c *Config) readLeaf(ctx context.Context) (*x509.Certificate, error) {
+	chain, err := c.LoadChain(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error reading the certificate for the cert_name_template: %v", err)
+	}
+	return chain[0], nil
+}
@@ -0,0 +1,189 @@
+/*
+ * Copyright (C) 2025 by John J. Rushford jrushford@apache.org
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package config
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/x509"
+	"embed"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+)
+
+// the intermediate certificates built into the tool, completing the chains
+// after those of the intermediates_dir, see intermediates/README.md.
+//
+//go:embed intermediates
+var bundledIntermediates embed.FS
+
+// returns the chain of the leaf in certs verified with x509.Verify, ordered
+// from the leaf to the last intermediate.  The leaf is the certificate of the
+// public key of the private key, whatever its place in certs.  The root and
+// the duplicates are left out, as are the certificates that are not part of
+// the chain, and the missing intermediates are taken from the
+// intermediates_dir or the bundled ones.  The chain is verified against the
+// system CAs, or the ca_file.
+func (c *Config) rebuildChain(certs []*x509.Certificate, key crypto.PublicKey) ([]*x509.Certificate, error) {
+	var leaf *x509.Certificate
+	for _, cert := range certs {
+		if pub, ok := cert.PublicKey.(interface{ Equal(crypto.PublicKey) bool }); ok && pub.Equal(key) {
+			leaf = cert
+			break
+		}
+	}
+	if leaf == nil {
+		return nil, errors.New("the private key matches none of the certificates of the chain")
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs {
+		if cert != leaf {
+			intermediates.AddCert(cert)
+		}
+	}
+	if c.IntermediatesDir != "" {
+		if err := addIntermediates(intermediates, os.DirFS(c.IntermediatesDir), "."); err != nil {
+			return nil, fmt.Errorf("error reading the intermediates_dir: %v", err)
+		}
+	}
+	if err := addIntermediates(intermediates, bundledIntermediates, "intermediates"); err != nil {
+		return nil, fmt.Errorf("error reading the bundled intermediates: %v", err)
+	}
+
+	roots, err := c.chainRoots()
+	if err != nil {
+		return nil, err
+	}
+	chains, err := leaf.Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("the certificate chain of '%s' could not be rebuilt, add its intermediates to the intermediates_dir: %v", leaf.Subject.CommonName, err)
+	}
+	chain := chains[0]
+	for _, ch := range chains {
+		if len(ch) < len(chain) {
+			chain = ch
+		}
+	}
+	// the clients know the root
+	if len(chain) > 1 {
+		chain = chain[:len(chain)-1]
+	}
+	return chain, nil
+}
+
+// rebuilds the chain of the key pair, see rebuildChain.
+func (c *Config) rebuildKeyPair(keyPair *KeyPair) error {
+	certs, err := keyPair.Chain()
+	if err != nil {
+		return err
+	}
+	key, err := keyPair.publicKey()
+	if err != nil {
+		return err
+	}
+	chain, err := c.rebuildChain(certs, key)
+	if err != nil {
+		return err
+	}
+	keyPair.CertificatePEM = encodeCertificates(chain)
+	return nil
+}
+
+// returns the CAs verifying the rebuilt chain, those of the ca_file or the
+// system CAs.
+func (c *Config) chainRoots() (*x509.CertPool, error) {
+	if c.CAFile == "" {
+		roots, err := x509.SystemCertPool()
+		if err != nil {
+			return nil, fmt.Errorf("error loading the system CAs: %v", err)
+		}
+		return roots, nil
+	}
+	data, err := os.ReadFile(c.CAFile)
+	if err != nil {
+		return nil, fmt.Errorf("error reading the ca_file: %v", err)
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificate was found in the ca_file '%s'", c.CAFile)
+	}
+	return roots, nil
+}
+
+// adds the PEM or DER certificates of the files in the dir of fsys to pool,
+// the files holding no certificate are skipped.
+func addIntermediates(pool *x509.CertPool, fsys fs.FS, dir string) error {
+	entries, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+		data, err := fs.ReadFile(fsys, path.Join(dir, e.Name()))
+		if err != nil {
+			return err
+		}
+		for _, cert := range parseCertificates(data) {
+			pool.AddCert(cert)
+		}
+	}
+	return nil
+}
+
+// returns the certificates of PEM or DER data, those that cannot be parsed
+// are left out.
+func parseCertificates(data []byte) []*x509.Certificate {
+	var certs []*x509.Certificate
+	rest := data
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		if cert, err := x509.ParseCertificate(block.Bytes); err == nil {
+			certs = append(certs, cert)
+		}
+	}
+	if len(certs) == 0 && !bytes.Contains(data, []byte("-----BEGIN")) {
+		certs, _ = x509.ParseCertificates(data)
+	}
+	return certs
+}
+
+// returns the PEM of the certificates.
+func encodeCertificates(certs []*x509.Certificate) []byte {
+	var certPem bytes.Buffer
+	for _, cert := range certs {
+		pem.Encode(&certPem, &pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+	}
+	return certPem.Bytes()
+}
@@ -0,0 +1,270 @@
+/*
+ * Copyright (C) 2025 by John J. Rushford jrushford@apache.org
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package config
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// Problem is an error or a warning found in a configuration file.
+type Problem struct {
+	File    string // the file holding the value
+	Line    int    // the line number in the file, 0 if unknown
+	Section string // the section being checked
+	Key     string // the key, empty if the problem is about the section
+	Message string
+	Warning bool // true if the setting is valid but risky
+}
+
+func (p Problem) String() string {
+	location := p.File
+	if p.Line > 0 {
+		location = fmt.Sprintf("%s:%d", p.File, p.Line)
+	}
+	severity := "error"
+	if p.Warning {
+		severity = "warning"
+	}
+	key := ""
+	if p.Key != "" {
+		key = " " + p.Key
+	}
+	return fmt.Sprintf("%s: %s: [%s]%s: %s", location, severity, p.Section, key, p.Message)
+}
+
+// returns the names of the configuration keys.
+func knownKeys() []string {
+	keys := []string{inheritKey, templateKey, includeKey}
+	for _, f := range schema {
+		keys = append(keys, f.name)
+		if f.alias != "" {
+			keys = append(keys, f.alias)
+		}
+	}
+	return keys
+}
+
+// Check validates every section of a configuration file and returns all
+// the problems found.  Unknown keys are reported with the closest known key
+// and risky settings are reported as warnings.  An error is returned when
+// the file cannot be read or parsed.
+func Check(config_file string) ([]Problem, error) {
+	sections, err := readConfig(config_file)
+	if err != nil {
+		return nil, err
+	}
+	var problems []Problem
+
+	// unknown keys are reported in every section, templates included
+	known := knownKeys()
+	for _, s := range sections {
+		for _, e := range s.entries {
+			if slices.Contains(known, e.name) {
+				continue
+			}
+			msg := "unknown key"
+			if hint := canonical(suggest(e.name, known)); hint != "" {
+				msg = fmt.Sprintf("unknown key, did you mean '%s'?", hint)
+			}
+			problems = append(problems, Problem{File: e.file, Line: e.line, Section: s.name, Key: e.name, Message: msg})
+		}
+	}
+
+	r, err := newResolver(sections)
+	if err != nil {
+		_, s := lookupSection(sections, defaultSection)
+		return append(problems, Problem{File: config_file, Line: s.entryLine(inheritKey), Section: s.name, Key: inheritKey, Message: err.Error()}), nil
+	}
+	ids := &identities{}
+	for _, s := range sections {
+		entries, err := r.resolve(s.name)
+		if err != nil {
+			problems = append(problems, Problem{File: s.file, Line: s.entryLine(inheritKey), Section: s.name, Key: inheritKey, Message: err.Error()})
+			continue
+		}
+		template, err := r.template(s.name)
+		if err != nil {
+			problems = append(problems, Problem{File: s.file, Line: s.entryLine(templateKey), Section: s.name, Key: templateKey, Message: err.Error()})
+			continue
+		}
+		if s.name == defaultSection || template {
+			continue
+		}
+		problems = append(problems, checkSection(s, entries, ids)...)
+	}
+
+	// secrets written as is, in a file that others may read
+	for _, s := range sections {
+		for _, e := range s.entries {
+			if secretKeys[e.name] && !e.fromEnv && IsPlainText(e.value) {
+				problems = append(problems, Problem{File: e.file, Line: e.line, Section: s.name, Key: e.name, Warning: true,
+					Message: "the secret is written in plain text, use an environment variable, a secret reference or an 'enc:' value" + readableBy(e.file)})
+			}
+		}
+	}
+	sort.SliceStable(problems, func(i, j int) bool {
+		if problems[i].File != problems[j].File {
+			return problems[i].File < problems[j].File
+		}
+		return problems[i].Line < problems[j].Line
+	})
+	return problems, nil
+}
+
+// checks the resolved values of a deployable section.
+func checkSection(s *section, entries []resolvedEntry, ids *identities) []Problem {
+	var problems []Problem
+	problem := func(key string, warning bool, msg string) {
+		p := Problem{File: s.file, Line: s.line, Section: s.name, Key: key, Message: msg, Warning: warning}
+		for _, e := range entries {
+			if e.name == key {
+				p.File, p.Line = e.file, e.line
+				if e.section != s.name {
+					p.Message += fmt.Sprintf(" (inherited from [%s])", e.section)
+				}
+				break
+			}
+		}
+		problems = append(problems, p)
+	}
+
+	var flat []entry
+	for _, e := range entries {
+		flat = append(flat, e.entry)
+	}
+	var c Config
+	if err := c.load(flat); err != nil {
+		for _, err := range unjoin(err) {
+			var ke *keyError
+			if errors.As(err, &ke) {
+				problem(ke.key, false, ke.Error())
+			} else {
+				problem("", false, err.Error())
+			}
+		}
+	}
+	if identityFile() != "" {
+		if err := c.decrypt(ids); err != nil {
+			problem("", false, err.Error())
+		}
+	}
+
+	// risky settings
+	if c.TlsSkipVerify {
+		problem("tls_skip_verify", true, "the certificate of the TrueNAS host is not verified")
+	}
+	if c.Protocol == "ws" || c.Protocol == "http" {
+		problem("protocol", true, fmt.Sprintf("the credentials and the private key are sent unencrypted with '%s'", c.Protocol))
+	}
+	if prefix := c.CertNamePrefix(); c.DeleteOldCerts && !c.StrictBasenameMatch && prefix != "" {
+		problem("delete_old_certs", true, fmt.Sprintf("every certificate whose name starts with '%s' is deleted, set strict_basename_match = true to only delete the certificates deployed by this tool", prefix))
+	}
+	return problems
+}
+
+// returns the current name of a key given by its alias.
+func canonical(name string) string {
+	for _, f := range schema {
+		if f.alias != "" && f.alias == name {
+			return f.name
+		}
+	}
+	return name
+}
+
+// returns the line number of a key defined in the section, or of the
+// section header.
+func (s *section) entryLine(name string) int {
+	for _, e := range s.entries {
+		if e.name == name {
+			return e.line
+		}
+	}
+	return s.line
+}
+
+// returns a note when other users may read the file.
+func readableBy(file string) string {
+	info, err := os.Stat(file)
+	if err != nil || runtime.GOOS == "windows" || info.Mode().Perm()&0o077 == 0 {
+		return ""
+	}
+	return fmt.Sprintf(", the file mode %v allows other users to read it", info.Mode().Perm())
+}
+
+// IsPlainText returns true if a secret value is written as is, not as a
+// $VARIABLE, a secret reference or an 'enc:' value.
+func IsPlainText(value string) bool {
+	value = strings.TrimSpace(value)
+	return value != "" && !strings.Contains(value, "$") && !isSecretRef(value) && !isEncrypted(value)
+}
+
+// returns the errors joined in err.
+func unjoin(err error) []error {
+	if joined, ok := err.(interface{ Unwrap() []error }); ok {
+		return joined.Unwrap()
+	}
+	return []error{err}
+}
+
+// returns the known key closest to name, or an empty string when none is
+// close enough.  Case and underscores are ignored.
+func suggest(name string, known []string) string {
+	normalize := func(s string) string {
+		return strings.ToLower(strings.ReplaceAll(s, "_", ""))
+	}
+	n := normalize(name)
+	best, bestDistance := "", len(n)/3+1
+	for _, k := range known {
+		nk := normalize(k)
+		if strings.HasPrefix(nk, n) && len(n) >= 4 {
+			return k
+		}
+		if d := distance(n, nk); d < bestDistance {
+			best, bestDistance = k, d
+		}
+	}
+	return best
+}
+
+// returns the Levenshtein distance between a and b.
+func distance(a string, b string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
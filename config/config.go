@@ -18,91 +18,237 @@
 package config
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"net/url"
 	"os"
+	"reflect"
+	"slices"
 	"strconv"
+	"strings"
 	"time"
-
-	"github.com/ncruces/go-strftime"
-	"gopkg.in/ini.v1"
 )
 
 const (
-	Config_file             = "tnas-cert.ini"
-	Default_base_cert_name  = "tnas-cert-deploy"
-	Default_section         = "deploy_default"
-	Default_port            = 443
-	Default_protocol        = "wss"
-	Default_timeout_seconds = 10
+	Config_file            = "tnas-cert.ini"
+	Default_base_cert_name = "tnas-cert-deploy"
+	Default_section        = "deploy_default"
+	Default_port           = 443
 )
 
+// The configuration keys are declared with the struct tags of the fields:
+//
+//	ini       the key name
+//	alias     a former name of the key that is still accepted
+//	default   the value used when the key is missing or empty
+//	required  "true" if the key must have a value
+//	oneof     the comma separated list of the valid values
+//	max       the largest valid number
+//
+// Values are expanded from the environment with ${VARIABLE_NAME}.  Fields
+// may be a string, bool, int64, uint64 or time.Duration, durations are
+// written like 30s or 5m and a bare number is a number of seconds.
 type Config struct {
-	ApiKey                 string `ini:"api_key"`                // TrueNAS 64 byte API Key
-	CertBasename           string `ini:"cert_basename"`          // basename for cert naming in TrueNAS
-	ClientApi              string `ini:"client_api"`             // Client type, 'wsapi' (default) or restapi
-	ConnectHost            string `ini:"connect_host"`           // TrueNAS hostname
-	DeleteOldCertsStr      string `ini:"delete_old_certs"`       // whether to remove old certificates, String value
-	StrictBasenameMatchStr string `ini:"strict_basename_match"`  // whether to use a strict basename match when deleting certs, String value
-	FullChainPath          string `ini:"full_chain_path"`        // path to full_chain.pem
-	PortStr                string `ini:"port"`                   // TrueNAS API endpoint port, String value
-	Protocol               string `ini:"protocol"`               // websocket protocol 'ws' or 'wss' 'wss' is default
-	PrivateKeyPath         string `ini:"private_key_path"`       // path to private_key.pem
-	TlsSkipVerifyStr       string `ini:"tls_skip_verify"`        // strict SSL cert verification of the endpoint, String value
-	AddAsUiCertificateStr  string `ini:"add_as_ui_certificate"`  // Install as the active UI certificate if true, String value
-	AddAsFTPCertificateStr string `ini:"add_as_ftp_certificate"` // Install as the active FTP service certificate if true, String value
-	AddAsAppCertificateStr string `ini:"add_as_app_certificate"` // Install as the active APP service certificate if true, String value
-	AppList                string `ini:"app_list"`               // comma separated list of Apps to deploy the certificate too.
-	TimeoutSecondsStr      string `ini:"timeoutSeconds"`         // the number of seconds after which the truenas client calls fail, String value
-	DebugStr               string `ini:"debug"`                  // debug logging if true, String value
-	Username               string `ini:"username"`               // an admin user name
-	Password               string `ini:"password"`               // admin users password
-	DeleteOldCerts         bool   // whether to remove old certificates
-	StrictBasenameMatch    bool   // whether to match the certificate basename strictly
-	Port                   uint64 // TrueNAS API endpoint port
-	TlsSkipVerify          bool   // strict SSL cert verification of the endpoint
-	AddAsUiCertificate     bool   // Install as the active UI certificate if true.
-	AddAsFTPCertificate    bool   // Install as the active FTP certificate if true.
-	AddAsAppCertificate    bool   // Install as the active APP certificate if true.
-	TimeoutSeconds         int64  // the number of seconds after which the truenas client calls fail
-	Debug                  bool   // debug logging if true.
-	certName               string // instance generated certificate name.
-	serverURL              string // instance generated server URL
+	ApiKey           string `ini:"api_key"`                                                                 // TrueNAS 64 byte API Key
+	CertBasename     string `ini:"cert_basename" default:"tnas-cert-deploy"`                                // basename for cert naming in TrueNAS
+	CertNameTemplate string `ini:"cert_name_template"`                                                      // template of the certificate name, e.g. le-{cn}-{notafter:%Y%m%d}-{fp8}
+	ClientApi        string `ini:"client_api" default:"auto" oneof:"auto,restapi,wsapi,legacyws,local,ssh"` // Client type, 'auto' (default), 'wsapi', 'legacyws', 'restapi', 'local' or 'ssh'
+	LocalSocket      string `ini:"local_socket" default:"/var/run/middleware/middlewared.sock"`             // middlewared Unix socket used with client_api = local
+
+	SSHUser       string `ini:"ssh_user" default:"root"`           // user running midclt on the connect_host with client_api = ssh
+	SSHPort       uint64 `ini:"ssh_port" default:"22" max:"65535"` // SSH port of the connect_host
+	SSHKeyPath    string `ini:"ssh_key_path"`                      // private key authenticating the ssh_user
+	SSHKnownHosts string `ini:"ssh_known_hosts"`                   // known_hosts file verifying the host key, defaults to ~/.ssh/known_hosts
+
+	PreflightPolicy      string        `ini:"preflight_policy" default:"warn" oneof:"strict,warn"` // whether the preflight warnings about the certificate abort the deployment
+	PreflightMinValidity time.Duration `ini:"preflight_min_validity" default:"168h"`               // the remaining validity of the certificate below which the preflight warns
+
+	ConnectHost         string        `ini:"connect_host"`                                     // TrueNAS hostname, or a comma separated list tried in order
+	DeleteOldCerts      bool          `ini:"delete_old_certs" default:"false"`                 // whether to remove old certificates
+	StrictBasenameMatch bool          `ini:"strict_basename_match" default:"false"`            // whether to match the certificate basename strictly
+	FullChainPath       string        `ini:"full_chain_path"`                                  // path to full_chain.pem
+	Port                uint64        `ini:"port" default:"443" max:"65535"`                   // TrueNAS API endpoint port
+	Proxy               string        `ini:"proxy"`                                            // socks5:// or http:// proxy URL, defaults to the proxy environment variables
+	ProxyPassword       string        `ini:"proxy_password"`                                   // password of the user named in the proxy URL
+	Protocol            string        `ini:"protocol" default:"wss" oneof:"ws,wss,http,https"` // websocket protocol 'ws' or 'wss' 'wss' is default
+	PrivateKeyPath      string        `ini:"private_key_path"`                                 // path to private_key.pem
+	PrivateKeyPassword  string        `ini:"private_key_password"`                             // password of an encrypted private key
+	BundlePath          string        `ini:"bundle_path"`                                      // PEM file of the private key and the chain used instead of the full_chain_path and private_key_path
+	PKCS12Path          string        `ini:"pkcs12_path"`                                      // PKCS#12 (.pfx) bundle used instead of the full_chain_path and private_key_path
+	PKCS12Password      string        `ini:"pkcs12_password"`                                  // password of the pkcs12_path
+	RebuildChain        bool          `ini:"rebuild_chain" default:"false"`                    // whether to order, complete and verify the certificate chain before it is imported
+	IntermediatesDir    string        `ini:"intermediates_dir"`                                // directory of the intermediate certificates completing the chain with rebuild_chain
+	TlsSkipVerify       bool          `ini:"tls_skip_verify" default:"false"`                  // strict SSL cert verification of the endpoint
+	CAFile              string        `ini:"ca_file"`                                          // PEM file of the CAs verifying the TrueNAS certificate instead of the system CAs
+	PinSHA256           string        `ini:"pin_sha256"`                                       // comma separated base64 SHA-256 hashes of the TrueNAS certificate public key
+	TrustStore          string        `ini:"trust_store"`                                      // file recording the public key pin of each host on first use
+	ClientCertPath      string        `ini:"client_cert_path"`                                 // PEM client certificate presented to a reverse proxy requiring one
+	ClientKeyPath       string        `ini:"client_key_path"`                                  // PEM private key of the client_cert_path
+	AddAsUiCertificate  bool          `ini:"add_as_ui_certificate" default:"false"`            // Install as the active UI certificate if true.
+	AddAsFTPCertificate bool          `ini:"add_as_ftp_certificate" default:"false"`           // Install as the active FTP certificate if true.
+	AddAsAppCertificate bool          `ini:"add_as_app_certificate" default:"false"`           // Install as the active APP certificate if true.
+	VerifyHost          string        `ini:"verify_host"`                                      // host, such as an HA virtual IP, serving the UI certificate after the deployment
+	AppList             string        `ini:"app_list"`                                         // comma separated list of Apps to deploy the certificate too.
+	Timeout             time.Duration `ini:"timeout" alias:"timeoutSeconds" default:"10s"`     // the default of connect_timeout and call_timeout
+	ConnectTimeout      time.Duration `ini:"connect_timeout"`                                  // the duration to connect and log in, defaults to timeout
+	CallTimeout         time.Duration `ini:"call_timeout"`                                     // the duration after which a TrueNAS API call fails, defaults to timeout
+	JobTimeout          time.Duration `ini:"job_timeout" default:"5m"`                         // the duration to wait for a TrueNAS job to finish
+	AppUpdateTimeout    time.Duration `ini:"app_update_timeout" default:"15m"`                 // the duration to wait for an app update, which may pull images
+	UIRestartTimeout    time.Duration `ini:"ui_restart_timeout" default:"1m"`                  // the duration to wait for the UI to restart with the new certificate
+	Debug               bool          `ini:"debug" default:"false"`                            // debug logging if true.
+	Username            string        `ini:"username"`                                         // an admin user name
+	Password            string        `ini:"password"`                                         // admin users password
+	certName            string        // instance generated certificate name.
+	serverURL           string        // instance generated server URL
+	file                string        // the file defining the section
+	keyPair             *KeyPair      // the key pair decrypted by LoadKeyPair
+	keyPairSource       string        // the files keyPair was read from
 }
 
+// LoadConfig loads all the sections of an INI, YAML, TOML or JSON
+// configuration file, the format is chosen by the file extension.  The
+// files named by 'include' are loaded too, or every configuration file when
+// config_file is a directory.  Sections
+// inherit the values of the DEFAULT section or of the section named by
+// their 'inherit' key.  Sections marked with 'template = true' are only
+// inherited from and are not loaded as configurations of their own.  Encrypted 'enc:' values are
+// decrypted with the age identity file.
 func LoadConfig(config_file string) (map[string]*Config, error) {
 	var cfg_list = make(map[string]*Config)
 
 	// load the config file
-	f, err := ini.Load(config_file)
+	sections, err := readConfig(config_file)
+	if err != nil {
+		return nil, err
+	}
+	r, err := newResolver(sections)
 	if err != nil {
 		return nil, err
 	}
+	ids := &identities{}
 
-	for _, section := range f.Sections() {
-		name := section.Name()
-		if name == "DEFAULT" {
+	for _, s := range sections {
+		name := s.name
+		flat, err := r.flatten(name)
+		if err != nil {
+			return nil, err
+		}
+		template, err := r.template(name)
+		if err != nil {
+			return nil, fmt.Errorf("error in section '%s' of '%s': %v", name, s.file, err)
+		}
+		if name == defaultSection || template {
 			continue
 		}
 		var c = Config{}
-		err = f.Section(name).MapTo(&c)
+		err = c.load(flat.entries)
 		if err != nil {
-			return nil, err
+			return nil, fmt.Errorf("error in section '%s' of '%s': %v", name, s.file, err)
 		}
-		err = c.checkConfig()
+		err = c.decrypt(ids)
 		if err != nil {
-			return nil, fmt.Errorf("error in section '%s': %v", name, err)
+			return nil, fmt.Errorf("error in section '%s' of '%s': %v", name, s.file, err)
 		}
+		c.file = s.file
 		cfg_list[name] = &c
 	}
 
 	return cfg_list, nil
 }
 
-func (c *Config) CertName() string {
-	if c.certName == "" {
-		c.certName = c.CertBasename + strftime.Format("-%Y-%m-%d-%s", time.Now())
+// NotLoaded returns the reason why the section name of a configuration file
+// has no configuration in those returned by LoadConfig.
+func NotLoaded(config_file string, name string) error {
+	if name == defaultSection {
+		return fmt.Errorf("configuration %s is only inherited from and is not deployed", name)
+	}
+	sections, err := readConfig(config_file)
+	if err != nil {
+		return err
+	}
+	r, err := newResolver(sections)
+	if err != nil {
+		return err
+	}
+	if template, _ := r.template(name); template {
+		return fmt.Errorf("configuration %s is a template, set with 'template = true', and is not deployed", name)
+	}
+	return fmt.Errorf("configuration %s was not found", name)
+}
+
+// File returns the path of the file defining the configuration section.
+func (c *Config) File() string {
+	return c.file
+}
+
+// ConnectHosts returns the connect_host addresses in the order they are
+// tried.
+func (c *Config) ConnectHosts() []string {
+	var hosts []string
+	for _, h := range strings.Split(c.ConnectHost, ",") {
+		if h = strings.TrimSpace(h); h != "" {
+			hosts = append(hosts, h)
+		}
 	}
-	return c.certName
+	return hosts
+}
+
+// HostName returns the name of the TrueNAS host in the logs, the
+// connect_host or 'localhost' for a local client without one.
+func (c *Config) HostName() string {
+	if c.ConnectHost == "" {
+		return "localhost"
+	}
+	return c.ConnectHost
+}
+
+// WithClientApi returns a copy of the configuration using the client API,
+// with the protocol of that API matching the TLS use of the protocol.
+func (c *Config) WithClientApi(clientApi string) *Config {
+	cfg := *c
+	cfg.ClientApi = clientApi
+	cfg.Protocol = matchingProtocol(clientApi, c.Protocol)
+	cfg.serverURL = ""
+	return &cfg
+}
+
+// returns the protocol of the client API that uses TLS when the given
+// protocol does, 'wss' or 'https' and 'ws' or 'http'.
+func matchingProtocol(clientApi string, protocol string) string {
+	secure := protocol != "ws" && protocol != "http"
+	switch {
+	case (clientApi == "wsapi" || clientApi == "legacyws") && secure:
+		return "wss"
+	case clientApi == "wsapi" || clientApi == "legacyws":
+		return "ws"
+	case clientApi == "restapi" && secure:
+		return "https"
+	case clientApi == "restapi":
+		return "http"
+	}
+	return protocol
+}
+
+// WithConnectHost returns a copy of the configuration connecting to one of
+// its connect_host addresses.
+func (c *Config) WithConnectHost(host string) *Config {
+	cfg := *c
+	cfg.ConnectHost = host
+	cfg.serverURL = ""
+	return &cfg
+}
+
+// CertName returns the name of the certificate deployed to TrueNAS, see
+// LoadCertName.  The error is returned when the certificate cannot be read.
+func (c *Config) CertName(ctx context.Context) (string, error) {
+	if err := c.LoadCertName(ctx); err != nil {
+		return "", err
+	}
+	return c.certName, nil
 }
 
 func (c *Config) ServerURL() string {
@@ -112,150 +258,285 @@ func (c *Config) ServerURL() string {
 	return c.serverURL
 }
 
-func (c *Config) checkConfig() error {
-	// lookup the ApiKey
-	c.ApiKey = os.ExpandEnv(c.ApiKey)
+// an invalid or missing configuration key.
+type keyError struct {
+	key string
+	err error
+}
 
-	// lookup the Username
-	c.Username = os.ExpandEnv(c.Username)
+func (e *keyError) Error() string {
+	return e.err.Error()
+}
 
-	// lookup the Password
-	c.Password = os.ExpandEnv(c.Password)
-	if c.ApiKey == "" && c.Username == "" {
-		return fmt.Errorf("no authentication is defined, use an 'api_key' or the 'username' and 'password'")
-	}
+func (e *keyError) Unwrap() error {
+	return e.err
+}
 
-	// lookup the cert_basename
-	c.CertBasename = os.ExpandEnv(c.CertBasename)
-	if c.CertBasename == "" {
-		c.CertBasename = Default_base_cert_name
-	}
+// returns an error about the key.
+func errorf(key string, format string, a ...any) error {
+	return &keyError{key: key, err: fmt.Errorf(format, a...)}
+}
 
-	// lookup the connect_host
-	c.ConnectHost = os.ExpandEnv(c.ConnectHost)
-	if c.ConnectHost == "" {
-		return fmt.Errorf("the required 'connect_host' parameter is not defined")
-	}
+// a configuration key declared by the tags of a Config field.
+type field struct {
+	name     string
+	alias    string
+	def      string
+	required bool
+	oneOf    []string
+	max      uint64
+	index    int
+}
 
-	// lookup the client_api
-	c.ClientApi = os.ExpandEnv(c.ClientApi)
-	if c.ClientApi == "" {
-		c.ClientApi = Default_protocol
-	} else if c.ClientApi != "restapi" && c.ClientApi != "wsapi" {
-		return fmt.Errorf("invalid client_api '%s' use 'restapi' or 'wsapi'", c.ClientApi)
+// the configuration keys in the order of the Config fields.
+var schema = newSchema()
+
+func newSchema() []field {
+	var fields []field
+	t := reflect.TypeOf(Config{})
+	for i := 0; i < t.NumField(); i++ {
+		tag := t.Field(i).Tag
+		if tag.Get("ini") == "" {
+			continue
+		}
+		f := field{
+			name:     tag.Get("ini"),
+			alias:    tag.Get("alias"),
+			def:      tag.Get("default"),
+			required: tag.Get("required") == "true",
+			index:    i,
+		}
+		if oneOf := tag.Get("oneof"); oneOf != "" {
+			f.oneOf = strings.Split(oneOf, ",")
+		}
+		if max := tag.Get("max"); max != "" {
+			f.max, _ = strconv.ParseUint(max, 10, 64)
+		}
+		fields = append(fields, f)
 	}
+	return fields
+}
 
-	// lookup delete_old_certs
-	c.DeleteOldCertsStr = os.ExpandEnv(c.DeleteOldCertsStr)
-	if b, err := strconv.ParseBool(c.DeleteOldCertsStr); err == nil {
-		c.DeleteOldCerts = b
-	} else {
-		return err
+// sets the configuration from the section entries, missing keys take their
+// default values.  All the problems found are returned joined in one error.
+func (c *Config) load(entries []entry) error {
+	values := make(map[string]entry)
+	for _, e := range entries {
+		values[e.name] = e
 	}
 
-	// lookup strict_basename_match
-	if c.StrictBasenameMatchStr != "" {
-		c.StrictBasenameMatchStr = os.ExpandEnv(c.StrictBasenameMatchStr)
-		if b, err := strconv.ParseBool(c.StrictBasenameMatchStr); err == nil {
-			c.StrictBasenameMatch = b
-		} else {
-			return err
+	var errs []error
+	v := reflect.ValueOf(c).Elem()
+	for _, f := range schema {
+		name := f.name
+		e, ok := values[name]
+		if !ok && f.alias != "" {
+			name = f.alias
+			e = values[name]
+		}
+		value := e.value
+		if !e.fromEnv {
+			value = os.ExpandEnv(value)
+		}
+		value = strings.TrimSpace(value)
+		if value == "" {
+			if f.required {
+				errs = append(errs, errorf(name, "the required '%s' is not defined", f.name))
+				continue
+			}
+			value = f.def
+		}
+		if value == "" {
+			continue
+		}
+		if err := f.set(v.Field(f.index), name, value); err != nil {
+			errs = append(errs, err)
 		}
-	} else {
-		// Default to the original app behaviour if the key is not specified
-		c.StrictBasenameMatch = false
 	}
 
-	//lookup the full_chain_path
-	c.FullChainPath = os.ExpandEnv(c.FullChainPath)
-	if c.FullChainPath == "" {
-		return fmt.Errorf("the required 'fullchain_path' is not defined")
+	// the local client connects to the middlewared socket, the connect_host
+	// then only names the host in the logs
+	if c.ConnectHost == "" && c.ClientApi != "local" {
+		errs = append(errs, errorf("connect_host", "the required 'connect_host' is not defined"))
+	} else if c.ConnectHost != "" {
+		for _, h := range strings.Split(c.ConnectHost, ",") {
+			if strings.TrimSpace(h) == "" {
+				errs = append(errs, errorf("connect_host", "'connect_host' has an empty address in '%s'", c.ConnectHost))
+				break
+			}
+		}
 	}
-
-	// lookup the private_key_path
-	c.PrivateKeyPath = os.ExpandEnv(c.PrivateKeyPath)
-	if c.PrivateKeyPath == "" {
-		return fmt.Errorf("the required 'private_key_path' is not defined")
+	// the timeouts of the connection and of the calls default to 'timeout'
+	if c.ConnectTimeout == 0 {
+		c.ConnectTimeout = c.Timeout
 	}
-
-	// lookup the port
-	c.PortStr = os.ExpandEnv(c.PortStr)
-	if c.PortStr != "" {
-		if i, err := strconv.ParseUint(c.PortStr, 10, 64); err == nil {
-			c.Port = i
-		} else {
-			return err
+	if c.CallTimeout == 0 {
+		c.CallTimeout = c.Timeout
+	}
+	// the protocol only tells whether TLS is used once the client API is known
+	c.Protocol = matchingProtocol(c.ClientApi, c.Protocol)
+	if c.CertNameTemplate != "" {
+		if _, err := parseTemplate(c.CertNameTemplate); err != nil {
+			errs = append(errs, errorf("cert_name_template", "invalid 'cert_name_template', %v", err))
 		}
 	}
-	// if port is not defined, use the default
-	if c.Port == 0 {
-		c.Port = Default_port
+	// the certificate and its key come from separate files, a combined PEM
+	// bundle or a PKCS#12 bundle
+	switch {
+	case c.PKCS12Path != "" && c.BundlePath != "":
+		errs = append(errs, errorf("bundle_path", "'bundle_path' and 'pkcs12_path' cannot both be set"))
+	case c.PKCS12Path != "" || c.BundlePath != "":
+		key := "pkcs12_path"
+		if c.BundlePath != "" {
+			key = "bundle_path"
+		}
+		if c.FullChainPath != "" || c.PrivateKeyPath != "" {
+			errs = append(errs, errorf(key, "'%s' replaces 'full_chain_path' and 'private_key_path', do not set them", key))
+		}
+	default:
+		for _, key := range []struct{ name, value string }{{"full_chain_path", c.FullChainPath}, {"private_key_path", c.PrivateKeyPath}} {
+			if key.value == "" {
+				errs = append(errs, errorf(key.name, "the required '%s' is not defined, or use a 'bundle_path' or 'pkcs12_path'", key.name))
+			}
+		}
 	}
-
-	// lookup the protocol
-	c.Protocol = os.ExpandEnv(c.Protocol)
-	// if the protocol is not defined, use the default
-	if c.Protocol == "" {
-		c.Protocol = Default_protocol
-	} else if c.Protocol != "ws" && c.Protocol != "wss" && c.Protocol != "http" && c.Protocol != "https" {
-		return fmt.Errorf("invalid protocol use 'ws' or 'wss' or 'http' or 'https")
+	if c.PKCS12Password != "" && c.PKCS12Path == "" {
+		errs = append(errs, errorf("pkcs12_password", "'pkcs12_password' is set but no 'pkcs12_path' is defined"))
 	}
-
-	// lookup tls_skip_verify
-	c.TlsSkipVerifyStr = os.ExpandEnv(c.TlsSkipVerifyStr)
-	if b, err := strconv.ParseBool(c.TlsSkipVerifyStr); err == nil {
-		c.TlsSkipVerify = b
-	} else {
-		return err
+	if c.PrivateKeyPassword != "" && c.PKCS12Path != "" {
+		errs = append(errs, errorf("private_key_password", "the 'pkcs12_path' is decrypted with the 'pkcs12_password', not the 'private_key_password'"))
 	}
-
-	// lookup the add_as_ui_certificate
-	c.AddAsUiCertificateStr = os.ExpandEnv(c.AddAsUiCertificateStr)
-	if b, err := strconv.ParseBool(c.AddAsUiCertificateStr); err == nil {
-		c.AddAsUiCertificate = b
-	} else {
-		return err
+	if c.IntermediatesDir != "" && !c.RebuildChain {
+		errs = append(errs, errorf("intermediates_dir", "'intermediates_dir' is only used with rebuild_chain = true"))
 	}
-
-	// lookup the add_as_ftp_certificate
-	c.AddAsFTPCertificateStr = os.ExpandEnv(c.AddAsFTPCertificateStr)
-	if b, err := strconv.ParseBool(c.AddAsFTPCertificateStr); err == nil {
-		c.AddAsFTPCertificate = b
-	} else {
-		return err
+	if (c.ClientCertPath == "") != (c.ClientKeyPath == "") {
+		errs = append(errs, errorf("client_cert_path", "'client_cert_path' and 'client_key_path' must be given together"))
 	}
-
-	// lookup the add_as_app_certificate
-	c.AddAsAppCertificateStr = os.ExpandEnv(c.AddAsAppCertificateStr)
-	if b, err := strconv.ParseBool(c.AddAsAppCertificateStr); err == nil {
-		c.AddAsAppCertificate = b
-	} else {
-		return err
+	if c.PinSHA256 != "" {
+		if _, err := parsePins(c.PinSHA256); err != nil {
+			errs = append(errs, errorf("pin_sha256", "invalid 'pin_sha256', %v", err))
+		}
+	}
+	if c.Proxy != "" {
+		if err := checkProxy(c.Proxy, c.ProxyPassword); err != nil {
+			errs = append(errs, errorf("proxy", "invalid 'proxy', %v", err))
+		}
+	} else if c.ProxyPassword != "" {
+		errs = append(errs, errorf("proxy_password", "'proxy_password' is set but no 'proxy' is defined"))
+	}
+	if c.ClientApi == "ssh" && c.SSHKeyPath == "" {
+		errs = append(errs, errorf("ssh_key_path", "the 'ssh_key_path' is required with client_api = ssh"))
 	}
+	// the middlewared socket authenticates the local user by its peer
+	// credentials, midclt runs as the ssh_user over SSH
+	if c.ApiKey == "" && c.Username == "" && c.ClientApi != "local" && c.ClientApi != "ssh" {
+		errs = append(errs, errorf("api_key", "no authentication is defined, use an 'api_key' or the 'username' and 'password'"))
+	}
+	return errors.Join(errs...)
+}
 
-	// lookup the app_list
-	c.AppList = os.ExpandEnv(c.AppList)
+// Pins returns the pin_sha256 hashes in base64.
+func (c *Config) Pins() []string {
+	pins, _ := parsePins(c.PinSHA256)
+	return pins
+}
 
-	// lookup the timeoutSeconds
-	c.TimeoutSecondsStr = os.ExpandEnv(c.TimeoutSecondsStr)
-	if c.TimeoutSecondsStr != "" {
-		if i, err := strconv.ParseInt(c.TimeoutSecondsStr, 10, 64); err == nil {
-			c.TimeoutSeconds = i
-		} else {
-			return err
+// parses a comma separated list of SHA-256 public key hashes written in
+// base64, as printed by 'openssl dgst -sha256 -binary | base64', with an
+// optional 'sha256//' prefix, or in hexadecimal.
+func parsePins(value string) ([]string, error) {
+	var pins []string
+	for _, pin := range strings.Split(value, ",") {
+		pin = strings.TrimPrefix(strings.TrimSpace(pin), "sha256//")
+		if pin == "" {
+			continue
 		}
+		hash, err := base64.StdEncoding.DecodeString(pin)
+		if err != nil || len(hash) != sha256.Size {
+			if hash, err = hex.DecodeString(strings.ReplaceAll(pin, ":", "")); err != nil || len(hash) != sha256.Size {
+				return nil, fmt.Errorf("'%s' is not a SHA-256 hash in base64 or hexadecimal", pin)
+			}
+		}
+		pins = append(pins, base64.StdEncoding.EncodeToString(hash))
 	}
-	if c.TimeoutSeconds <= 0 {
-		c.TimeoutSeconds = Default_timeout_seconds
+	if len(pins) == 0 {
+		return nil, fmt.Errorf("no pin is given")
 	}
+	return pins, nil
+}
 
-	// lookup the debug key
-	c.DebugStr = os.ExpandEnv(c.DebugStr)
-	if b, err := strconv.ParseBool(c.DebugStr); err == nil {
-		c.Debug = b
-	} else {
-		return err
+// checks a proxy URL, the proxy password must be given with proxy_password
+// so that it is handled like the other secrets.  The URL is not repeated in
+// the errors as it may hold a password.
+func checkProxy(proxy string, password string) error {
+	u, err := url.Parse(proxy)
+	if err != nil {
+		return fmt.Errorf("the proxy is not a URL")
+	}
+	if u.Scheme != "socks5" && u.Scheme != "http" {
+		return fmt.Errorf("the proxy URL must start with socks5:// or http://")
+	}
+	if u.Hostname() == "" {
+		return fmt.Errorf("the proxy URL has no host")
+	}
+	if _, ok := u.User.Password(); ok {
+		return fmt.Errorf("the proxy URL holds a password, use 'proxy_password'")
 	}
+	if password != "" && u.User.Username() == "" {
+		return fmt.Errorf("the proxy URL names no user for the 'proxy_password', use %s://user@%s", u.Scheme, u.Host)
+	}
+	return nil
+}
 
+// parses and validates a value, the errors name the key.
+func (f *field) set(v reflect.Value, name string, value string) error {
+	if len(f.oneOf) > 0 && !slices.Contains(f.oneOf, value) {
+		return errorf(name, "invalid %s '%s' use '%s'", name, value, strings.Join(f.oneOf, "' or '"))
+	}
+	switch v.Interface().(type) {
+	case string:
+		v.SetString(value)
+	case bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return errorf(name, "'%s' must be true or false, got '%s'", name, value)
+		}
+		v.SetBool(b)
+	case int64:
+		i, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || (f.max > 0 && i > int64(f.max)) {
+			return errorf(name, "'%s' must be a number%s, got '%s'", name, f.maxText(), value)
+		}
+		v.SetInt(i)
+	case uint64:
+		i, err := strconv.ParseUint(value, 10, 64)
+		if err != nil || (f.max > 0 && i > f.max) {
+			return errorf(name, "'%s' must be a number%s, got '%s'", name, f.maxText(), value)
+		}
+		v.SetUint(i)
+	case time.Duration:
+		d, err := parseDuration(value)
+		if err != nil || d <= 0 {
+			return errorf(name, "'%s' must be a duration such as 30s or 5m, or a number of seconds, got '%s'", name, value)
+		}
+		v.SetInt(int64(d))
+	default:
+		return errorf(name, "unsupported type %v for '%s'", v.Type(), name)
+	}
 	return nil
 }
+
+func (f *field) maxText() string {
+	if f.max > 0 {
+		return fmt.Sprintf(" up to %d", f.max)
+	}
+	return ""
+}
+
+// parses a duration, a bare number is a number of seconds.
+func parseDuration(value string) (time.Duration, error) {
+	if i, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Duration(i) * time.Second, nil
+	}
+	return time.ParseDuration(value)
+}
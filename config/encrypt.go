@@ -0,0 +1,305 @@
+/*
+ * Copyright (C) 2025 by John J. Rushford jrushford@apache.org
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package config
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"filippo.io/age"
+)
+
+const (
+	// the prefix of a value encrypted with age
+	encPrefix = "enc:"
+	// the environment variable naming the age identity file, used when no
+	// identity file is given on the command line
+	IdentityEnv = "TNASCERT_AGE_IDENTITY"
+)
+
+// IdentityFile is the age identity file used to decrypt 'enc:' values, the
+// IdentityEnv environment variable is used when it is empty.
+var IdentityFile string
+
+// returns true if the value is encrypted.
+func isEncrypted(value string) bool {
+	return strings.HasPrefix(value, encPrefix)
+}
+
+// returns the path of the age identity file.
+func identityFile() string {
+	if IdentityFile != "" {
+		return IdentityFile
+	}
+	return os.Getenv(IdentityEnv)
+}
+
+// reads the age identities, the identity file is only read the first time
+// an encrypted value is found.
+type identities struct {
+	ids []age.Identity
+	err error
+}
+
+func (i *identities) get() ([]age.Identity, error) {
+	if i.ids == nil && i.err == nil {
+		i.ids, i.err = readIdentities()
+	}
+	return i.ids, i.err
+}
+
+func readIdentities() ([]age.Identity, error) {
+	path := identityFile()
+	if path == "" {
+		return nil, fmt.Errorf("no identity file is given, use --identity or set %s", IdentityEnv)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("error opening the identity file: %w", err)
+	}
+	defer f.Close()
+	ids, err := age.ParseIdentities(f)
+	if err != nil {
+		return nil, fmt.Errorf("error reading the identity file '%s': %w", path, err)
+	}
+	return ids, nil
+}
+
+// decrypts an 'enc:' value, other values are returned unchanged.
+func decryptValue(key string, value string, ids *identities) (string, error) {
+	if !isEncrypted(value) {
+		return value, nil
+	}
+	idList, err := ids.get()
+	if err != nil {
+		return "", fmt.Errorf("the '%s' value is encrypted: %w", key, err)
+	}
+	plain, err := decrypt(value, idList)
+	if err != nil {
+		return "", fmt.Errorf("error decrypting the '%s' value: %w", key, err)
+	}
+	return plain, nil
+}
+
+func decrypt(value string, identities []age.Identity) (string, error) {
+	ciphertext, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(value, encPrefix))
+	if err != nil {
+		return "", fmt.Errorf("invalid base64 encoding: %w", err)
+	}
+	r, err := age.Decrypt(bytes.NewReader(ciphertext), identities...)
+	if err != nil {
+		return "", err
+	}
+	plain, err := io.ReadAll(r)
+	if err != nil {
+		return "", err
+	}
+	return string(plain), nil
+}
+
+// decrypts the encrypted secret values of a configuration.
+func (c *Config) decrypt(ids *identities) error {
+	var err error
+	if c.ApiKey, err = decryptValue("api_key", c.ApiKey, ids); err != nil {
+		return err
+	}
+	if c.Password, err = decryptValue("password", c.Password, ids); err != nil {
+		return err
+	}
+	if c.ProxyPassword, err = decryptValue("proxy_password", c.ProxyPassword, ids); err != nil {
+		return err
+	}
+	if c.PKCS12Password, err = decryptValue("pkcs12_password", c.PKCS12Password, ids); err != nil {
+		return err
+	}
+	if c.PrivateKeyPassword, err = decryptValue("private_key_password", c.PrivateKeyPassword, ids); err != nil {
+		return err
+	}
+	return nil
+}
+
+// ParseRecipients parses age recipients given either as 'age1...' public
+// keys or as files holding one recipient per line.  When no recipient is
+// given, the recipients of the identity file are used.
+func ParseRecipients(args []string) ([]age.Recipient, error) {
+	var recipients []age.Recipient
+	if len(args) == 0 {
+		ids, err := readIdentities()
+		if err != nil {
+			return nil, err
+		}
+		for _, id := range ids {
+			if x, ok := id.(*age.X25519Identity); ok {
+				recipients = append(recipients, x.Recipient())
+			}
+		}
+		if len(recipients) == 0 {
+			return nil, fmt.Errorf("the identity file has no X25519 identity")
+		}
+		return recipients, nil
+	}
+	for _, arg := range args {
+		if strings.HasPrefix(arg, "age1") {
+			r, err := age.ParseX25519Recipient(arg)
+			if err != nil {
+				return nil, err
+			}
+			recipients = append(recipients, r)
+			continue
+		}
+		f, err := os.Open(arg)
+		if err != nil {
+			return nil, fmt.Errorf("error opening the recipients file: %w", err)
+		}
+		rs, err := age.ParseRecipients(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("error reading the recipients file '%s': %w", arg, err)
+		}
+		recipients = append(recipients, rs...)
+	}
+	return recipients, nil
+}
+
+// EncryptValue encrypts a value to the age recipients and returns it as an
+// 'enc:' value.
+func EncryptValue(value string, recipients []age.Recipient) (string, error) {
+	var b bytes.Buffer
+	w, err := age.Encrypt(&b, recipients...)
+	if err != nil {
+		return "", err
+	}
+	if _, err = io.WriteString(w, value); err != nil {
+		return "", err
+	}
+	if err = w.Close(); err != nil {
+		return "", err
+	}
+	return encPrefix + base64.StdEncoding.EncodeToString(b.Bytes()), nil
+}
+
+// RekeyedFile is a configuration file whose values were encrypted again by
+// Rekey.
+type RekeyedFile struct {
+	Path  string
+	Count int // the number of values encrypted again
+}
+
+// Rekey decrypts every 'enc:' value of the configuration files with the
+// identity file and encrypts it again to the recipients.  The files are
+// those loaded by LoadConfig, the files of a directory and the included
+// files.  Every value is encrypted again before any file is rewritten in
+// place, everything else is kept as written.  Returns the number of values
+// encrypted again in each file.
+func Rekey(config_file string, recipients []age.Recipient) ([]RekeyedFile, error) {
+	files, err := configFileSet(config_file)
+	if err != nil {
+		return nil, err
+	}
+	ids := &identities{}
+	rekeyed := make([]RekeyedFile, len(files))
+	data := make([][]byte, len(files))
+	for i, path := range files {
+		rekeyed[i].Path = path
+		if data[i], rekeyed[i].Count, err = rekeyFile(path, ids, recipients); err != nil {
+			return nil, fmt.Errorf("'%s': %w", path, err)
+		}
+	}
+	for i, r := range rekeyed {
+		if r.Count == 0 {
+			continue
+		}
+		if err = replaceFile(r.Path, data[i]); err != nil {
+			return rekeyed[:i], fmt.Errorf("error rewriting '%s': %w", r.Path, err)
+		}
+	}
+	return rekeyed, nil
+}
+
+// returns the data of a configuration file with its 'enc:' values encrypted
+// again to the recipients, and the number of those values.  Only the values
+// of the keys found by the parser of the file format are rewritten, on their
+// line, so that comments are kept as they are.
+func rekeyFile(path string, ids *identities, recipients []age.Recipient) ([]byte, int, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	sections, err := readFile(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	lines := bytes.SplitAfter(data, []byte("\n"))
+	count := 0
+	for _, s := range sections {
+		for _, e := range s.entries {
+			value := strings.TrimSpace(e.value)
+			if !isEncrypted(value) {
+				continue
+			}
+			if e.line < 1 || e.line > len(lines) || !bytes.Contains(lines[e.line-1], []byte(value)) {
+				return nil, 0, fmt.Errorf("the encrypted value of [%s] '%s' was not found on its line", s.name, e.name)
+			}
+			idList, err := ids.get()
+			if err != nil {
+				return nil, 0, err
+			}
+			plain, err := decrypt(value, idList)
+			if err != nil {
+				return nil, 0, fmt.Errorf("error decrypting [%s] '%s' line %d: %w", s.name, e.name, e.line, err)
+			}
+			enc, err := EncryptValue(plain, recipients)
+			if err != nil {
+				return nil, 0, err
+			}
+			lines[e.line-1] = bytes.Replace(lines[e.line-1], []byte(value), []byte(enc), 1)
+			count++
+		}
+	}
+	return bytes.Join(lines, nil), count, nil
+}
+
+// replaces a file with data through a temporary file, keeping its mode.
+func replaceFile(path string, data []byte) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err = tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Chmod(info.Mode().Perm()); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,109 @@
+/*
+ * Copyright (C) 2025 by John J. Rushford jrushford@apache.org
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package config
+
+import (
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// the prefix of the environment variables holding a configuration.
+const envPrefix = "TNASCERT_"
+
+// the file name reported for sections read from the environment.
+const envSource = "environment"
+
+// the variables that Kubernetes sets for a service named tnascert or
+// tnascert-<name>, such as TNASCERT_SERVICE_PORT, after the prefix.
+var serviceLinkRegexp = regexp.MustCompile(`^(\w+_)?(SERVICE_HOST|SERVICE_PORT(_\w+)?|PORT_\d+_(TCP|UDP|SCTP)(_\w+)?)$`)
+
+// the value of the <SERVICE>_PORT variable of a Kubernetes service or of a
+// Docker link, such as tcp://10.0.0.1:443.
+var serviceURLRegexp = regexp.MustCompile(`^(tcp|udp|sctp)://`)
+
+// returns true when the variable, named without the prefix, was set for a
+// Kubernetes service or a Docker link rather than for the configuration.
+func isServiceLink(name string, value string) bool {
+	if serviceLinkRegexp.MatchString(name) {
+		return true
+	}
+	return (name == "PORT" || strings.HasSuffix(name, "_PORT")) && serviceURLRegexp.MatchString(value)
+}
+
+// returns the key names matched by the environment variables, longest
+// first so that TNASCERT_NAS01_JOB_TIMEOUT is read as 'job_timeout'.
+func envKeys() []string {
+	keys := []string{inheritKey, templateKey}
+	for _, f := range schema {
+		keys = append(keys, f.name)
+		if f.alias != "" {
+			keys = append(keys, f.alias)
+		}
+	}
+	sort.SliceStable(keys, func(i, j int) bool {
+		return len(keys[i]) > len(keys[j])
+	})
+	return keys
+}
+
+// reads the configuration sections from the TNASCERT_ environment
+// variables.  TNASCERT_<KEY> variables belong to the DEFAULT section and
+// TNASCERT_<SECTION>_<KEY> variables to the lower case <section>.  When
+// there are only DEFAULT variables, they make up the deploy_default section.
+// The variables of a Kubernetes service or of a Docker link whose name starts
+// with TNASCERT_ are ignored.  Returns nil when no variable is set.
+func readEnvironment() []*section {
+	keys := envKeys()
+	var names []string
+	values := make(map[string]string)
+	for _, kv := range os.Environ() {
+		name, value, ok := strings.Cut(kv, "=")
+		if ok && strings.HasPrefix(name, envPrefix) && !isServiceLink(strings.TrimPrefix(name, envPrefix), value) {
+			names = append(names, name)
+			values[name] = value
+		}
+	}
+	sort.Strings(names)
+
+	var sections []*section
+	for _, name := range names {
+		rest := strings.TrimPrefix(name, envPrefix)
+		for _, key := range keys {
+			upper := strings.ToUpper(key)
+			sname := ""
+			if rest == upper {
+				sname = defaultSection
+			} else if strings.HasSuffix(rest, "_"+upper) && len(rest) > len(upper)+1 {
+				sname = strings.ToLower(strings.TrimSuffix(rest, "_"+upper))
+			} else {
+				continue
+			}
+			var s *section
+			sections, s = lookupSection(sections, sname)
+			s.file = envSource
+			s.entries = append(s.entries, entry{name: key, value: values[name], file: "$" + name, fromEnv: true})
+			break
+		}
+	}
+	if len(sections) == 1 && sections[0].name == defaultSection {
+		sections = append(sections, &section{name: Default_section, file: envSource})
+	}
+	return sections
+}
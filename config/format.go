@@ -0,0 +1,723 @@
+/*
+ * Copyright (C) 2025 by John J. Rushford jrushford@apache.org
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/ini.v1"
+	"gopkg.in/yaml.v3"
+)
+
+// supported configuration file formats
+const (
+	Format_ini  = "ini"
+	Format_yaml = "yaml"
+	Format_toml = "toml"
+	Format_json = "json"
+)
+
+// name of the section holding values that are not part of a named section.
+const defaultSection = "DEFAULT"
+
+// a key and its value as read from a configuration file.
+type entry struct {
+	name    string
+	value   string
+	file    string // the file holding the key
+	line    int    // line number in the file, 0 if unknown
+	fromEnv bool   // the value was read from an environment variable and is not expanded
+}
+
+// a configuration section as read from a file, independent of the file format.
+type section struct {
+	name    string
+	file    string
+	line    int // line number of the section header, 0 if unknown
+	entries []entry
+}
+
+// FormatFromPath returns the configuration format of a file based on its
+// extension, files with an unknown extension are read as INI files.
+func FormatFromPath(path string) string {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		return Format_yaml
+	case ".toml":
+		return Format_toml
+	case ".json":
+		return Format_json
+	}
+	return Format_ini
+}
+
+// Convert translates the configuration file src into a new file dst, the
+// formats of both files are detected from their extensions.  Values are
+// copied as written, environment variables are not expanded.
+func Convert(src string, dst string) error {
+	sections, err := readFile(src)
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	if err = writeSections(&buf, FormatFromPath(dst), sections); err != nil {
+		return err
+	}
+	// the converted file may hold credentials, do not overwrite an existing
+	// file and keep it private to the owner.
+	f, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(buf.Bytes()); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// reads a configuration file of any supported format.
+func readFile(path string) ([]*section, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var sections []*section
+	switch FormatFromPath(path) {
+	case Format_yaml:
+		sections, err = parseYAML(data)
+	case Format_toml:
+		sections, err = parseTOML(data)
+	case Format_json:
+		sections, err = parseJSON(data)
+	default:
+		sections, err = parseINI(data)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error parsing '%s': %v", path, err)
+	}
+	for _, s := range sections {
+		s.file = path
+		for i := range s.entries {
+			s.entries[i].file = path
+		}
+	}
+	return sections, nil
+}
+
+// returns the section with the given name, adding it if needed.
+func lookupSection(sections []*section, name string) ([]*section, *section) {
+	for _, s := range sections {
+		if s.name == name {
+			return sections, s
+		}
+	}
+	s := &section{name: name}
+	return append(sections, s), s
+}
+
+func parseINI(data []byte) ([]*section, error) {
+	f, err := ini.Load(data)
+	if err != nil {
+		return nil, err
+	}
+	var sections []*section
+	for _, sec := range f.Sections() {
+		s := &section{name: sec.Name()}
+		for _, k := range sec.Keys() {
+			s.entries = append(s.entries, entry{name: k.Name(), value: k.Value()})
+		}
+		if s.name == defaultSection && len(s.entries) == 0 {
+			continue
+		}
+		sections = append(sections, s)
+	}
+	setLines(data, sections)
+	return sections, nil
+}
+
+// sets the line numbers of the sections and keys of INI and TOML files,
+// whose parsers do not report them.  Keys are looked up by name below their
+// section header.
+func setLines(data []byte, sections []*section) {
+	type position struct {
+		header int
+		keys   map[string]int
+	}
+	positions := map[string]*position{defaultSection: {keys: map[string]int{}}}
+	current := positions[defaultSection]
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || line[0] == '#' || line[0] == ';' {
+			continue
+		}
+		if strings.HasPrefix(line, "[") {
+			if strings.HasPrefix(line, "[[") || !strings.Contains(line, "]") {
+				continue
+			}
+			name := strings.Trim(strings.TrimSpace(line[1:strings.Index(line, "]")]), `"'`)
+			if _, ok := positions[name]; !ok {
+				positions[name] = &position{header: i + 1, keys: map[string]int{}}
+			}
+			current = positions[name]
+			continue
+		}
+		if n := strings.IndexAny(line, "=:"); n > 0 {
+			name := strings.TrimSpace(line[:n])
+			name = strings.ReplaceAll(strings.ReplaceAll(name, `"`, ""), "'", "")
+			name = strings.ReplaceAll(name, " ", "")
+			if _, ok := current.keys[name]; !ok {
+				current.keys[name] = i + 1
+			}
+		}
+	}
+	for _, s := range sections {
+		p, ok := positions[s.name]
+		if !ok {
+			continue
+		}
+		s.line = p.header
+		for i := range s.entries {
+			s.entries[i].line = p.keys[s.entries[i].name]
+		}
+	}
+}
+
+// YAML and JSON documents are a mapping of section names to mappings of
+// keys, scalar values at the top level belong to the DEFAULT section.
+func parseYAML(data []byte) ([]*section, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	if len(doc.Content) == 0 {
+		return nil, nil
+	}
+	root := doc.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("line %d: the document must be a mapping of section names", root.Line)
+	}
+	pairs, err := yamlPairs(root)
+	if err != nil {
+		return nil, err
+	}
+	var sections []*section
+	for i := 0; i+1 < len(pairs); i += 2 {
+		key, value := pairs[i], pairs[i+1]
+		if value.Kind == yaml.AliasNode {
+			value = value.Alias
+		}
+		var s *section
+		if value.Kind == yaml.MappingNode {
+			sections, s = lookupSection(sections, key.Value)
+			if s.line == 0 {
+				s.line = key.Line
+			}
+			values, err := yamlPairs(value)
+			if err != nil {
+				return nil, err
+			}
+			for j := 0; j+1 < len(values); j += 2 {
+				k := values[j]
+				if err := addYAMLValue(s, k.Value, k.Line, values[j+1]); err != nil {
+					return nil, err
+				}
+			}
+			continue
+		}
+		sections, s = lookupSection(sections, defaultSection)
+		if err := addYAMLValue(s, key.Value, key.Line, value); err != nil {
+			return nil, err
+		}
+	}
+	return sections, nil
+}
+
+// returns the keys and values of a YAML mapping, alternating, with the
+// mappings of its '<<' merge keys added after its own keys.  A key of the
+// mapping overrides a merged one, and an earlier merged mapping overrides a
+// later one.  The 'template' key is not merged, like it is not inherited.
+func yamlPairs(n *yaml.Node) ([]*yaml.Node, error) {
+	var pairs, merged []*yaml.Node
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		key, value := n.Content[i], n.Content[i+1]
+		if key.Tag != "!!merge" {
+			pairs = append(pairs, key, value)
+			continue
+		}
+		if value.Kind == yaml.AliasNode {
+			value = value.Alias
+		}
+		sources := []*yaml.Node{value}
+		if value.Kind == yaml.SequenceNode {
+			sources = value.Content
+		}
+		for _, source := range sources {
+			if source.Kind == yaml.AliasNode {
+				source = source.Alias
+			}
+			if source.Kind != yaml.MappingNode {
+				return nil, fmt.Errorf("line %d: '<<' may only merge mappings", key.Line)
+			}
+			values, err := yamlPairs(source)
+			if err != nil {
+				return nil, err
+			}
+			merged = append(merged, values...)
+		}
+	}
+	defined := make(map[string]bool)
+	for i := 0; i < len(pairs); i += 2 {
+		defined[pairs[i].Value] = true
+	}
+	for i := 0; i+1 < len(merged); i += 2 {
+		name := merged[i].Value
+		if !defined[name] && name != templateKey {
+			defined[name] = true
+			pairs = append(pairs, merged[i], merged[i+1])
+		}
+	}
+	return pairs, nil
+}
+
+// adds a YAML value to the section, lists are joined with commas.  The keys
+// of a section are flat, a nested mapping is an error.
+func addYAMLValue(s *section, name string, line int, n *yaml.Node) error {
+	if n.Kind == yaml.AliasNode {
+		n = n.Alias
+	}
+	switch n.Kind {
+	case yaml.ScalarNode:
+		if n.Tag == "!!null" {
+			s.entries = append(s.entries, entry{name: name, value: "", line: line})
+		} else {
+			s.entries = append(s.entries, entry{name: name, value: n.Value, line: line})
+		}
+	case yaml.SequenceNode:
+		var values []string
+		for _, item := range n.Content {
+			if item.Kind != yaml.ScalarNode {
+				return fmt.Errorf("line %d: '%s' may only hold a list of values", item.Line, name)
+			}
+			values = append(values, item.Value)
+		}
+		s.entries = append(s.entries, entry{name: name, value: strings.Join(values, ", "), line: line})
+	case yaml.MappingNode:
+		return fmt.Errorf("line %d: '%s' is a nested mapping, the keys of a section must be flat, share values with '<<' merge keys or 'inherit'", line, name)
+	default:
+		return fmt.Errorf("line %d: unsupported value for '%s'", n.Line, name)
+	}
+	return nil
+}
+
+// a JSON token decoder that reports line numbers.
+type jsonDecoder struct {
+	*json.Decoder
+	data []byte
+}
+
+// returns the line number of the last token read.
+func (dec *jsonDecoder) line() int {
+	return bytes.Count(dec.data[:dec.InputOffset()], []byte("\n")) + 1
+}
+
+func parseJSON(data []byte) ([]*section, error) {
+	dec := &jsonDecoder{json.NewDecoder(bytes.NewReader(data)), data}
+	dec.UseNumber()
+	var sections []*section
+	err := decodeJSONObject(dec, func(name string) error {
+		line := dec.line()
+		t, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		var s *section
+		if t == json.Delim('{') {
+			sections, s = lookupSection(sections, name)
+			if s.line == 0 {
+				s.line = line
+			}
+			return decodeJSONObject(dec, func(key string) error {
+				return readJSONValue(dec, s, key)
+			}, true)
+		}
+		sections, s = lookupSection(sections, defaultSection)
+		return addJSONValue(dec, s, name, line, t)
+	}, false)
+	if err != nil {
+		return nil, err
+	}
+	return sections, nil
+}
+
+// walks the keys of a JSON object calling fn to decode each value.
+func decodeJSONObject(dec *jsonDecoder, fn func(key string) error, opened bool) error {
+	if !opened {
+		t, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		if t != json.Delim('{') {
+			return fmt.Errorf("line %d: the document must be an object of section names", dec.line())
+		}
+	}
+	for dec.More() {
+		t, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		if err = fn(t.(string)); err != nil {
+			return err
+		}
+	}
+	_, err := dec.Token()
+	return err
+}
+
+// adds the next JSON value to the section, see addYAMLValue.
+func readJSONValue(dec *jsonDecoder, s *section, name string) error {
+	line := dec.line()
+	t, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	return addJSONValue(dec, s, name, line, t)
+}
+
+func addJSONValue(dec *jsonDecoder, s *section, name string, line int, t json.Token) error {
+	switch v := t.(type) {
+	case json.Delim:
+		if v == '{' {
+			return fmt.Errorf("line %d: '%s' is a nested object, the keys of a section must be flat", line, name)
+		}
+		var values []string
+		for dec.More() {
+			t, err := dec.Token()
+			if err != nil {
+				return err
+			}
+			if _, ok := t.(json.Delim); ok {
+				return fmt.Errorf("line %d: '%s' may only hold a list of values", dec.line(), name)
+			}
+			values = append(values, jsonScalar(t))
+		}
+		if _, err := dec.Token(); err != nil {
+			return err
+		}
+		s.entries = append(s.entries, entry{name: name, value: strings.Join(values, ", "), line: line})
+	default:
+		s.entries = append(s.entries, entry{name: name, value: jsonScalar(t), line: line})
+	}
+	return nil
+}
+
+func jsonScalar(t json.Token) string {
+	switch v := t.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case json.Number:
+		return v.String()
+	case bool:
+		return strconv.FormatBool(v)
+	}
+	return fmt.Sprint(t)
+}
+
+// TOML tables are sections, keys outside of a table belong to the DEFAULT
+// section.  The keys of a section are flat, nested tables and dotted keys
+// are errors.
+func parseTOML(data []byte) ([]*section, error) {
+	var values map[string]interface{}
+	md, err := toml.Decode(string(data), &values)
+	if err != nil {
+		return nil, err
+	}
+	var sections []*section
+	for _, key := range md.Keys() {
+		if isTOMLTable(md.Type(key...)) {
+			if len(key) > 1 {
+				return nil, fmt.Errorf("'%s' is a nested table, the keys of a section must be flat", strings.Join(key, "."))
+			}
+			sections, _ = lookupSection(sections, key[0])
+			continue
+		}
+		// values nested in an array are part of their parent key
+		v, ok := lookupTOML(values, key)
+		if !ok {
+			continue
+		}
+		if len(key) > 2 {
+			return nil, fmt.Errorf("'%s' is a dotted key, the keys of a section must be flat", strings.Join(key, "."))
+		}
+		name, sname := key[0], defaultSection
+		if len(key) > 1 {
+			name, sname = key[1], key[0]
+		}
+		value, err := tomlScalar(v)
+		if err != nil {
+			return nil, fmt.Errorf("'%s': %v", strings.Join(key, "."), err)
+		}
+		var s *section
+		sections, s = lookupSection(sections, sname)
+		s.entries = append(s.entries, entry{name: name, value: value})
+	}
+	setLines(data, sections)
+	return sections, nil
+}
+
+func isTOMLTable(typ string) bool {
+	return typ == "Hash"
+}
+
+func lookupTOML(values map[string]interface{}, key toml.Key) (interface{}, bool) {
+	var v interface{} = values
+	for _, k := range key {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if v, ok = m[k]; !ok {
+			return nil, false
+		}
+	}
+	return v, true
+}
+
+func tomlScalar(v interface{}) (string, error) {
+	switch t := v.(type) {
+	case string:
+		return t, nil
+	case bool:
+		return strconv.FormatBool(t), nil
+	case int64:
+		return strconv.FormatInt(t, 10), nil
+	case float64:
+		return strconv.FormatFloat(t, 'f', -1, 64), nil
+	case time.Time:
+		return t.Format(time.RFC3339), nil
+	case []interface{}:
+		var values []string
+		for _, item := range t {
+			s, err := tomlScalar(item)
+			if err != nil {
+				return "", err
+			}
+			if _, ok := item.([]interface{}); ok {
+				return "", fmt.Errorf("nested lists are not supported")
+			}
+			values = append(values, s)
+		}
+		return strings.Join(values, ", "), nil
+	}
+	return "", fmt.Errorf("unsupported value type %T", v)
+}
+
+// writes the sections in the given format.
+func writeSections(w io.Writer, format string, sections []*section) error {
+	switch format {
+	case Format_yaml:
+		return writeYAML(w, sections)
+	case Format_toml:
+		return writeTOML(w, sections)
+	case Format_json:
+		return writeJSON(w, sections)
+	case Format_ini:
+		return writeINI(w, sections)
+	}
+	return fmt.Errorf("unsupported configuration format '%s'", format)
+}
+
+// returns the sections with the DEFAULT section, if any, first.
+func defaultFirst(sections []*section) []*section {
+	var sorted []*section
+	for _, s := range sections {
+		if s.name == defaultSection {
+			sorted = append([]*section{s}, sorted...)
+		} else {
+			sorted = append(sorted, s)
+		}
+	}
+	return sorted
+}
+
+var integerValue = regexp.MustCompile(`^-?(0|[1-9][0-9]{0,17})$`)
+
+// the YAML, TOML and JSON type for a value read from a file.
+func valueType(v string) string {
+	if v == "true" || v == "false" {
+		return "bool"
+	}
+	if integerValue.MatchString(v) {
+		return "int"
+	}
+	return "string"
+}
+
+func writeINI(w io.Writer, sections []*section) error {
+	f := ini.Empty()
+	for _, s := range defaultFirst(sections) {
+		sec, err := f.NewSection(s.name)
+		if err != nil {
+			return err
+		}
+		for _, e := range s.entries {
+			if _, err = sec.NewKey(e.name, e.value); err != nil {
+				return err
+			}
+		}
+	}
+	_, err := f.WriteTo(w)
+	return err
+}
+
+func writeYAML(w io.Writer, sections []*section) error {
+	root := &yaml.Node{Kind: yaml.MappingNode}
+	for _, s := range defaultFirst(sections) {
+		values := root
+		if s.name != defaultSection {
+			values = &yaml.Node{Kind: yaml.MappingNode}
+			root.Content = append(root.Content, &yaml.Node{Kind: yaml.ScalarNode, Value: s.name}, values)
+		}
+		for _, e := range s.entries {
+			tag := "!!str"
+			if t := valueType(e.value); t != "string" {
+				tag = "!!" + t
+			}
+			value := &yaml.Node{Kind: yaml.ScalarNode, Tag: tag, Value: e.value}
+			values.Content = append(values.Content, &yaml.Node{Kind: yaml.ScalarNode, Value: e.name}, value)
+		}
+	}
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+	if err := enc.Encode(&yaml.Node{Kind: yaml.DocumentNode, Content: []*yaml.Node{root}}); err != nil {
+		return err
+	}
+	return enc.Close()
+}
+
+var bareTOMLKey = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+func tomlKey(k string) string {
+	if bareTOMLKey.MatchString(k) {
+		return k
+	}
+	return tomlString(k)
+}
+
+func tomlString(v string) string {
+	var b strings.Builder
+	b.WriteByte('"')
+	for _, r := range v {
+		switch r {
+		case '"':
+			b.WriteString(`\"`)
+		case '\\':
+			b.WriteString(`\\`)
+		case '\n':
+			b.WriteString(`\n`)
+		case '\r':
+			b.WriteString(`\r`)
+		case '\t':
+			b.WriteString(`\t`)
+		default:
+			if r < 0x20 || r == 0x7f {
+				fmt.Fprintf(&b, `\u%04X`, r)
+			} else {
+				b.WriteRune(r)
+			}
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+func writeTOML(w io.Writer, sections []*section) error {
+	var b strings.Builder
+	for i, s := range defaultFirst(sections) {
+		if s.name != defaultSection {
+			if i > 0 {
+				b.WriteString("\n")
+			}
+			fmt.Fprintf(&b, "[%s]\n", tomlKey(s.name))
+		}
+		for _, e := range s.entries {
+			value := e.value
+			if valueType(value) == "string" {
+				value = tomlString(value)
+			}
+			fmt.Fprintf(&b, "%s = %s\n", tomlKey(e.name), value)
+		}
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func writeJSON(w io.Writer, sections []*section) error {
+	var b bytes.Buffer
+	writeEntries := func(entries []entry, indent string) {
+		for i, e := range entries {
+			k, _ := json.Marshal(e.name)
+			v := []byte(e.value)
+			if valueType(e.value) == "string" {
+				v, _ = json.Marshal(e.value)
+			}
+			fmt.Fprintf(&b, "%s%s: %s", indent, k, v)
+			if i < len(entries)-1 {
+				b.WriteString(",")
+			}
+			b.WriteString("\n")
+		}
+	}
+	b.WriteString("{\n")
+	sorted := defaultFirst(sections)
+	for i, s := range sorted {
+		last := i == len(sorted)-1
+		if s.name == defaultSection {
+			writeEntries(s.entries, "  ")
+			if !last && len(s.entries) > 0 {
+				// the DEFAULT entries are followed by the sections
+				b.Truncate(b.Len() - 1)
+				b.WriteString(",\n")
+			}
+			continue
+		}
+		k, _ := json.Marshal(s.name)
+		fmt.Fprintf(&b, "  %s: {\n", k)
+		writeEntries(s.entries, "    ")
+		b.WriteString("  }")
+		if !last {
+			b.WriteString(",")
+		}
+		b.WriteString("\n")
+	}
+	b.WriteString("}\n")
+	_, err := w.Write(b.Bytes())
+	return err
+}
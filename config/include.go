@@ -0,0 +1,204 @@
+/*
+ * Copyright (C) 2025 by John J. Rushford jrushford@apache.org
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package config
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// the key listing the glob patterns of the files to include, it may only be
+// used outside of a section.
+const includeKey = "include"
+
+// the file extensions read from a configuration directory.
+var configExtensions = map[string]bool{
+	".ini":  true,
+	".conf": true,
+	".yaml": true,
+	".yml":  true,
+	".toml": true,
+	".json": true,
+}
+
+// reads the sections of a configuration file and of the files it includes,
+// or of every configuration file in a directory.  Sections are merged, a
+// section defined in two files is an error.  When the file does not exist,
+// the sections are read from the TNASCERT_ environment variables.
+func readConfig(path string) ([]*section, error) {
+	if _, err := os.Stat(path); errors.Is(err, fs.ErrNotExist) {
+		if sections := readEnvironment(); sections != nil {
+			return sections, nil
+		}
+	}
+	m := &merger{seen: make(map[string]bool)}
+	if err := m.read(path); err != nil {
+		return nil, err
+	}
+	return m.sections, nil
+}
+
+// returns the configuration files read by readConfig, the files of a
+// directory and the included files.
+func configFileSet(path string) ([]string, error) {
+	m := &merger{seen: make(map[string]bool)}
+	if err := m.read(path); err != nil {
+		return nil, err
+	}
+	return m.files, nil
+}
+
+// merges the sections of several files.
+type merger struct {
+	sections []*section
+	seen     map[string]bool
+	files    []string // the files read, in order
+}
+
+func (m *merger) read(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		files, err := configFiles(path)
+		if err != nil {
+			return err
+		}
+		for _, f := range files {
+			if err = m.read(f); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	if m.seen[abs] {
+		return nil
+	}
+	m.seen[abs] = true
+	m.files = append(m.files, path)
+
+	sections, err := readFile(path)
+	if err != nil {
+		return err
+	}
+	var includes []string
+	for _, s := range sections {
+		for _, e := range s.entries {
+			if e.name != includeKey {
+				continue
+			}
+			if s.name != defaultSection {
+				return fmt.Errorf("'%s' line %d: '%s' may not be used in section '%s'", path, e.line, includeKey, s.name)
+			}
+			for _, pattern := range strings.Split(os.ExpandEnv(e.value), ",") {
+				if pattern = strings.TrimSpace(pattern); pattern != "" {
+					includes = append(includes, pattern)
+				}
+			}
+		}
+		if err = m.add(s); err != nil {
+			return err
+		}
+	}
+
+	// included files are relative to the including file
+	for _, pattern := range includes {
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(filepath.Dir(path), pattern)
+		}
+		files, err := filepath.Glob(pattern)
+		if err != nil {
+			return fmt.Errorf("'%s': invalid include pattern '%s': %v", path, pattern, err)
+		}
+		sort.Strings(files)
+		for _, f := range files {
+			if err = m.read(f); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// adds a section, the DEFAULT section keys of each file are merged.
+func (m *merger) add(s *section) error {
+	var existing *section
+	for _, e := range m.sections {
+		if e.name == s.name {
+			existing = e
+			break
+		}
+	}
+	if existing == nil {
+		s.entries = withoutKey(s.entries, includeKey)
+		m.sections = append(m.sections, s)
+		return nil
+	}
+	if s.name != defaultSection {
+		return fmt.Errorf("section '%s' is defined in both '%s' line %d and '%s' line %d", s.name, existing.file, existing.line, s.file, s.line)
+	}
+	for _, e := range withoutKey(s.entries, includeKey) {
+		for _, x := range existing.entries {
+			if canonical(x.name) == canonical(e.name) {
+				return fmt.Errorf("the %s key '%s' is defined in both '%s' line %d and '%s' line %d", defaultSection, e.name, x.file, x.line, e.file, e.line)
+			}
+		}
+		existing.entries = append(existing.entries, e)
+	}
+	return nil
+}
+
+// returns the entries without the named key.
+func withoutKey(entries []entry, name string) []entry {
+	var result []entry
+	for _, e := range entries {
+		if e.name != name {
+			result = append(result, e)
+		}
+	}
+	return result
+}
+
+// returns the configuration files of a directory in name order, hidden
+// files and files with other extensions are skipped.
+func configFiles(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || strings.HasPrefix(name, ".") || !configExtensions[strings.ToLower(filepath.Ext(name))] {
+			continue
+		}
+		files = append(files, filepath.Join(dir, name))
+	}
+	return files, nil
+}
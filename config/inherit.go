@@ -0,0 +1,206 @@
+/*
+ * Copyright (C) 2025 by John J. Rushford jrushford@apache.org
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package config
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+// the key naming the section that a section inherits its values from.
+const inheritKey = "inherit"
+
+// the key marking a section as a template, only inherited from and never
+// loaded as a configuration of its own.
+const templateKey = "template"
+
+// keys whose values are never printed.
+var secretKeys = map[string]bool{
+	"api_key":              true,
+	"password":             true,
+	"proxy_password":       true,
+	"pkcs12_password":      true,
+	"private_key_password": true,
+}
+
+// a key value after inheritance has been resolved, with the section where
+// the value was defined.
+type resolvedEntry struct {
+	entry
+	section string
+}
+
+// resolves section inheritance.  A section inherits the values of the
+// section named by its 'inherit' key, or of the DEFAULT section when it has
+// no 'inherit' key.  Values defined in a section override inherited ones.
+type resolver struct {
+	sections map[string]*section
+	resolved map[string][]resolvedEntry
+}
+
+func newResolver(sections []*section) (*resolver, error) {
+	r := &resolver{
+		sections: make(map[string]*section),
+		resolved: make(map[string][]resolvedEntry),
+	}
+	for _, s := range sections {
+		r.sections[s.name] = s
+	}
+	if s, ok := r.sections[defaultSection]; ok && s.lookup(inheritKey) != "" {
+		return nil, fmt.Errorf("the %s section may not use '%s'", defaultSection, inheritKey)
+	}
+	return r, nil
+}
+
+// returns true when the section is marked as a template by its own
+// 'template' key, the key is not inherited.
+func (r *resolver) template(name string) (bool, error) {
+	s, ok := r.sections[name]
+	if !ok {
+		return false, nil
+	}
+	value := s.lookup(templateKey)
+	if value == "" {
+		return false, nil
+	}
+	template, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, errorf(templateKey, "'%s' must be true or false, got '%s'", templateKey, value)
+	}
+	return template, nil
+}
+
+// returns the value of a key defined in the section itself.
+func (s *section) lookup(name string) string {
+	for _, e := range s.entries {
+		if e.name == name {
+			return strings.TrimSpace(e.value)
+		}
+	}
+	return ""
+}
+
+// returns the resolved values of a section.
+func (r *resolver) resolve(name string) ([]resolvedEntry, error) {
+	return r.resolveChain(name, nil)
+}
+
+func (r *resolver) resolveChain(name string, chain []string) ([]resolvedEntry, error) {
+	if entries, ok := r.resolved[name]; ok {
+		return entries, nil
+	}
+	for _, n := range chain {
+		if n == name {
+			return nil, fmt.Errorf("inheritance cycle: %s -> %s", strings.Join(chain, " -> "), name)
+		}
+	}
+	s, ok := r.sections[name]
+	if !ok {
+		if len(chain) > 0 {
+			return nil, fmt.Errorf("section '%s' inherits from '%s' which is not defined", chain[len(chain)-1], name)
+		}
+		return nil, fmt.Errorf("section '%s' is not defined", name)
+	}
+
+	var entries []resolvedEntry
+	parent := s.lookup(inheritKey)
+	if parent == "" && name != defaultSection {
+		if _, ok := r.sections[defaultSection]; ok {
+			parent = defaultSection
+		}
+	}
+	if parent != "" {
+		inherited, err := r.resolveChain(parent, append(chain, name))
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, inherited...)
+	}
+
+	for _, e := range s.entries {
+		if e.name == inheritKey || e.name == templateKey {
+			continue
+		}
+		// a key given by its alias overrides the inherited key, and the
+		// other way around
+		re := resolvedEntry{entry: e, section: s.name}
+		replaced := false
+		for i := range entries {
+			if canonical(entries[i].name) == canonical(e.name) {
+				entries[i] = re
+				replaced = true
+				break
+			}
+		}
+		if !replaced {
+			entries = append(entries, re)
+		}
+	}
+	r.resolved[name] = entries
+	return entries, nil
+}
+
+// returns a section holding the resolved values of the named section.
+func (r *resolver) flatten(name string) (*section, error) {
+	entries, err := r.resolve(name)
+	if err != nil {
+		return nil, err
+	}
+	s := &section{name: name, file: r.sections[name].file}
+	for _, e := range entries {
+		s.entries = append(s.entries, e.entry)
+	}
+	return s, nil
+}
+
+// Show prints the values of a configuration section after inheritance and
+// environment variables are resolved, along with the section and the file
+// each value came from.  Secret values are redacted, secret references such
+// as 'file:' and encrypted 'enc:' values are printed as written.
+func Show(w io.Writer, config_file string, name string) error {
+	sections, err := readConfig(config_file)
+	if err != nil {
+		return err
+	}
+	r, err := newResolver(sections)
+	if err != nil {
+		return err
+	}
+	entries, err := r.resolve(name)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(w, "[%s]\n", name)
+	tw := tabwriter.NewWriter(w, 0, 4, 1, ' ', 0)
+	for _, e := range entries {
+		value := e.value
+		if !e.fromEnv {
+			value = os.ExpandEnv(value)
+		}
+		if secretKeys[e.name] && value != "" && !isSecretRef(value) && !isEncrypted(value) {
+			value = "<redacted>"
+		}
+		fmt.Fprintf(tw, "%s\t= %s\t# from [%s] in %s\n", e.name, value, e.section, e.file)
+	}
+	return tw.Flush()
+}
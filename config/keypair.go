@@ -0,0 +1,336 @@
+/*
+ * Copyright (C) 2025 by John J. Rushford jrushford@apache.org
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package config
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/youmark/pkcs8"
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+// KeyPair is the certificate chain and the private key deployed to TrueNAS,
+// in the PEM format expected by certificate.create.
+type KeyPair struct {
+	CertificatePEM []byte // the certificate chain, leaf first
+	PrivateKeyPEM  []byte
+}
+
+// Chain returns the certificates of the chain, leaf first.
+func (k *KeyPair) Chain() ([]*x509.Certificate, error) {
+	var chain []*x509.Certificate
+	data := k.CertificatePEM
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("certificate parsing error: %v", err)
+		}
+		chain = append(chain, cert)
+	}
+	if len(chain) == 0 {
+		return nil, errors.New("no certificate was found")
+	}
+	return chain, nil
+}
+
+// returns the public key of the private key.
+func (k *KeyPair) publicKey() (crypto.PublicKey, error) {
+	block, _ := pem.Decode(k.PrivateKeyPEM)
+	if block == nil {
+		return nil, errors.New("no private key was found")
+	}
+	var key interface{}
+	var err error
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	default:
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error parsing the private key: %v", err)
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported private key type %T", key)
+	}
+	return signer.Public(), nil
+}
+
+// LoadKeyPair returns the certificate chain and the private key of the
+// full_chain_path and private_key_path, of the bundle_path or of the
+// pkcs12_path, normalized to PEM.  The certificates may be PEM or DER and
+// the key may be DER or encrypted with the private_key_password.  A
+// PKCS#12 bundle or an encrypted key is decrypted in memory, the key is never
+// written to disk, and only once so that the password secret is resolved
+// once, an exec: password command is stopped when ctx is done.  With
+// rebuild_chain the chain is rebuilt, see rebuildChain.
+func (c *Config) LoadKeyPair(ctx context.Context) (*KeyPair, error) {
+	source := c.FullChainPath + "\x00" + c.PrivateKeyPath + "\x00" + c.BundlePath + "\x00" + c.PKCS12Path
+	if c.keyPair != nil && c.keyPairSource == source {
+		return c.keyPair, nil
+	}
+	var keyPair *KeyPair
+	var err error
+	if c.PKCS12Path != "" {
+		keyPair, err = c.loadPKCS12(ctx)
+	} else {
+		keyPair, err = c.loadPEM(ctx)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if c.RebuildChain {
+		if err = c.rebuildKeyPair(keyPair); err != nil {
+			return nil, err
+		}
+	}
+	if c.PKCS12Path != "" || c.PrivateKeyPassword != "" {
+		c.keyPair, c.keyPairSource = keyPair, source
+	}
+	return keyPair, nil
+}
+
+// LoadChain returns the certificate chain to deploy, leaf first, rebuilt
+// with rebuild_chain.  The private key is only read with the chain of a
+// pkcs12_path or with rebuild_chain, to find the leaf.
+func (c *Config) LoadChain(ctx context.Context) ([]*x509.Certificate, error) {
+	if c.PKCS12Path != "" || c.RebuildChain {
+		keyPair, err := c.LoadKeyPair(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return keyPair.Chain()
+	}
+	certPem, _, err := c.readCertificates()
+	if err != nil {
+		return nil, err
+	}
+	return (&KeyPair{CertificatePEM: certPem}).Chain()
+}
+
+// reads the certificates of the full_chain_path or of the bundle_path as
+// PEM, the data of the file is also returned.
+func (c *Config) readCertificates() ([]byte, []byte, error) {
+	path := c.FullChainPath
+	if c.BundlePath != "" {
+		path = c.BundlePath
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error reading the certificate file: %v", err)
+	}
+	var certPem bytes.Buffer
+	rest := data
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if block.Type == "CERTIFICATE" {
+			pem.Encode(&certPem, &pem.Block{Type: block.Type, Bytes: block.Bytes})
+		}
+	}
+	if certPem.Len() == 0 && c.BundlePath == "" {
+		// the DER certificates of the chain
+		certs, err := x509.ParseCertificates(data)
+		if err != nil || len(certs) == 0 {
+			return nil, nil, fmt.Errorf("no PEM or DER certificate was found in '%s'", path)
+		}
+		for _, cert := range certs {
+			pem.Encode(&certPem, &pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+		}
+	}
+	if certPem.Len() == 0 {
+		return nil, nil, fmt.Errorf("no certificate was found in '%s'", path)
+	}
+	return certPem.Bytes(), data, nil
+}
+
+// reads the certificates and the private key of the full_chain_path and
+// private_key_path, or of the bundle_path.
+func (c *Config) loadPEM(ctx context.Context) (*KeyPair, error) {
+	certPem, data, err := c.readCertificates()
+	if err != nil {
+		return nil, err
+	}
+	path := c.BundlePath
+	if path == "" {
+		path = c.PrivateKeyPath
+		if data, err = os.ReadFile(path); err != nil {
+			return nil, fmt.Errorf("error reading the private key file: %v", err)
+		}
+	}
+	keyPem, err := c.decodePrivateKey(ctx, data, path)
+	if err != nil {
+		return nil, err
+	}
+	return &KeyPair{CertificatePEM: certPem, PrivateKeyPEM: keyPem}, nil
+}
+
+// returns the PEM of the private key in data, a PEM or DER key that may be
+// encrypted with the private_key_password.  An encrypted key is returned as
+// PKCS#8, the others keep their format.
+func (c *Config) decodePrivateKey(ctx context.Context, data []byte, path string) ([]byte, error) {
+	var key *pem.Block
+	for rest := data; ; {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if strings.HasSuffix(block.Type, "PRIVATE KEY") {
+			if key != nil {
+				return nil, fmt.Errorf("'%s' holds more than one private key", path)
+			}
+			key = block
+		}
+	}
+	if key == nil {
+		if c.BundlePath != "" {
+			return nil, fmt.Errorf("no private key was found in '%s'", path)
+		}
+		// a DER key, either PKCS#8, PKCS#1, SEC 1 or encrypted PKCS#8
+		if _, err := x509.ParsePKCS8PrivateKey(data); err == nil {
+			key = &pem.Block{Type: "PRIVATE KEY", Bytes: data}
+		} else if _, err := x509.ParsePKCS1PrivateKey(data); err == nil {
+			key = &pem.Block{Type: "RSA PRIVATE KEY", Bytes: data}
+		} else if _, err := x509.ParseECPrivateKey(data); err == nil {
+			key = &pem.Block{Type: "EC PRIVATE KEY", Bytes: data}
+		} else {
+			key = &pem.Block{Type: "ENCRYPTED PRIVATE KEY", Bytes: data}
+		}
+	}
+
+	// the legacy PEM encryption is deprecated but such keys are still found
+	legacy := x509.IsEncryptedPEMBlock(key)
+	if key.Type != "ENCRYPTED PRIVATE KEY" && !legacy {
+		return pem.EncodeToMemory(&pem.Block{Type: key.Type, Bytes: key.Bytes}), nil
+	}
+	if c.PrivateKeyPassword == "" {
+		return nil, fmt.Errorf("the private key of '%s' is encrypted or invalid, set the private_key_password if it is encrypted", path)
+	}
+	password, err := c.ResolvePrivateKeyPassword(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if legacy {
+		der, err := x509.DecryptPEMBlock(key, []byte(password))
+		if err != nil {
+			return nil, fmt.Errorf("the private_key_password does not decrypt the private key of '%s'", path)
+		}
+		return pem.EncodeToMemory(&pem.Block{Type: key.Type, Bytes: der}), nil
+	}
+	privateKey, err := pkcs8.ParsePKCS8PrivateKey(key.Bytes, []byte(password))
+	if err != nil {
+		return nil, fmt.Errorf("the private_key_password does not decrypt the private key of '%s': %v", path, err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	if err != nil {
+		return nil, fmt.Errorf("error encoding the private key of '%s': %v", path, err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), nil
+}
+
+// decodes the PKCS#12 bundle of the pkcs12_path.  The leaf is the
+// certificate of the private key, whatever its place in the bundle, and is
+// followed by its issuers.
+func (c *Config) loadPKCS12(ctx context.Context) (*KeyPair, error) {
+	data, err := os.ReadFile(c.PKCS12Path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading the pkcs12_path: %v", err)
+	}
+	password, err := c.ResolvePKCS12Password(ctx)
+	if err != nil {
+		return nil, err
+	}
+	key, first, others, err := pkcs12.DecodeChain(data, password)
+	if errors.Is(err, pkcs12.ErrIncorrectPassword) {
+		return nil, fmt.Errorf("the pkcs12_password does not decrypt '%s'", c.PKCS12Path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error decoding the pkcs12_path '%s': %v", c.PKCS12Path, err)
+	}
+
+	certs := append([]*x509.Certificate{first}, others...)
+	leaf := -1
+	if signer, ok := key.(crypto.Signer); ok {
+		for i, cert := range certs {
+			if pub, ok := cert.PublicKey.(interface{ Equal(crypto.PublicKey) bool }); ok && pub.Equal(signer.Public()) {
+				leaf = i
+				break
+			}
+		}
+	}
+	if leaf < 0 {
+		return nil, fmt.Errorf("the private key of '%s' matches none of its certificates", c.PKCS12Path)
+	}
+	leafCert := certs[leaf]
+	certs = append(certs[:leaf:leaf], certs[leaf+1:]...)
+
+	keyDer, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("error encoding the private key of '%s': %v", c.PKCS12Path, err)
+	}
+	return &KeyPair{
+		CertificatePEM: encodeCertificates(orderChain(leafCert, certs)),
+		PrivateKeyPEM:  pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDer}),
+	}, nil
+}
+
+// returns the leaf followed by its issuers found in certs, the certificates
+// that are not part of its chain are kept after them.
+func orderChain(leaf *x509.Certificate, certs []*x509.Certificate) []*x509.Certificate {
+	chain := []*x509.Certificate{leaf}
+	rest := append([]*x509.Certificate(nil), certs...)
+	for current := leaf; ; {
+		issuer := -1
+		for i, cert := range rest {
+			if bytes.Equal(current.RawIssuer, cert.RawSubject) && current.CheckSignatureFrom(cert) == nil {
+				issuer = i
+				break
+			}
+		}
+		if issuer < 0 {
+			break
+		}
+		current = rest[issuer]
+		chain = append(chain, current)
+		rest = append(rest[:issuer], rest[issuer+1:]...)
+	}
+	return append(chain, rest...)
+}
@@ -0,0 +1,189 @@
+/*
+ * Copyright (C) 2025 by John J. Rushford jrushford@apache.org
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package config
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// secret reference schemes
+const (
+	secretFile = "file:" // read the secret from a file
+	secretExec = "exec:" // read the secret from the output of a command
+	secretCred = "cred:" // read the secret from a systemd credential
+)
+
+// the environment variable set by systemd to the directory holding the
+// credentials of 'LoadCredential='.
+const credentialsDirectory = "CREDENTIALS_DIRECTORY"
+
+// returns true if the value refers to a secret stored elsewhere.
+func isSecretRef(value string) bool {
+	return strings.HasPrefix(value, secretFile) ||
+		strings.HasPrefix(value, secretExec) ||
+		strings.HasPrefix(value, secretCred)
+}
+
+// ResolveApiKey returns the api_key, the secret is read when a reference
+// such as 'file:', 'exec:' or 'cred:' is used.
+func (c *Config) ResolveApiKey(ctx context.Context) (string, error) {
+	return resolveSecret(ctx, "api_key", c.ApiKey)
+}
+
+// ResolvePassword returns the password, the secret is read when a reference
+// such as 'file:', 'exec:' or 'cred:' is used.
+func (c *Config) ResolvePassword(ctx context.Context) (string, error) {
+	return resolveSecret(ctx, "password", c.Password)
+}
+
+// ResolveProxyPassword returns the proxy_password, the secret is read when
+// a reference such as 'file:', 'exec:' or 'cred:' is used.
+func (c *Config) ResolveProxyPassword(ctx context.Context) (string, error) {
+	return resolveSecret(ctx, "proxy_password", c.ProxyPassword)
+}
+
+// ResolvePKCS12Password returns the pkcs12_password, the secret is read
+// when a reference such as 'file:', 'exec:' or 'cred:' is used.
+func (c *Config) ResolvePKCS12Password(ctx context.Context) (string, error) {
+	return resolveSecret(ctx, "pkcs12_password", c.PKCS12Password)
+}
+
+// ResolvePrivateKeyPassword returns the private_key_password, the secret is
+// read when a reference such as 'file:', 'exec:' or 'cred:' is used.
+func (c *Config) ResolvePrivateKeyPassword(ctx context.Context) (string, error) {
+	return resolveSecret(ctx, "private_key_password", c.PrivateKeyPassword)
+}
+
+// returns the secret a value refers to, or the value itself when it is not
+// a secret reference.  Errors name the key and the reference but never the
+// secret.
+func resolveSecret(ctx context.Context, key string, value string) (string, error) {
+	var secret []byte
+	var err error
+	switch {
+	case strings.HasPrefix(value, secretFile):
+		path := strings.TrimSpace(strings.TrimPrefix(value, secretFile))
+		if secret, err = os.ReadFile(path); err != nil {
+			return "", fmt.Errorf("error reading the '%s' secret file: %w", key, err)
+		}
+	case strings.HasPrefix(value, secretExec):
+		args, err := splitWords(strings.TrimPrefix(value, secretExec))
+		if err != nil {
+			return "", fmt.Errorf("invalid command for the '%s' secret: %v", key, err)
+		}
+		if len(args) == 0 {
+			return "", fmt.Errorf("no command is given for the '%s' secret", key)
+		}
+		var stdout bytes.Buffer
+		cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+		cmd.Stdin = os.Stdin
+		cmd.Stdout = &stdout
+		cmd.Stderr = os.Stderr
+		if err = cmd.Run(); err != nil {
+			return "", fmt.Errorf("the '%s' secret command '%s' failed: %w", key, args[0], err)
+		}
+		secret = stdout.Bytes()
+	case strings.HasPrefix(value, secretCred):
+		name := strings.TrimSpace(strings.TrimPrefix(value, secretCred))
+		dir := os.Getenv(credentialsDirectory)
+		if dir == "" {
+			return "", fmt.Errorf("the '%s' secret uses the credential '%s' but %s is not set", key, name, credentialsDirectory)
+		}
+		if name == "" || strings.ContainsAny(name, `/\`) {
+			return "", fmt.Errorf("invalid credential name '%s' for the '%s' secret", name, key)
+		}
+		if secret, err = os.ReadFile(filepath.Join(dir, name)); err != nil {
+			return "", fmt.Errorf("error reading the '%s' credential: %w", key, err)
+		}
+	default:
+		return value, nil
+	}
+
+	s := strings.TrimSpace(string(secret))
+	if s == "" {
+		return "", fmt.Errorf("the '%s' secret is empty", key)
+	}
+	return s, nil
+}
+
+// splits the command of an 'exec:' secret into its words as a POSIX shell
+// does, without running a shell: single quotes keep every character, double
+// quotes keep all but the backslash escaping '"', '\', '$' and '`', and a
+// backslash outside of quotes escapes the next character.  No variable,
+// glob or other expansion is done.
+func splitWords(line string) ([]string, error) {
+	var words []string
+	var word strings.Builder
+	inWord := false
+	for i := 0; i < len(line); i++ {
+		ch := line[i]
+		switch {
+		case ch == ' ' || ch == '\t' || ch == '\n':
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		case ch == '\\':
+			if i+1 == len(line) {
+				return nil, errors.New("a backslash ends the command")
+			}
+			i++
+			word.WriteByte(line[i])
+			inWord = true
+		case ch == '\'':
+			end := strings.IndexByte(line[i+1:], '\'')
+			if end < 0 {
+				return nil, errors.New("a single quote is not closed")
+			}
+			word.WriteString(line[i+1 : i+1+end])
+			i += end + 1
+			inWord = true
+		case ch == '"':
+			closed := false
+			for i++; i < len(line); i++ {
+				if line[i] == '"' {
+					closed = true
+					break
+				}
+				if line[i] == '\\' && i+1 < len(line) && strings.IndexByte("\"\\$`", line[i+1]) >= 0 {
+					i++
+				}
+				word.WriteByte(line[i])
+			}
+			if !closed {
+				return nil, errors.New("a double quote is not closed")
+			}
+			inWord = true
+		default:
+			word.WriteByte(ch)
+			inWord = true
+		}
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words, nil
+}
@@ -0,0 +1,139 @@
+/*
+ * Copyright (C) 2025 by John J. Rushford jrushford@apache.org
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// Value is a key and its value in a new configuration section.
+type Value struct {
+	Key   string
+	Value string
+}
+
+// returns the sections of an existing configuration file, none when it does
+// not exist yet.
+func existingSections(config_file string) ([]*section, error) {
+	if _, err := os.Stat(config_file); errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	return readConfig(config_file)
+}
+
+// returns the file a new section is written to, <section>.ini in a
+// configuration directory.
+func sectionFile(config_file string, name string) string {
+	if info, err := os.Stat(config_file); err == nil && info.IsDir() {
+		return filepath.Join(config_file, name+".ini")
+	}
+	return config_file
+}
+
+// Defined returns true if the section is defined in the configuration file.
+func Defined(config_file string, name string) (bool, error) {
+	sections, err := existingSections(config_file)
+	if err != nil {
+		return false, err
+	}
+	for _, s := range sections {
+		if s.name == name {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// NewSection returns the configuration of a new section holding the values.
+// The section inherits the DEFAULT section of the configuration file when
+// the file exists and the values are validated like those read from a file.
+func NewSection(config_file string, name string, values []Value) (*Config, error) {
+	sections, err := existingSections(config_file)
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range sections {
+		if s.name == name {
+			return nil, fmt.Errorf("section '%s' is already defined in '%s'", name, s.file)
+		}
+	}
+	s := &section{name: name, file: sectionFile(config_file, name)}
+	for _, v := range values {
+		s.entries = append(s.entries, entry{name: v.Key, value: v.Value, file: s.file})
+	}
+	r, err := newResolver(append(sections, s))
+	if err != nil {
+		return nil, err
+	}
+	flat, err := r.flatten(name)
+	if err != nil {
+		return nil, err
+	}
+	var c = Config{}
+	if err = c.load(flat.entries); err != nil {
+		return nil, fmt.Errorf("error in section '%s': %v", name, err)
+	}
+	if err = c.decrypt(&identities{}); err != nil {
+		return nil, fmt.Errorf("error in section '%s': %v", name, err)
+	}
+	c.file = s.file
+	return &c, nil
+}
+
+// AppendSection validates a new section and appends it to the INI
+// configuration file, which is created when needed.  When config_file is a
+// directory the section is written to the <section>.ini file in it.  Returns
+// the file written.
+func AppendSection(config_file string, name string, values []Value) (string, error) {
+	c, err := NewSection(config_file, name, values)
+	if err != nil {
+		return "", err
+	}
+	file := c.File()
+	if format := FormatFromPath(file); format != Format_ini {
+		return "", fmt.Errorf("sections can only be appended to INI files, '%s' is a %s file", file, format)
+	}
+
+	s := &section{name: name}
+	for _, v := range values {
+		s.entries = append(s.entries, entry{name: v.Key, value: v.Value})
+	}
+	var buf bytes.Buffer
+	if info, err := os.Stat(file); err == nil && info.Size() > 0 {
+		buf.WriteString("\n")
+	}
+	if err = writeINI(&buf, []*section{s}); err != nil {
+		return "", err
+	}
+
+	// the section may hold credentials, keep a new file private to the owner
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return "", err
+	}
+	if _, err = f.Write(buf.Bytes()); err != nil {
+		f.Close()
+		return "", err
+	}
+	return file, f.Close()
+}
@@ -3,13 +3,22 @@ module tnascert-deploy
 go 1.24
 
 require (
+	filippo.io/age v1.2.1
+	github.com/BurntSushi/toml v1.5.0
+	github.com/gorilla/websocket v1.5.3
 	github.com/ncruces/go-strftime v1.0.0
 	github.com/pborman/getopt/v2 v2.1.0
 	github.com/truenas/api_client_golang v0.0.0-20250820184128-fc6edc0b6ebe
+	github.com/youmark/pkcs8 v0.0.0-20240726163527-a2c0da244d78
+	golang.org/x/crypto v0.24.0
+	golang.org/x/net v0.26.0
 	gopkg.in/ini.v1 v1.67.0
+	gopkg.in/yaml.v3 v3.0.1
+	software.sslmate.com/src/go-pkcs12 v0.5.0
 )
 
 require (
-	github.com/gorilla/websocket v1.5.3 // indirect
 	github.com/stretchr/testify v1.11.1 // indirect
+	golang.org/x/sys v0.21.0 // indirect
+	golang.org/x/text v0.16.0 // indirect
 )
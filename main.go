@@ -18,13 +18,21 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"github.com/pborman/getopt/v2"
 	"log"
+	"net"
 	"os"
+	"os/signal"
 	"runtime/debug"
+	"strconv"
+	"syscall"
+	"time"
 	"tnascert-deploy/clients"
 	"tnascert-deploy/clients/restapi"
+	"tnascert-deploy/clients/sshapi"
 	"tnascert-deploy/clients/wsapi"
 	"tnascert-deploy/config"
 )
@@ -43,15 +51,179 @@ func NewClient(cfg *config.Config) (clients.Client, error) {
 			log.Printf("using a wsapi client")
 		}
 		return wsapi.NewClient(cfg)
+	} else if cfg.ClientApi == "legacyws" {
+		if cfg.Debug {
+			log.Printf("using a legacy DDP websocket client")
+		}
+		return wsapi.NewLegacyClient(cfg)
+	} else if cfg.ClientApi == "local" {
+		if cfg.Debug {
+			log.Printf("using a local middlewared socket client")
+		}
+		return wsapi.NewLocalClient(cfg)
+	} else if cfg.ClientApi == "ssh" {
+		if cfg.Debug {
+			log.Printf("using an ssh client running midclt")
+		}
+		return sshapi.NewClient(cfg)
 	}
 	return nil, fmt.Errorf("empty or undefined client api in the config for %s", cfg.ConnectHost)
 }
 
+// the deployment steps run for each configuration section, in order.
+type step struct {
+	name string
+	run  func(ctx context.Context) error
+}
+
+// how long closing a client connection may take once a deployment has
+// finished or was interrupted.
+const closeTimeout = 5 * time.Second
+
+// deploy runs the deployment steps for one configuration section.  No new
+// step is started once the context is cancelled and the step that was
+// interrupted is reported in the returned error.  Unless allowDowngrade is
+// set, a bound certificate newer than the one deployed is not replaced.
+func deploy(ctx context.Context, section string, cfg *config.Config, allowDowngrade bool) error {
+	client, cfg, err := connect(ctx, section, cfg)
+	if err != nil {
+		return err
+	}
+	defer closeClient(ctx, client)
+
+	steps := []step{{"preinstall", client.PreInstall}}
+	if fetcher, ok := client.(clients.CertificateFetcher); ok && !allowDowngrade && (cfg.AddAsUiCertificate || cfg.AddAsFTPCertificate) {
+		steps = append(steps, step{"downgrade check", func(ctx context.Context) error {
+			bound, err := fetcher.BoundCertificates(ctx)
+			if err != nil {
+				return fmt.Errorf("could not get the certificates in use: %w", err)
+			}
+			return clients.CheckDowngrade(ctx, cfg, bound)
+		}})
+	}
+	steps = append(steps, step{"installation", client.Install}, step{"post installation", client.PostInstall})
+	if cfg.AddAsUiCertificate && (cfg.TrustStore != "" || cfg.PinSHA256 != "") {
+		steps = append(steps, step{"trust store update", func(ctx context.Context) error {
+			return clients.TrustDeployedCertificate(ctx, cfg)
+		}})
+	}
+	if cfg.VerifyHost != "" {
+		steps = append(steps, step{"verification", func(ctx context.Context) error {
+			return verify(ctx, cfg)
+		}})
+	}
+	for _, s := range steps {
+		if ctx.Err() != nil {
+			return fmt.Errorf("'%s' stopped before the %s step: %w", section, s.name, context.Cause(ctx))
+		}
+		err = s.run(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return fmt.Errorf("'%s' interrupted during the %s step: %w", section, s.name, err)
+			}
+			return fmt.Errorf("%s tasks error, %w", s.name, err)
+		}
+	}
+	return nil
+}
+
+// connects and logs in to the first connect_host address that answers.  The
+// returned configuration uses that address.  The error of the last address
+// is returned when no client could be created or logged in for any address.
+func connect(ctx context.Context, section string, cfg *config.Config) (clients.Client, *config.Config, error) {
+	var loginErr error
+	hosts := cfg.ConnectHosts()
+	if cfg.ClientApi == "local" {
+		// the local client connects once to the middlewared socket, the
+		// connect_host only names the host in the logs
+		hosts = []string{cfg.ConnectHost}
+	}
+	for _, host := range hosts {
+		if ctx.Err() != nil {
+			return nil, nil, fmt.Errorf("'%s' stopped before the login step: %w", section, context.Cause(ctx))
+		}
+		hostCfg := cfg.WithConnectHost(host)
+		if hostCfg.ClientApi == "auto" {
+			api, err := clients.DetectAPI(ctx, hostCfg)
+			if err != nil {
+				if ctx.Err() != nil {
+					return nil, nil, fmt.Errorf("'%s' interrupted while detecting the client api: %w", section, err)
+				}
+				log.Printf("error detecting the client api of %s for '%s': %v", host, section, err)
+				loginErr = err
+				continue
+			}
+			log.Printf("'%s' detected the %s api over %s on %s", section, api.ClientApi, api.Protocol, host)
+			hostCfg = hostCfg.WithClientApi(api.ClientApi)
+		}
+		client, err := NewClient(hostCfg)
+		if err != nil {
+			log.Printf("error creating client for '%s' on %s: %v", section, hostCfg.HostName(), err)
+			loginErr = err
+			continue
+		}
+		err = client.Login(ctx)
+		if err == nil {
+			log.Printf("'%s' logged in to %s", section, hostCfg.HostName())
+			return client, hostCfg, nil
+		}
+		closeClient(ctx, client)
+		if ctx.Err() != nil {
+			return nil, nil, fmt.Errorf("'%s' interrupted during the login step: %w", section, err)
+		}
+		log.Printf("error logging in to %s for '%s': %v", hostCfg.HostName(), section, err)
+		loginErr = err
+	}
+	if loginErr == nil {
+		loginErr = errors.New("no connect_host address is defined")
+	}
+	return nil, nil, fmt.Errorf("login tasks error, %w", loginErr)
+}
+
+// closes a client connection, even when ctx has been cancelled.
+func closeClient(ctx context.Context, client clients.Client) {
+	closeCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), closeTimeout)
+	defer cancel()
+	err := client.Close(closeCtx)
+	if err != nil {
+		log.Printf("error closing the client connection, %v", err)
+	}
+}
+
+// checks that the verify_host serves the deployed certificate, polling while
+// the UI restarts for up to the ui_restart_timeout.
+func verify(ctx context.Context, cfg *config.Config) error {
+	address := cfg.VerifyHost
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		address = net.JoinHostPort(address, strconv.FormatUint(cfg.Port, 10))
+	}
+	ctx, cancel := context.WithTimeout(ctx, cfg.UIRestartTimeout)
+	defer cancel()
+	for {
+		err := clients.VerifyServedCertificate(ctx, address, cfg)
+		if err == nil {
+			log.Printf("%s serves the deployed certificate", address)
+			return nil
+		}
+		if cfg.Debug {
+			log.Printf("verification: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(5 * time.Second):
+		}
+	}
+}
+
 func main() {
 	help := getopt.BoolLong("help", 'h', "print usage information and exit")
 	version := getopt.BoolLong("version", 'v', "print version information and exit")
-	configFile := getopt.StringLong("config", 'c', config.Config_file, "full path to the configuration file")
-	getopt.SetParameters("config_section ... config_section")
+	configFile := getopt.StringLong("config", 'c', config.Config_file, "full path to the INI, YAML, TOML or JSON configuration file, or to a directory of them")
+	identityFile := getopt.StringLong("identity", 'i', "", "age identity file used to decrypt 'enc:' values, defaults to $"+config.IdentityEnv)
+	allowDowngrade := getopt.BoolLong("allow-downgrade", 0, "deploy the certificate even if it expires before, or covers fewer names than, the UI or FTP certificate it replaces")
+	deadline := getopt.DurationLong("deadline", 'd', 0, "maximum duration of the whole run, e.g. 5m, no limit if not set")
+	getopt.SetParameters("config_section ... config_section | config command ... | init")
 
 	getopt.Parse()
 	if *help == true {
@@ -69,6 +241,15 @@ func main() {
 		}
 	}
 	args := getopt.Args()
+	if *identityFile != "" {
+		config.IdentityFile = *identityFile
+	}
+	if len(args) > 0 && args[0] == "config" {
+		os.Exit(configCommand(args[1:], *configFile))
+	}
+	if len(args) > 0 && args[0] == "init" {
+		os.Exit(initCommand(args[1:], *configFile))
+	}
 	if len(args) == 0 {
 		args = append(args, config.Default_section)
 	}
@@ -78,46 +259,48 @@ func main() {
 		getopt.PrintUsage(os.Stdout)
 		log.Fatalln("error loading the config,", err)
 	}
+
+	ctx, cancel := context.WithCancelCause(context.Background())
+	defer cancel(nil)
+	if *deadline > 0 {
+		var cancelDeadline context.CancelFunc
+		ctx, cancelDeadline = context.WithTimeoutCause(ctx, *deadline, fmt.Errorf("the --deadline of %v was exceeded", *deadline))
+		defer cancelDeadline()
+	}
+
+	// the first SIGINT or SIGTERM cancels the run, a second one exits immediately.
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		log.Printf("received %v, stopping after cleaning up, send it again to exit immediately", sig)
+		cancel(fmt.Errorf("received signal %v", sig))
+		sig = <-signals
+		log.Fatalf("received %v again, exiting", sig)
+	}()
+
 	for i := 0; i < len(args); i++ {
+		if ctx.Err() != nil {
+			log.Printf("not processing '%s': %v", args[i], context.Cause(ctx))
+			continue
+		}
 		fmt.Printf("\n")
 		log.Printf("processing certificate installation for '%s'\n", args[i])
 		cfg, ok := cfgList[args[i]]
 		if !ok {
-			log.Fatalf("configuration %s was not found", args[i])
+			log.Fatalf("%v", config.NotLoaded(*configFile, args[i]))
 		}
-
-		client, err := NewClient(cfg)
-		if err != nil {
-			log.Printf("error creating client for '%s': %v", args[i], err)
-			continue
+		if cfg.Debug {
+			log.Printf("'%s' is defined in '%s'", args[i], cfg.File())
 		}
 
-		defer func(client clients.Client) {
-			err := client.Close()
-			if err != nil {
-				log.Printf("error closing the client connection, %v", err)
-			}
-		}(client)
-
-		err = client.Login()
+		err = deploy(ctx, args[i], cfg, *allowDowngrade)
 		if err != nil {
-			log.Printf("login error: %v", err)
-			os.Exit(1)
-		}
-		err = client.PreInstall()
-		if err != nil {
-			log.Printf("preinstall tasks error, %v", err)
-			os.Exit(1)
-		}
-		err = client.Install()
-		if err != nil {
-			log.Printf("installation tasks error, %v", err)
-			os.Exit(1)
-		}
-		err = client.PostInstall()
-		if err != nil {
-			log.Printf("post installation tasks error, %v", err)
+			log.Printf("%v", err)
 			os.Exit(1)
 		}
 	}
+	if ctx.Err() != nil {
+		os.Exit(1)
+	}
 }
@@ -0,0 +1,369 @@
+/*
+ * Copyright (C) 2025 by John J. Rushford jrushford@apache.org
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+	"tnascert-deploy/clients"
+	"tnascert-deploy/config"
+)
+
+// reads the answers to the questions of the init command.  The input is read
+// by a goroutine so that a question is abandoned when ctx is done.
+type prompter struct {
+	ctx   context.Context
+	in    *bufio.Reader
+	out   io.Writer
+	lines chan answer
+}
+
+// a line read from the input.
+type answer struct {
+	line string
+	err  error
+}
+
+// asks a question and returns the answer, or def when the answer is empty.
+// The error of ctx is returned when it is done before the answer is read.
+func (p *prompter) ask(question string, def string) (string, error) {
+	if def != "" {
+		fmt.Fprintf(p.out, "%s [%s]: ", question, def)
+	} else {
+		fmt.Fprintf(p.out, "%s: ", question)
+	}
+	if p.lines == nil {
+		p.lines = make(chan answer)
+		go func() {
+			for {
+				line, err := p.in.ReadString('\n')
+				p.lines <- answer{line, err}
+				if err != nil {
+					close(p.lines)
+					return
+				}
+			}
+		}()
+	}
+	var a answer
+	select {
+	case read, ok := <-p.lines:
+		if !ok {
+			return "", io.EOF
+		}
+		a = read
+	case <-p.ctx.Done():
+		return "", p.ctx.Err()
+	}
+	line, err := a.line, a.err
+	if err != nil && (err != io.EOF || line == "") {
+		return "", err
+	}
+	if line = strings.TrimSpace(line); line == "" {
+		return def, nil
+	}
+	return line, nil
+}
+
+// asks a question until it is answered.
+func (p *prompter) require(question string, def string) (string, error) {
+	for {
+		answer, err := p.ask(question, def)
+		if err != nil || answer != "" {
+			return answer, err
+		}
+	}
+}
+
+// asks a yes or no question.
+func (p *prompter) confirm(question string, def bool) (bool, error) {
+	choices := "y/N"
+	if def {
+		choices = "Y/n"
+	}
+	for {
+		answer, err := p.ask(question+" ("+choices+")", "")
+		if err != nil {
+			return false, err
+		}
+		switch strings.ToLower(answer) {
+		case "":
+			return def, nil
+		case "y", "yes":
+			return true, nil
+		case "n", "no":
+			return false, nil
+		}
+	}
+}
+
+// asks for a secret, the answer is not echoed when the input is a terminal.
+func (p *prompter) secret(question string) (string, error) {
+	if info, err := os.Stdin.Stat(); err == nil && info.Mode()&os.ModeCharDevice != 0 {
+		stty := func(arg string) error {
+			cmd := exec.Command("stty", arg)
+			cmd.Stdin = os.Stdin
+			return cmd.Run()
+		}
+		if stty("-echo") == nil {
+			defer func() {
+				stty("echo")
+				fmt.Fprintln(p.out)
+			}()
+		}
+	}
+	return p.ask(question, "")
+}
+
+// how long probing the API of the host may take.
+const probeTimeout = 10 * time.Second
+
+// the usage of the 'init' command.
+const initUsage = `usage: tnascert-deploy [-c config_file] [-i identity] init
+
+Asks for a TrueNAS host and its credentials, probes the API it serves, shows
+the certificates used by its UI, FTP service and apps, and appends a
+validated section for it to the configuration file.
+`
+
+// runs the interactive 'init' command and returns the process exit status.
+func initCommand(args []string, configFile string) int {
+	if len(args) != 0 {
+		fmt.Fprint(os.Stderr, initUsage)
+		return 2
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	p := &prompter{ctx: ctx, in: bufio.NewReader(os.Stdin), out: os.Stdout}
+	if err := runWizard(ctx, p, configFile); err != nil {
+		if ctx.Err() != nil {
+			fmt.Fprintln(os.Stderr, "\ninit interrupted")
+			return 1
+		}
+		fmt.Fprintf(os.Stderr, "\ninit error: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// asks the questions of the init command, probes the host and appends the
+// new section to the configuration file.
+func runWizard(ctx context.Context, p *prompter, configFile string) error {
+	fmt.Fprintf(p.out, "Adding a TrueNAS host to '%s'.\n\n", configFile)
+
+	name, err := p.require("section name", config.Default_section)
+	if err != nil {
+		return err
+	}
+	if defined, err := config.Defined(configFile, name); err != nil {
+		return err
+	} else if defined {
+		return fmt.Errorf("section '%s' is already defined in '%s'", name, configFile)
+	}
+
+	// find the API served by the host
+	host, err := p.require("TrueNAS host name or address", "")
+	if err != nil {
+		return err
+	}
+	answer, err := p.require("port", strconv.Itoa(config.Default_port))
+	if err != nil {
+		return err
+	}
+	port, err := strconv.ParseUint(answer, 10, 16)
+	if err != nil || port == 0 {
+		return fmt.Errorf("invalid port '%s'", answer)
+	}
+	probe := &config.Config{ConnectHost: host, Port: port, ConnectTimeout: probeTimeout}
+	fmt.Fprintf(p.out, "probing %s:%d ...\n", host, port)
+	api, err := clients.DetectAPI(ctx, probe)
+	if clients.IsCertificateError(err) {
+		fmt.Fprintf(p.out, "the certificate of %s cannot be verified: %v\n", host, err)
+		var skip bool
+		if skip, err = p.confirm("skip the certificate verification until a trusted certificate is deployed", false); err != nil {
+			return err
+		}
+		if !skip {
+			return fmt.Errorf("the certificate of %s cannot be verified", host)
+		}
+		probe.TlsSkipVerify = true
+		api, err = clients.DetectAPI(ctx, probe)
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(p.out, "%s serves the %s API over %s\n\n", host, api.ClientApi, api.Protocol)
+
+	// client_api = auto detects the API again at each run, the protocol is
+	// only needed when TLS is not used
+	values := []config.Value{{Key: "connect_host", Value: host}}
+	if api.Protocol == "ws" || api.Protocol == "http" {
+		values = append(values, config.Value{Key: "protocol", Value: api.Protocol})
+	}
+	if port != config.Default_port {
+		values = append(values, config.Value{Key: "port", Value: answer})
+	}
+	if probe.TlsSkipVerify {
+		values = append(values, config.Value{Key: "tls_skip_verify", Value: "true"})
+	}
+
+	// credentials
+	fmt.Fprintln(p.out, "Secrets may be given as is or as a $VARIABLE, file:, exec: or cred: reference.")
+	apiKey, err := p.secret("API key, empty to log in with a username and password")
+	if err != nil {
+		return err
+	}
+	if apiKey != "" {
+		if apiKey, err = protect(p, apiKey); err != nil {
+			return err
+		}
+		values = append(values, config.Value{Key: "api_key", Value: apiKey})
+	} else {
+		username, err := p.require("username", "admin")
+		if err != nil {
+			return err
+		}
+		password, err := p.secret("password")
+		if err != nil {
+			return err
+		}
+		if password, err = protect(p, password); err != nil {
+			return err
+		}
+		values = append(values, config.Value{Key: "username", Value: username}, config.Value{Key: "password", Value: password})
+	}
+
+	// the certificate to deploy
+	fullChain, err := p.require("full chain certificate file", "")
+	if err != nil {
+		return err
+	}
+	privateKey, err := p.require("private key file", "")
+	if err != nil {
+		return err
+	}
+	// the configuration is used from other directories
+	if fullChain, err = filepath.Abs(fullChain); err != nil {
+		return err
+	}
+	if privateKey, err = filepath.Abs(privateKey); err != nil {
+		return err
+	}
+	values = append(values, config.Value{Key: "full_chain_path", Value: fullChain}, config.Value{Key: "private_key_path", Value: privateKey})
+
+	cfg, err := config.NewSection(configFile, name, values)
+	if err != nil {
+		return err
+	}
+
+	// check the certificate to deploy
+	report, err := clients.Preflight(ctx, cfg)
+	if err != nil {
+		fmt.Fprintf(p.out, "warning: the certificate cannot be deployed as is: %v\n", err)
+	} else {
+		for _, problem := range report.Problems {
+			fmt.Fprintf(p.out, "certificate %s, %s: %s\n", problem.Severity, problem.Check, problem.Message)
+		}
+	}
+
+	// log in and show the certificates in use
+	client, err := NewClient(cfg.WithClientApi(api.ClientApi))
+	if err != nil {
+		return err
+	}
+	defer closeClient(ctx, client)
+	if err = client.Login(ctx); err != nil {
+		return err
+	}
+	bindings := &clients.Bindings{}
+	if inspector, ok := client.(clients.Inspector); ok {
+		if bindings, err = inspector.Bindings(ctx); err != nil {
+			return err
+		}
+	}
+	fmt.Fprintf(p.out, "\nlogged in to %s running %s\n", host, bindings.Version)
+	fmt.Fprintf(p.out, "  UI certificate:  %s\n", orNone(bindings.UICertificate))
+	fmt.Fprintf(p.out, "  FTP certificate: %s\n", orNone(bindings.FTPCertificate))
+	fmt.Fprintf(p.out, "  apps using a certificate: %s\n\n", orNone(strings.Join(bindings.Apps, ", ")))
+
+	addUI, err := p.confirm("use the deployed certificate for the UI", true)
+	if err != nil {
+		return err
+	}
+	addFTP, err := p.confirm("use the deployed certificate for the FTP service", bindings.FTPCertificate != "")
+	if err != nil {
+		return err
+	}
+	values = append(values,
+		config.Value{Key: "add_as_ui_certificate", Value: strconv.FormatBool(addUI)},
+		config.Value{Key: "add_as_ftp_certificate", Value: strconv.FormatBool(addFTP)})
+	if len(bindings.Apps) > 0 {
+		apps, err := p.ask("apps to update, comma separated, '-' for none", strings.Join(bindings.Apps, ","))
+		if err != nil {
+			return err
+		}
+		if apps != "-" {
+			values = append(values,
+				config.Value{Key: "add_as_app_certificate", Value: "true"},
+				config.Value{Key: "app_list", Value: apps})
+		}
+	}
+
+	file, err := config.AppendSection(configFile, name, values)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(p.out, "\nadded section '%s' to '%s', deploy the certificate with:\n\n", name, file)
+	fmt.Fprintf(p.out, "    tnascert-deploy -c %s %s\n", configFile, name)
+	return nil
+}
+
+// encrypts a secret given as is when an age identity file is set, a
+// reference or an already encrypted value is kept.
+func protect(p *prompter, value string) (string, error) {
+	if !config.IsPlainText(value) {
+		return value, nil
+	}
+	if config.IdentityFile == "" && os.Getenv(config.IdentityEnv) == "" {
+		fmt.Fprintln(p.out, "warning: the secret is written in plain text, use -i to encrypt it with an age identity")
+		return value, nil
+	}
+	recipients, err := config.ParseRecipients(nil)
+	if err != nil {
+		return "", err
+	}
+	return config.EncryptValue(value, recipients)
+}
+
+func orNone(s string) string {
+	if s == "" {
+		return "none"
+	}
+	return s
+}